@@ -0,0 +1,233 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+Download accounting for reader sessions.
+
+An Accountant counts the bytes downloaded by each user (ARTICLE, HEAD, BODY
+and the overview commands) and enforces block quotas: Once a user has used up
+the quota, further downloads are refused, until the counter is reset (for
+example, when a new block has been bought). The quota is soft: The size of a
+download is not known in advance, so the download, that uses the quota up, is
+completed, and the counter may exceed the quota by up to one article or
+overview range. The counters are persisted in a file. Additionally, every download can be passed to a Sink, such as a billing
+system.
+
+Anonymous readers are counted by their remote host, under the name
+"anonymous <host>", which Used and Reset accept as well.
+
+The Accountant is plugged into a fastnntp.Handler by wrapping its ArticleCaps
+with an ArticleCaps of this package.
+*/
+package accounting
+
+import "github.com/byte-mug/fastnntp"
+import "bufio"
+import "fmt"
+import "net"
+import "os"
+import "sync"
+import "time"
+
+// Receives the number of bytes downloaded by a session.
+type Sink interface{
+	Account(s *fastnntp.Session, n int64)
+}
+
+// A Go function as Sink.
+type SinkFunc func(s *fastnntp.Session, n int64)
+
+func (f SinkFunc) Account(s *fastnntp.Session, n int64) { f(s,n) }
+
+type Accountant struct{
+	// Returns the quota of a user (nil, if not authenticated; then the quota
+	// applies to each remote host), in bytes. Zero or less means: unlimited.
+	// If nil, all users are unlimited.
+	Quota func(user []byte) int64
+	
+	// Receives every download, in addition to the counters. May be nil.
+	Sink Sink
+	
+	// Changed counters are written to the file after this time, so the file
+	// is written at most this often. Defaults to 1 minute.
+	SaveInterval time.Duration
+	
+	fn     string
+	mu     sync.Mutex
+	used   map[string]int64
+	dirty  bool
+	timer  *time.Timer // The pending save, if any.
+	saveMu sync.Mutex
+}
+
+/*
+Opens an Accountant, whose counters are persisted in the given file. If the
+file does not exist, all counters start at zero. If fn is empty, the counters
+are only kept in memory.
+*/
+func Open(fn string) (*Accountant,error) {
+	a := &Accountant{fn:fn,used:make(map[string]int64)}
+	if fn=="" { return a,nil }
+	f,err := os.Open(fn)
+	if os.IsNotExist(err) { return a,nil }
+	if err!=nil { return nil,err }
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var user string
+		var n int64
+		if _,err := fmt.Sscanf(sc.Text(),"%q %d",&user,&n); err!=nil { continue }
+		a.used[user] = n
+	}
+	return a,sc.Err()
+}
+
+/*
+Returns the counter name of a session: The user name, or, for anonymous
+sessions, "anonymous <host>". As user names contain no spaces, these do not
+collide.
+*/
+func counterName(s *fastnntp.Session) string {
+	if s==nil { return "" }
+	if len(s.User)>0 { return string(s.User) }
+	if s.RemoteAddr==nil { return "" }
+	switch v := s.RemoteAddr.(type) {
+	case *net.TCPAddr: return "anonymous "+v.IP.String()
+	}
+	h,_,err := net.SplitHostPort(s.RemoteAddr.String())
+	if err!=nil { h = s.RemoteAddr.String() }
+	return "anonymous "+h
+}
+
+// Returns the number of bytes downloaded by a user.
+func (a *Accountant) Used(user []byte) int64 {
+	a.mu.Lock(); defer a.mu.Unlock()
+	return a.used[string(user)]
+}
+
+/*
+Returns the number of bytes, the user may still download. If the user is not
+limited, it returns false.
+*/
+func (a *Accountant) Remaining(user []byte) (n int64, limited bool) {
+	return a.remaining(string(user),user)
+}
+
+func (a *Accountant) remaining(name string, user []byte) (n int64, limited bool) {
+	if a.Quota==nil { return 0,false }
+	q := a.Quota(user)
+	if q<=0 { return 0,false }
+	a.mu.Lock()
+	n = q-a.used[name]
+	a.mu.Unlock()
+	if n<0 { n = 0 }
+	return n,true
+}
+
+// Sets the counter of a user to zero.
+func (a *Accountant) Reset(user []byte) {
+	a.mu.Lock()
+	delete(a.used,string(user))
+	a.changed()
+	a.mu.Unlock()
+}
+
+// Marks the counters as changed, and schedules a save. The lock must be held.
+func (a *Accountant) changed() {
+	a.dirty = true
+	if a.fn=="" || a.timer!=nil { return }
+	iv := a.SaveInterval
+	if iv<=0 { iv = time.Minute }
+	a.timer = time.AfterFunc(iv,func() { a.Save() })
+}
+
+/*
+Checks, whether the session may download. Downloads are refused, once the
+quota of the user is used up. As the size of the download is not known, it is
+permitted, as long as any quota remains.
+*/
+func (a *Accountant) Allow(s *fastnntp.Session) (ok bool, reason string) {
+	var user []byte
+	if s!=nil { user = s.User }
+	if n,limited := a.remaining(counterName(s),user); limited && n==0 {
+		return false,fmt.Sprint("Download quota of ",a.Quota(user)," bytes used up")
+	}
+	return true,""
+}
+
+/*
+Counts a download. The counters are written to the file in the background,
+within the SaveInterval.
+*/
+func (a *Accountant) Account(s *fastnntp.Session, n int64) {
+	if a.Sink!=nil { a.Sink.Account(s,n) }
+	a.mu.Lock()
+	a.used[counterName(s)] += n
+	a.changed()
+	a.mu.Unlock()
+}
+
+/*
+Writes the counters to the file atomically, if they have changed. If this
+fails, another attempt is made after the SaveInterval.
+*/
+func (a *Accountant) Save() error {
+	if a.fn=="" { return nil }
+	a.saveMu.Lock(); defer a.saveMu.Unlock()
+	a.mu.Lock()
+	if a.timer!=nil { a.timer.Stop(); a.timer = nil }
+	snap := make(map[string]int64,len(a.used))
+	for u,n := range a.used { snap[u] = n }
+	dirty := a.dirty
+	a.dirty = false
+	a.mu.Unlock()
+	
+	var err error
+	if dirty { err = writeCounters(a.fn,snap) }
+	if err!=nil {
+		a.mu.Lock()
+		a.changed()
+		a.mu.Unlock()
+	}
+	return err
+}
+
+/*
+Writes the counters, if necessary, and cancels the pending save. The Accountant
+remains usable.
+*/
+func (a *Accountant) Close() error { return a.Save() }
+
+func writeCounters(fn string,used map[string]int64) error {
+	tmp := fn+".tmp"
+	f,err := os.Create(tmp)
+	if err!=nil { return err }
+	w := bufio.NewWriter(f)
+	for u,n := range used { fmt.Fprintf(w,"%q %d\n",u,n) }
+	err = w.Flush()
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	if err!=nil { os.Remove(tmp); return err }
+	return os.Rename(tmp,fn)
+}
@@ -0,0 +1,110 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package accounting
+
+import "github.com/byte-mug/fastnntp"
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func user(name string) *fastnntp.Session {
+	return &fastnntp.Session{User:[]byte(name),RemoteAddr:&net.TCPAddr{IP:net.IPv4(192,0,2,1),Port:1119}}
+}
+func anon(ip string, port int) *fastnntp.Session {
+	return &fastnntp.Session{RemoteAddr:&net.TCPAddr{IP:net.ParseIP(ip),Port:port}}
+}
+
+func TestQuota(t *testing.T) {
+	a,err := Open("")
+	if err!=nil { t.Fatal(err) }
+	var sunk int64
+	a.Sink = SinkFunc(func(s *fastnntp.Session, n int64) { sunk += n })
+	a.Quota = func(u []byte) int64 {
+		if string(u)=="free" { return 0 }
+		return 1000
+	}
+	if ok,_ := a.Allow(user("alice")); !ok { t.Fatal("refused before any download") }
+	a.Account(user("alice"),600)
+	a.Account(user("alice"),600) // The quota is soft.
+	if ok,reason := a.Allow(user("alice")); ok || reason=="" { t.Error("allowed after the quota was used up") }
+	if n := a.Used([]byte("alice")); n!=1200 { t.Errorf("used %d, want 1200",n) }
+	if n,limited := a.Remaining([]byte("alice")); n!=0 || !limited { t.Errorf("remaining %d %v",n,limited) }
+	
+	a.Account(user("free"),5000)
+	if ok,_ := a.Allow(user("free")); !ok { t.Error("unlimited user refused") }
+	if _,limited := a.Remaining([]byte("free")); limited { t.Error("unlimited user is limited") }
+	
+	// Anonymous readers are counted per host, not per connection.
+	a.Account(anon("192.0.2.7",1000),700)
+	a.Account(anon("192.0.2.7",1001),300)
+	if ok,_ := a.Allow(anon("192.0.2.7",1002)); ok { t.Error("anonymous host allowed after the quota was used up") }
+	if ok,_ := a.Allow(anon("192.0.2.8",1000)); !ok { t.Error("other anonymous host refused") }
+	if n := a.Used([]byte("anonymous 192.0.2.7")); n!=1000 { t.Errorf("anonymous host used %d",n) }
+	
+	a.Reset([]byte("alice"))
+	if ok,_ := a.Allow(user("alice")); !ok { t.Error("refused after Reset") }
+	if sunk!=1200+5000+1000 { t.Errorf("Sink received %d bytes",sunk) }
+}
+
+func TestPersistence(t *testing.T) {
+	dir,err := ioutil.TempDir("","accounting")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir,"counters")
+	a,err := Open(fn)
+	if err!=nil { t.Fatal(err) }
+	a.SaveInterval = 50*time.Millisecond
+	a.Account(user("alice"),100)
+	a.Account(anon("2001:db8::1",1),200)
+	
+	// The counters are saved on a timer, without further downloads.
+	deadline := time.Now().Add(5*time.Second)
+	for {
+		b,err := Open(fn)
+		if err!=nil { t.Fatal(err) }
+		if b.Used([]byte("alice"))==100 && b.Used([]byte("anonymous 2001:db8::1"))==200 { break }
+		if time.Now().After(deadline) { t.Fatal("counters not saved by the timer") }
+		time.Sleep(10*time.Millisecond)
+	}
+	
+	// Close saves the latest counters.
+	a.SaveInterval = time.Hour
+	a.Account(user("alice"),50)
+	a.Reset([]byte("anonymous 2001:db8::1"))
+	if err = a.Close(); err!=nil { t.Fatal(err) }
+	a,err = Open(fn)
+	if err!=nil { t.Fatal(err) }
+	if n := a.Used([]byte("alice")); n!=150 { t.Errorf("alice: %d after reopen, want 150",n) }
+	if n := a.Used([]byte("anonymous 2001:db8::1")); n!=0 { t.Errorf("reset counter is %d after reopen",n) }
+	
+	// Malformed lines are skipped.
+	ioutil.WriteFile(fn,[]byte("\"alice\" 7\ngarbage\n\"bob\" x\n"),0644)
+	if a,err = Open(fn); err!=nil { t.Fatal(err) }
+	if a.Used([]byte("alice"))!=7 || a.Used([]byte("bob"))!=0 { t.Error("counters not read") }
+}
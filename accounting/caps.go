@@ -0,0 +1,43 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package accounting
+
+import "github.com/byte-mug/fastnntp"
+
+/*
+Wraps a fastnntp.ArticleCaps and adds download accounting. It implements
+fastnntp.DownloadAccountingCaps.
+*/
+type ArticleCaps struct{
+	fastnntp.ArticleCaps
+	Accountant *Accountant
+}
+
+func (c *ArticleCaps) AllowDownload(s *fastnntp.Session) (ok bool, reason string) {
+	return c.Accountant.Allow(s)
+}
+func (c *ArticleCaps) AccountDownload(s *fastnntp.Session, n int64) {
+	c.Accountant.Account(s,n)
+}
@@ -0,0 +1,285 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+A naive Bayes spam classifier for news articles.
+
+The Classifier keeps one Model per hierarchy (the first component of the
+newsgroup name) and a global model, which is trained with every article. An
+article is scored with the model of the hierarchy of its first newsgroup, if
+that model has been trained sufficiently, and with the global model otherwise.
+
+Training uses articles, that are labelled as ham or spam, either by the group
+they are stored in (see TrainGroup), or by an administrator (see Train and
+TrainArticle). A Classifier is a posting.Filter: It adds the score to every
+article, and rejects articles with a score above the threshold.
+*/
+package bayes
+
+import "github.com/byte-mug/fastnntp"
+import "github.com/byte-mug/fastnntp/posting"
+import "bufio"
+import "bytes"
+import "errors"
+import "fmt"
+import "os"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+
+var ErrCorrupt = errors.New("bayes: corrupt model file")
+var ErrNotFound = errors.New("bayes: article not found")
+
+const fileMagic = "fastnntp-bayes 1"
+
+// The name of the global model.
+const Global = "*"
+
+type Classifier struct{
+	// Articles with a score of Threshold or more are rejected. Defaults to 0.9.
+	// A value above 1 disables the rejection: articles are only scored.
+	Threshold float64
+	
+	// The minimum number of ham and spam articles, a hierarchy model must be
+	// trained with, before it is used. Defaults to 20.
+	MinTrain int
+	
+	// The header field, that receives the score. Defaults to "X-Bayes-Score".
+	// If "-", no field is added.
+	Header string
+	
+	// Returns the hierarchy of a newsgroup. Defaults to the first component.
+	Hierarchy func(group []byte) string
+	
+	file   string
+	mu     sync.RWMutex
+	models map[string]*Model
+}
+
+// Returns an empty Classifier, that is not backed by a file.
+func New() *Classifier {
+	return &Classifier{models:map[string]*Model{Global:newModel()}}
+}
+
+/*
+Opens a Classifier, that is persisted in the given file. If the file does not
+exist, the Classifier is empty, and the file is created by Save.
+*/
+func Open(fn string) (*Classifier,error) {
+	c := New()
+	c.file = fn
+	f,err := os.Open(fn)
+	if os.IsNotExist(err) { return c,nil }
+	if err!=nil { return nil,err }
+	defer f.Close()
+	if err = c.read(bufio.NewReader(f)); err!=nil { return nil,err }
+	return c,nil
+}
+
+func (c *Classifier) read(r *bufio.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil,1<<16)
+	if !sc.Scan() || sc.Text()!=fileMagic { return ErrCorrupt }
+	var m *Model
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f)==0 { continue }
+		if f[0]=="model" && len(f)==4 {
+			m = newModel()
+			h,e1 := strconv.ParseUint(f[2],10,32)
+			s,e2 := strconv.ParseUint(f[3],10,32)
+			if e1!=nil || e2!=nil { return ErrCorrupt }
+			m.Ham,m.Spam = uint32(h),uint32(s)
+			c.models[f[1]] = m
+			continue
+		}
+		if m==nil || len(f)!=3 { return ErrCorrupt }
+		h,e1 := strconv.ParseUint(f[1],10,32)
+		s,e2 := strconv.ParseUint(f[2],10,32)
+		if e1!=nil || e2!=nil { return ErrCorrupt }
+		m.Tokens[f[0]] = Count{uint32(h),uint32(s)}
+	}
+	return sc.Err()
+}
+
+/*
+Writes the models to the file, the Classifier has been opened with,
+atomically. Does nothing, if the Classifier is not backed by a file.
+*/
+func (c *Classifier) Save() error {
+	if c.file=="" { return nil }
+	c.mu.RLock(); defer c.mu.RUnlock()
+	tmp := c.file+".tmp"
+	f,err := os.Create(tmp)
+	if err!=nil { return err }
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w,fileMagic)
+	names := make([]string,0,len(c.models))
+	for n := range c.models { names = append(names,n) }
+	sort.Strings(names)
+	for _,n := range names {
+		m := c.models[n]
+		fmt.Fprintf(w,"model %s %d %d\n",n,m.Ham,m.Spam)
+		for t,cnt := range m.Tokens { fmt.Fprintf(w,"%s %d %d\n",t,cnt.Ham,cnt.Spam) }
+	}
+	err = w.Flush()
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	if err!=nil { os.Remove(tmp); return err }
+	return os.Rename(tmp,c.file)
+}
+
+func (c *Classifier) hierarchy(g []byte) string {
+	if c.Hierarchy!=nil { return c.Hierarchy(g) }
+	if i := bytes.IndexByte(g,'.'); i>=0 { g = g[:i] }
+	return string(g)
+}
+
+// Returns the hierarchies of the newsgroups of an article, without duplicates.
+func (c *Classifier) hierarchies(h *posting.Header) (hs []string) {
+	outer:
+	for _,g := range posting.SplitNewsgroups(h.Get("Newsgroups")) {
+		n := c.hierarchy(g)
+		if n=="" || n==Global { continue }
+		for _,o := range hs { if o==n { continue outer } }
+		hs = append(hs,n)
+	}
+	return
+}
+
+func (c *Classifier) learn(h *posting.Header,body []byte,spam bool,n int) {
+	tokens := Tokens(h,body)
+	c.mu.Lock(); defer c.mu.Unlock()
+	c.models[Global].learn(tokens,spam,n)
+	for _,hr := range c.hierarchies(h) {
+		m := c.models[hr]
+		if m==nil {
+			if n<0 { continue }
+			m = newModel()
+			c.models[hr] = m
+		}
+		m.learn(tokens,spam,n)
+	}
+}
+
+/*
+Trains the classifier with an article (body in wire form), for the global
+model and the models of all hierarchies, the article is posted to.
+*/
+func (c *Classifier) Train(h *posting.Header,body []byte,spam bool) { c.learn(h,body,spam,1) }
+
+/*
+Reverts a previous Train with the same article and label. To relabel an
+article, it is untrained with the old label and trained with the new one.
+*/
+func (c *Classifier) Untrain(h *posting.Header,body []byte,spam bool) { c.learn(h,body,spam,-1) }
+
+/*
+Returns a copy of a model by name (a hierarchy or Global), or nil. The copy is
+not affected by later training.
+*/
+func (c *Classifier) Model(name string) *Model {
+	c.mu.RLock(); defer c.mu.RUnlock()
+	m := c.models[name]
+	if m==nil { return nil }
+	return m.Clone()
+}
+
+// Removes the rare tokens from all models. See Model.Prune.
+func (c *Classifier) Prune(min int) {
+	c.mu.Lock(); defer c.mu.Unlock()
+	for _,m := range c.models { m.Prune(min) }
+}
+
+/*
+Returns the spam probability of an article and the name of the model used.
+*/
+func (c *Classifier) Score(h *posting.Header,body []byte) (score float64,model string) {
+	tokens := Tokens(h,body)
+	min := c.MinTrain
+	if min<=0 { min = 20 }
+	c.mu.RLock(); defer c.mu.RUnlock()
+	model = Global
+	if hs := c.hierarchies(h); len(hs)>0 && c.models[hs[0]].Trained(min) { model = hs[0] }
+	return c.models[model].Score(tokens),model
+}
+
+func (c *Classifier) FilterArticle(a *posting.Article) (v posting.Verdict,reason string) {
+	score,model := c.Score(a.Header,a.Body)
+	switch c.Header {
+	case "-":
+	case "": a.Header.Set("X-Bayes-Score",[]byte(fmt.Sprintf("%.4f (%s)",score,model)))
+	default: a.Header.Set(c.Header,[]byte(fmt.Sprintf("%.4f (%s)",score,model)))
+	}
+	t := c.Threshold
+	if t==0 { t = 0.9 }
+	if score>=t { return posting.Reject,"Classified as spam" }
+	return posting.Accept,""
+}
+
+// Reads a stored article, in wire form.
+func fetch(ac fastnntp.ArticleCaps,a *fastnntp.Article) (h *posting.Header,body []byte,ok bool) {
+	f := ac.GetArticle(a,true,true)
+	if f==nil { return }
+	buf := new(bytes.Buffer)
+	w := fastnntp.AcquireDotWriter()
+	w.Reset(buf)
+	f(w)
+	w.Close()
+	w.Release()
+	art := bytes.TrimSuffix(buf.Bytes(),[]byte(".\r\n"))
+	head := art
+	if i := bytes.Index(art,[]byte("\r\n\r\n")); i>=0 {
+		head,body = art[:i+2],art[i+4:]
+	}
+	return posting.ParseHeader(head),body,true
+}
+
+/*
+Trains the classifier with an article, given by its Message-ID, from the
+article storage. This is the administrator's way to label an article.
+*/
+func (c *Classifier) TrainArticle(ac fastnntp.ArticleCaps,id []byte,spam bool) error {
+	h,body,ok := fetch(ac,&fastnntp.Article{MessageId:id,HasId:true})
+	if !ok { return ErrNotFound }
+	c.Train(h,body,spam)
+	return nil
+}
+
+/*
+Trains the classifier with all articles stored in a group, which are all
+labelled as ham, or all as spam. Returns the number of articles trained.
+*/
+func (c *Classifier) TrainGroup(gc fastnntp.GroupCaps,ac fastnntp.ArticleCaps,group string,spam bool) (n int,err error) {
+	g := &fastnntp.Group{Group:[]byte(group)}
+	if !gc.GetGroup(g) { return 0,ErrNotFound }
+	for num := g.Low; num<=g.High && g.Number>0; num++ {
+		h,body,ok := fetch(ac,&fastnntp.Article{Group:g.Group,Number:num,HasNum:true})
+		if !ok { continue }
+		c.Train(h,body,spam)
+		n++
+	}
+	return
+}
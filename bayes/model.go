@@ -0,0 +1,144 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package bayes
+
+import "math"
+import "sort"
+
+// The counts of a token: the number of ham and spam articles containing it.
+type Count struct{
+	Ham  uint32
+	Spam uint32
+}
+
+/*
+The statistics of a set of training articles.
+*/
+type Model struct{
+	// The number of ham and spam articles trained.
+	Ham  uint32
+	Spam uint32
+	
+	Tokens map[string]Count
+}
+
+func newModel() *Model { return &Model{Tokens:make(map[string]Count)} }
+
+// Returns a deep copy of the model.
+func (m *Model) Clone() *Model {
+	c := &Model{Ham:m.Ham,Spam:m.Spam,Tokens:make(map[string]Count,len(m.Tokens))}
+	for t,n := range m.Tokens { c.Tokens[t] = n }
+	return c
+}
+
+// Adds (or, if n is -1, removes) the tokens of an article.
+func (m *Model) learn(tokens map[string]struct{},spam bool,n int) {
+	add := func(v *uint32) {
+		if n<0 && *v==0 { return }
+		*v = uint32(int64(*v)+int64(n))
+	}
+	if spam { add(&m.Spam) } else { add(&m.Ham) }
+	for t := range tokens {
+		c := m.Tokens[t]
+		if spam { add(&c.Spam) } else { add(&c.Ham) }
+		if c.Ham==0 && c.Spam==0 {
+			delete(m.Tokens,t)
+		} else {
+			m.Tokens[t] = c
+		}
+	}
+}
+
+// Removes all tokens, that occurred in less than min articles.
+func (m *Model) Prune(min int) {
+	for t,c := range m.Tokens {
+		if int(c.Ham)+int(c.Spam)<min { delete(m.Tokens,t) }
+	}
+}
+
+// Returns true, if the model has at least min ham and min spam articles.
+func (m *Model) Trained(min int) bool {
+	return m!=nil && int(m.Ham)>=min && int(m.Spam)>=min && m.Ham>0 && m.Spam>0
+}
+
+// Parameters of the token probability (Robinson) and the combining, as in SpamBayes.
+const(
+	unknownStrength = 0.45
+	unknownProb     = 0.5
+	minDeviation    = 0.1
+	maxClues        = 150
+)
+
+// The probability, that an article containing the token is spam.
+func (m *Model) tokenProb(c Count) float64 {
+	h := float64(c.Ham)/math.Max(float64(m.Ham),1)
+	s := float64(c.Spam)/math.Max(float64(m.Spam),1)
+	p := unknownProb
+	if h+s>0 { p = s/(h+s) }
+	n := float64(c.Ham)+float64(c.Spam)
+	return (unknownStrength*unknownProb+n*p)/(unknownStrength+n)
+}
+
+/*
+Returns the spam probability of an article with the given tokens, between 0
+(ham) and 1 (spam). The most significant tokens are combined with Fisher's
+method (chi-squared). An untrained model returns 0.5.
+*/
+func (m *Model) Score(tokens map[string]struct{}) float64 {
+	if m.Ham==0 || m.Spam==0 { return 0.5 }
+	clues := make([]float64,0,64)
+	for t := range tokens {
+		c,ok := m.Tokens[t]
+		if !ok { continue }
+		p := m.tokenProb(c)
+		if math.Abs(p-0.5)>=minDeviation { clues = append(clues,p) }
+	}
+	if len(clues)==0 { return 0.5 }
+	if len(clues)>maxClues {
+		sort.Slice(clues,func(i,j int) bool { return math.Abs(clues[i]-0.5)>math.Abs(clues[j]-0.5) })
+		clues = clues[:maxClues]
+	}
+	var lnS,lnH float64
+	for _,p := range clues {
+		lnS += math.Log(1-p)
+		lnH += math.Log(p)
+	}
+	n := 2*len(clues)
+	s := 1-chi2Q(-2*lnS,n)
+	h := 1-chi2Q(-2*lnH,n)
+	return (s-h+1)/2
+}
+
+// The probability, that a chi-squared value with v (even) degrees of freedom is at least x2.
+func chi2Q(x2 float64,v int) float64 {
+	m := x2/2
+	term := math.Exp(-m)
+	sum := term
+	for i := 1; i<v/2; i++ {
+		term *= m/float64(i)
+		sum += term
+	}
+	return math.Min(sum,1)
+}
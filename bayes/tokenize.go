@@ -0,0 +1,96 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package bayes
+
+import "github.com/byte-mug/fastnntp/posting"
+import "bytes"
+import "strconv"
+
+// Only this many bytes of the body are tokenized.
+const maxBodyScan = 1<<16
+
+// Header fields, whose words are used as tokens (prefixed with the field name).
+var tokenFields = []string{"Subject","From","Organization","User-Agent","X-Newsreader","Content-Type"}
+
+func lowerB(b []byte) []byte {
+	for i,c := range b {
+		if c>='A' && c<='Z' { b[i] = c+('a'-'A') }
+	}
+	return b
+}
+
+func isPunct(c byte) bool {
+	switch c {
+	case '.',',',';',':','!','?','(',')','[',']','{','}','"','\'','<','>','*','=','`': return true
+	}
+	return false
+}
+
+/*
+Adds the tokens of a single word. URLs are reduced to their host, long words
+to their first character and length class.
+*/
+func addWord(set map[string]struct{},prefix string,w []byte) {
+	if i := bytes.Index(w,[]byte("://")); i>0 {
+		host := w[i+3:]
+		if j := bytes.IndexAny(host,"/?#"); j>=0 { host = host[:j] }
+		set["url:"+string(lowerB(host))] = struct{}{}
+		return
+	}
+	for len(w)>0 && isPunct(w[0]) { w = w[1:] }
+	for len(w)>0 && isPunct(w[len(w)-1]) { w = w[:len(w)-1] }
+	switch {
+	case len(w)<3:
+	case len(w)>24:
+		set[prefix+"skip:"+string(w[0])+":"+strconv.Itoa(len(w)/10*10)] = struct{}{}
+	default:
+		set[prefix+string(lowerB(w))] = struct{}{}
+	}
+}
+
+/*
+Returns the set of tokens of an article. The header contributes the words of a
+few fields, the domain of the Message-ID and the number of newsgroups; the body
+contributes its words.
+*/
+func Tokens(h *posting.Header,body []byte) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _,f := range tokenFields {
+		prefix := string(lowerB([]byte(f)))+":"
+		for _,v := range h.Values(f) {
+			for _,w := range bytes.Fields(v) { addWord(set,prefix,append([]byte(nil),w...)) }
+		}
+	}
+	if id := h.Get("Message-ID"); len(id)>0 {
+		if i := bytes.LastIndexByte(id,'@'); i>=0 {
+			set["mid:"+string(lowerB(bytes.TrimRight(append([]byte(nil),id[i+1:]...),">")))] = struct{}{}
+		}
+	}
+	ng := posting.SplitNewsgroups(h.Get("Newsgroups"))
+	set["newsgroups:"+strconv.Itoa(len(ng))] = struct{}{}
+	if len(body)>maxBodyScan { body = body[:maxBodyScan] }
+	for _,w := range bytes.Fields(body) { addWord(set,"",append([]byte(nil),w...)) }
+	return set
+}
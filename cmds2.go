@@ -240,6 +240,8 @@ func handleAuthInfo(h *nntpHandler,args [][]byte) error {
 	case 1:
 		if ok,nh := h.h.AuthinfoUserOny(args[1],h.h); ok {
 			if nh!=nil { h.h = nh }
+			h.session.User = append([]byte(nil),args[1]...)
+			h.throttle()
 			return h.writeRaw(append(h.outBuffer,handleAuthInfo_281...))
 		}
 		h.userName = append(h.userNameBuf,args[1]...)
@@ -248,6 +250,8 @@ func handleAuthInfo(h *nntpHandler,args [][]byte) error {
 		if len(h.userName)==0 { return h.writeRaw(append(h.outBuffer,handleAuthInfo_482...)) }
 		if ok,nh := h.h.AuthinfoUserPass(h.userName,args[1],h.h); ok {
 			if nh!=nil { h.h = nh }
+			h.session.User = append([]byte(nil),h.userName...)
+			h.throttle()
 			return h.writeRaw(append(h.outBuffer,handleAuthInfo_281...))
 		}
 		return h.writeRaw(append(h.outBuffer,handleAuthInfo_481...))
@@ -0,0 +1,325 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package cnfs
+
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "hash/crc32"
+import "os"
+import "sync"
+
+const(
+	blockSize  = 512
+	bufMagic   = "FNCNFS01"
+	recMagic   = 0x434e5231 // "CNR1"
+	recHdrSize = 32
+)
+
+var(
+	ErrNotCycbuf = errors.New("cnfs: not a cyclic buffer")
+	ErrTooLarge  = errors.New("cnfs: article too large for buffer")
+	ErrMissing   = errors.New("cnfs: article has been overwritten")
+	ErrBadToken  = errors.New("cnfs: invalid token")
+)
+
+/*
+A storage token. It identifies an article within a set of cyclic buffers.
+*/
+type Token struct{
+	// Index of the buffer.
+	Buffer uint16
+	// The cycle of the buffer, the article has been written in.
+	Cycle  uint32
+	// Offset of the record within the buffer file.
+	Offset int64
+}
+
+func (t Token) String() string {
+	return fmt.Sprintf("@%04x%08x%016x@",t.Buffer,t.Cycle,t.Offset)
+}
+
+// Parses the string form of a token.
+func ParseToken(s string) (t Token,err error) {
+	var b,c uint64
+	var o uint64
+	if len(s)!=30 { return t,ErrBadToken }
+	if _,err = fmt.Sscanf(s,"@%04x%08x%016x@",&b,&c,&o); err!=nil { return t,ErrBadToken }
+	return Token{uint16(b),uint32(c),int64(o)},nil
+}
+
+func align(n int64) int64 { return (n+blockSize-1)/blockSize*blockSize }
+
+/*
+Creates a cyclic buffer file of the given size. The space is allocated
+by writing zeros, so that writing articles never fails due to a full disk.
+*/
+func CreateBuffer(path string, size int64) error {
+	size = size/blockSize*blockSize
+	if size<4*blockSize { return ErrTooLarge }
+	f,err := os.OpenFile(path,os.O_WRONLY|os.O_CREATE|os.O_EXCL,0644)
+	if err!=nil { return err }
+	zero := make([]byte,1<<20)
+	for off := int64(0); off<size; {
+		n := int64(len(zero))
+		if size-off<n { n = size-off }
+		if _,err = f.WriteAt(zero[:n],off); err!=nil { break }
+		off += n
+	}
+	if err==nil { err = writeBufHeader(f,size,blockSize,1) }
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	if err!=nil { os.Remove(path) }
+	return err
+}
+
+func writeBufHeader(f *os.File, size, pos int64, cycle uint32) error {
+	var h [28]byte
+	copy(h[:],bufMagic)
+	binary.BigEndian.PutUint64(h[8:],uint64(size))
+	binary.BigEndian.PutUint64(h[16:],uint64(pos))
+	binary.BigEndian.PutUint32(h[24:],cycle)
+	_,err := f.WriteAt(h[:],0)
+	return err
+}
+
+/*
+A single cyclic buffer. Records are appended at the write position. When the
+end of the file is reached, the write position wraps to the start and the cycle
+number is incremented, so the oldest records get overwritten.
+*/
+type cycbuf struct{
+	index uint16
+	path  string
+	f     *os.File
+	size  int64
+	
+	lock  sync.Mutex
+	pos   int64
+	cycle uint32
+	
+	// The records written, oldest first. Used to determine the overwritten ones.
+	queue []entry
+}
+
+// A record, as tracked by the Store.
+type entry struct{
+	tok  Token
+	end  int64
+	id   string
+}
+
+func openCycbuf(index uint16, path string) (*cycbuf,error) {
+	f,err := os.OpenFile(path,os.O_RDWR,0)
+	if err!=nil { return nil,err }
+	var h [28]byte
+	if _,err = f.ReadAt(h[:],0); err!=nil || string(h[:8])!=bufMagic {
+		f.Close()
+		return nil,ErrNotCycbuf
+	}
+	c := &cycbuf{index:index,path:path,f:f}
+	c.size  = int64(binary.BigEndian.Uint64(h[8:]))
+	c.pos   = int64(binary.BigEndian.Uint64(h[16:]))
+	c.cycle = binary.BigEndian.Uint32(h[24:])
+	if c.pos<blockSize || c.pos>c.size { f.Close(); return nil,ErrNotCycbuf }
+	return c,nil
+}
+
+func (c *cycbuf) close() error {
+	c.lock.Lock()
+	err := writeBufHeader(c.f,c.size,c.pos,c.cycle)
+	c.lock.Unlock()
+	if err==nil { err = c.f.Sync() }
+	if e := c.f.Close(); err==nil { err = e }
+	return err
+}
+
+/*
+Returns true, if the record of the token has not been overwritten (yet).
+The caller must hold the lock.
+*/
+func (c *cycbuf) live(t Token, end int64) bool {
+	switch t.Cycle {
+	case c.cycle: return end<=c.pos
+	case c.cycle-1: return t.Offset>=c.pos
+	}
+	return false
+}
+
+/*
+Reserves space for a record of n bytes. Returns the token and the entries, that
+are overwritten by it.
+*/
+func (c *cycbuf) reserve(n int64, id string) (t Token,dead []entry,err error) {
+	n = align(n)
+	if n>c.size-blockSize { return t,nil,ErrTooLarge }
+	c.lock.Lock(); defer c.lock.Unlock()
+	if c.pos+n>c.size {
+		c.pos = blockSize
+		c.cycle++
+	}
+	t = Token{c.index,c.cycle,c.pos}
+	c.pos += n
+	i := 0
+	for ; i<len(c.queue); i++ {
+		e := c.queue[i]
+		if c.live(e.tok,e.end) { break }
+	}
+	dead = append(dead,c.queue[:i]...)
+	c.queue = append(c.queue[i:],entry{t,t.Offset+n,id})
+	return
+}
+
+// Returns the size of the record for the given meta data and article.
+func recordSize(meta, art []byte) int64 { return int64(recHdrSize+len(meta)+len(art)) }
+
+/*
+Writes a record into the space reserved for it. The meta data is stored along
+with the article; it is used to rebuild the index, when the buffer is opened again.
+*/
+func (c *cycbuf) put(t Token, meta, art []byte) (err error) {
+	rec := make([]byte,recHdrSize,recordSize(meta,art))
+	binary.BigEndian.PutUint32(rec[0:],recMagic)
+	binary.BigEndian.PutUint32(rec[4:],t.Cycle)
+	binary.BigEndian.PutUint32(rec[8:],uint32(len(meta)))
+	binary.BigEndian.PutUint32(rec[12:],uint32(len(art)))
+	crc := crc32.NewIEEE()
+	crc.Write(meta)
+	crc.Write(art)
+	binary.BigEndian.PutUint32(rec[16:],crc.Sum32())
+	rec = append(append(rec,meta...),art...)
+	if _,err = c.f.WriteAt(rec,t.Offset); err!=nil { return }
+	
+	c.lock.Lock()
+	err = writeBufHeader(c.f,c.size,c.pos,c.cycle)
+	c.lock.Unlock()
+	return
+}
+
+// Reads and checks the header of a record. Returns the lengths of meta data and article.
+func (c *cycbuf) header(t Token) (ml, al int64, crc uint32, err error) {
+	var h [recHdrSize]byte
+	c.lock.Lock()
+	ok := t.Cycle==c.cycle || t.Cycle==c.cycle-1
+	c.lock.Unlock()
+	if !ok { return 0,0,0,ErrMissing }
+	if _,err = c.f.ReadAt(h[:],t.Offset); err!=nil { return 0,0,0,ErrMissing }
+	if binary.BigEndian.Uint32(h[0:])!=recMagic || binary.BigEndian.Uint32(h[4:])!=t.Cycle {
+		return 0,0,0,ErrMissing
+	}
+	ml = int64(binary.BigEndian.Uint32(h[8:]))
+	al = int64(binary.BigEndian.Uint32(h[12:]))
+	if t.Offset+recHdrSize+ml+al>c.size { return 0,0,0,ErrMissing }
+	return ml,al,binary.BigEndian.Uint32(h[16:]),nil
+}
+
+// Returns true, if a record of n bytes (without header) has not been overwritten.
+func (c *cycbuf) intact(t Token, n int64) bool {
+	c.lock.Lock(); defer c.lock.Unlock()
+	return c.live(t,align(t.Offset+recHdrSize+n))
+}
+
+/*
+Reads a record. Returns ErrMissing, if it has been overwritten, even if this
+happens while it is being read.
+*/
+func (c *cycbuf) read(t Token) (meta, art []byte,err error) {
+	ml,al,crc,err := c.header(t)
+	if err!=nil { return nil,nil,err }
+	data := make([]byte,ml+al)
+	if _,err = c.f.ReadAt(data,t.Offset+recHdrSize); err!=nil { return nil,nil,ErrMissing }
+	if crc32.ChecksumIEEE(data)!=crc { return nil,nil,ErrMissing }
+	if !c.intact(t,ml+al) { return nil,nil,ErrMissing }
+	return data[:ml],data[ml:],nil
+}
+
+/*
+Reads only the meta data of a record, and returns the size of the article. The
+checksum is not verified; it has been checked, when the record was indexed.
+*/
+func (c *cycbuf) readMeta(t Token) (meta []byte, size int64, err error) {
+	ml,al,_,err := c.header(t)
+	if err!=nil { return nil,0,err }
+	meta = make([]byte,ml)
+	if _,err = c.f.ReadAt(meta,t.Offset+recHdrSize); err!=nil { return nil,0,ErrMissing }
+	if !c.intact(t,ml+al) { return nil,0,ErrMissing }
+	return meta,al,nil
+}
+
+/*
+Scans the buffer for live records, oldest first, and rebuilds the queue. Records
+written behind the stored write position (because of a crash before the header
+was updated) are recovered, and the write position is advanced over them.
+*/
+func (c *cycbuf) scan(fn func(t Token, meta []byte) string) error {
+	c.lock.Lock(); defer c.lock.Unlock()
+	var h [recHdrSize]byte
+	
+	// Recover records of the current cycle behind the write position.
+	for c.pos+recHdrSize<=c.size {
+		if _,err := c.f.ReadAt(h[:],c.pos); err!=nil { return err }
+		if binary.BigEndian.Uint32(h[0:])!=recMagic || binary.BigEndian.Uint32(h[4:])!=c.cycle { break }
+		n := recHdrSize+int64(binary.BigEndian.Uint32(h[8:]))+int64(binary.BigEndian.Uint32(h[12:]))
+		if c.pos+n>c.size || !c.checkCRC(c.pos,h[:]) { break }
+		c.pos += align(n)
+	}
+	
+	c.queue = c.queue[:0]
+	visit := func(from, to int64, cycle uint32) error {
+		for off := from; off+recHdrSize<=to; {
+			if _,err := c.f.ReadAt(h[:],off); err!=nil { return err }
+			if binary.BigEndian.Uint32(h[0:])!=recMagic || binary.BigEndian.Uint32(h[4:])!=cycle {
+				off += blockSize
+				continue
+			}
+			ml := int64(binary.BigEndian.Uint32(h[8:]))
+			n := recHdrSize+ml+int64(binary.BigEndian.Uint32(h[12:]))
+			if off+n>to || !c.checkCRC(off,h[:]) {
+				off += blockSize
+				continue
+			}
+			meta := make([]byte,ml)
+			if _,err := c.f.ReadAt(meta,off+recHdrSize); err!=nil { return err }
+			t := Token{c.index,cycle,off}
+			id := fn(t,meta)
+			c.queue = append(c.queue,entry{t,off+align(n),id})
+			off += align(n)
+		}
+		return nil
+	}
+	if c.cycle>1 {
+		if err := visit(c.pos,c.size,c.cycle-1); err!=nil { return err }
+	}
+	return visit(blockSize,c.pos,c.cycle)
+}
+
+func (c *cycbuf) checkCRC(off int64, h []byte) bool {
+	n := int64(binary.BigEndian.Uint32(h[8:]))+int64(binary.BigEndian.Uint32(h[12:]))
+	data := make([]byte,n)
+	if _,err := c.f.ReadAt(data,off+recHdrSize); err!=nil { return false }
+	return crc32.ChecksumIEEE(data)==binary.BigEndian.Uint32(h[16:])
+}
+
@@ -0,0 +1,171 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package cnfs
+
+import "bytes"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func tempBuffer(t *testing.T, size int64) (string,func()) {
+	dir,err := ioutil.TempDir("","cnfs")
+	if err!=nil { t.Fatal(err) }
+	fn := filepath.Join(dir,"buf")
+	if err = CreateBuffer(fn,size); err!=nil { os.RemoveAll(dir); t.Fatal(err) }
+	return fn,func() { os.RemoveAll(dir) }
+}
+
+func putRecord(t *testing.T, c *cycbuf, id string, art []byte) (Token,[]entry) {
+	meta := []byte(id)
+	tok,dead,err := c.reserve(recordSize(meta,art),id)
+	if err!=nil { t.Fatal(err) }
+	if err = c.put(tok,meta,art); err!=nil { t.Fatal(err) }
+	return tok,dead
+}
+
+// Scans the buffer and returns the IDs found, oldest first.
+func scanIds(t *testing.T, c *cycbuf) (ids []string) {
+	err := c.scan(func(t Token, meta []byte) string {
+		ids = append(ids,string(meta))
+		return string(meta)
+	})
+	if err!=nil { t.Fatal(err) }
+	return
+}
+
+func TestToken(t *testing.T) {
+	for _,tok := range []Token{{},{1,2,512},{0xffff,0xffffffff,1<<40}} {
+		p,err := ParseToken(tok.String())
+		if err!=nil || p!=tok { t.Errorf("%v: parsed as %v, %v",tok,p,err) }
+	}
+	for _,s := range []string{"","@0001@","@zzzz0000000000000000000000000@","00010000000200000000000002000"} {
+		if _,err := ParseToken(s); err!=ErrBadToken { t.Errorf("%q: %v",s,err) }
+	}
+}
+
+func TestBufferHeader(t *testing.T) {
+	fn,done := tempBuffer(t,64*blockSize)
+	defer done()
+	if CreateBuffer(fn,64*blockSize)==nil { t.Error("existing buffer overwritten") }
+	if CreateBuffer(fn+"2",blockSize)!=ErrTooLarge { t.Error("tiny buffer created") }
+	
+	c,err := openCycbuf(0,fn)
+	if err!=nil { t.Fatal(err) }
+	if c.size!=64*blockSize || c.pos!=blockSize || c.cycle!=1 { t.Errorf("header: %d %d %d",c.size,c.pos,c.cycle) }
+	putRecord(t,c,"<1@x>",[]byte("article"))
+	if err = c.close(); err!=nil { t.Fatal(err) }
+	
+	c,err = openCycbuf(0,fn)
+	if err!=nil { t.Fatal(err) }
+	if c.pos!=2*blockSize { t.Errorf("write position %d after reopen",c.pos) }
+	c.close()
+	
+	// Bad magic, bad write position.
+	data,_ := ioutil.ReadFile(fn)
+	for _,off := range []int{0,16} {
+		bad := append([]byte(nil),data...)
+		bad[off] ^= 0xff
+		ioutil.WriteFile(fn+"2",bad,0644)
+		if _,err = openCycbuf(0,fn+"2"); err!=ErrNotCycbuf { t.Errorf("corrupt header at %d: %v",off,err) }
+	}
+	ioutil.WriteFile(fn+"2",data[:10],0644)
+	if _,err = openCycbuf(0,fn+"2"); err!=ErrNotCycbuf { t.Errorf("truncated header: %v",err) }
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	fn,done := tempBuffer(t,64*blockSize)
+	defer done()
+	c,err := openCycbuf(0,fn)
+	if err!=nil { t.Fatal(err) }
+	defer c.close()
+	var toks []Token
+	for i := 0; i<5; i++ {
+		tok,_ := putRecord(t,c,fmt.Sprintf("<%d@x>",i),bytes.Repeat([]byte{byte('a'+i)},100*i))
+		toks = append(toks,tok)
+	}
+	for i,tok := range toks {
+		meta,art,err := c.read(tok)
+		if err!=nil || string(meta)!=fmt.Sprintf("<%d@x>",i) || len(art)!=100*i { t.Errorf("record %d: %q %d %v",i,meta,len(art),err) }
+		meta,size,err := c.readMeta(tok)
+		if err!=nil || string(meta)!=fmt.Sprintf("<%d@x>",i) || size!=int64(100*i) { t.Errorf("meta %d: %q %d %v",i,meta,size,err) }
+	}
+	
+	// A token of another cycle or offset is missing.
+	for _,tok := range []Token{{0,2,toks[1].Offset},{0,1,toks[1].Offset+blockSize/2}} {
+		if _,_,err = c.read(tok); err!=ErrMissing { t.Errorf("%v: %v",tok,err) }
+	}
+	
+	// A damaged article fails its checksum, on read and on scan.
+	if _,err = c.f.WriteAt([]byte("X"),toks[3].Offset+recHdrSize+10); err!=nil { t.Fatal(err) }
+	if _,_,err = c.read(toks[3]); err!=ErrMissing { t.Errorf("damaged record read: %v",err) }
+	if ids := scanIds(t,c); fmt.Sprint(ids)!="[<0@x> <1@x> <2@x> <4@x>]" { t.Errorf("scan found %v",ids) }
+}
+
+func TestWrapAround(t *testing.T) {
+	fn,done := tempBuffer(t,8*blockSize)
+	defer done()
+	c,err := openCycbuf(0,fn)
+	if err!=nil { t.Fatal(err) }
+	defer c.close()
+	art := make([]byte,blockSize)
+	var toks []Token
+	var lost []string
+	for i := 0; i<10; i++ {
+		tok,dead := putRecord(t,c,fmt.Sprintf("<%d@x>",i),art)
+		toks = append(toks,tok)
+		for _,e := range dead { lost = append(lost,e.id) }
+	}
+	// Each record takes two blocks; three fit in the buffer.
+	if fmt.Sprint(lost)!="[<0@x> <1@x> <2@x> <3@x> <4@x> <5@x> <6@x>]" { t.Errorf("overwritten: %v",lost) }
+	for i,tok := range toks {
+		_,_,err := c.read(tok)
+		if (i<7)!=(err==ErrMissing) { t.Errorf("record %d: %v",i,err) }
+	}
+	if ids := scanIds(t,c); fmt.Sprint(ids)!="[<7@x> <8@x> <9@x>]" { t.Errorf("scan found %v",ids) }
+	
+	if _,_,err = c.reserve(8*blockSize,"big"); err!=ErrTooLarge { t.Errorf("oversized record: %v",err) }
+}
+
+func TestCrashRecovery(t *testing.T) {
+	fn,done := tempBuffer(t,64*blockSize)
+	defer done()
+	c,err := openCycbuf(0,fn)
+	if err!=nil { t.Fatal(err) }
+	putRecord(t,c,"<1@x>",[]byte("one"))
+	pos := c.pos
+	putRecord(t,c,"<2@x>",[]byte("two"))
+	putRecord(t,c,"<3@x>",[]byte("three"))
+	
+	// The records were written, but the header still has the old write position.
+	writeBufHeader(c.f,c.size,pos,c.cycle)
+	c.f.Close()
+	
+	c,err = openCycbuf(0,fn)
+	if err!=nil { t.Fatal(err) }
+	defer c.close()
+	if ids := scanIds(t,c); fmt.Sprint(ids)!="[<1@x> <2@x> <3@x>]" { t.Errorf("scan found %v",ids) }
+	if c.pos!=4*blockSize { t.Errorf("write position %d, want %d",c.pos,4*blockSize) }
+}
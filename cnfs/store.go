@@ -0,0 +1,620 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Cyclic buffer article storage, in the style of INN's CNFS.
+
+Articles are written into a fixed set of preallocated, large files, that are
+used as ring buffers. When a buffer wraps around, the oldest articles are
+overwritten. Each article is identified by a storage token (buffer, cycle,
+offset); reading an overwritten token is detected and reported as missing.
+
+The Store keeps its article index in memory. It is rebuilt from the buffers,
+when the Store is opened, along with the high water marks. The meta data of each
+record holds the overview fields and the size of the article, so that STAT and
+OVER do not read whole articles.
+
+Only the high water marks of the groups are kept in a separate "active" file.
+It is written, before the last record, that carries a group's high water mark,
+is overwritten, so that article numbers are never reused.
+*/
+package cnfs
+
+import "github.com/byte-mug/fastnntp"
+import "github.com/byte-mug/fastnntp/posting"
+import "bufio"
+import "bytes"
+import "fmt"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "sync"
+import "sync/atomic"
+
+type group struct{
+	name   string
+	status byte
+	high   int64
+	saved  int64 // the high water mark in the active file
+	nums   []int64 // sorted
+	ids    map[int64]string
+}
+
+func (g *group) search(n int64) int {
+	return sort.Search(len(g.nums),func(i int) bool { return g.nums[i]>=n })
+}
+func (g *group) insert(n int64, id string) {
+	i := g.search(n)
+	g.nums = append(g.nums,0)
+	copy(g.nums[i+1:],g.nums[i:])
+	g.nums[i] = n
+	g.ids[n] = id
+}
+func (g *group) remove(n int64) {
+	delete(g.ids,n)
+	i := g.search(n)
+	if i<len(g.nums) && g.nums[i]==n {
+		g.nums = append(g.nums[:i],g.nums[i+1:]...)
+	}
+}
+func (g *group) low() int64 {
+	if len(g.nums)==0 { return g.high+1 }
+	return g.nums[0]
+}
+
+type article struct{
+	tok    Token
+	groups []string
+	nums   []int64
+}
+
+/*
+A Store on top of a set of cyclic buffers. Use Open to open one.
+
+The Store implements fastnntp.GroupCaps, fastnntp.ArticleCaps,
+fastnntp.PostingCaps and fastnntp.GroupListingCaps, as well as posting.Store.
+*/
+type Store struct{
+	dir     string
+	bufs    []*cycbuf
+	next    uint32
+	
+	lock    sync.RWMutex
+	groups  map[string]*group
+	byId    map[string]*article
+	pending map[string]bool
+	
+	// The posting pipeline, used for POST, IHAVE and TAKETHIS.
+	// It may be reconfigured before the Store is used.
+	Posting *posting.Pipeline
+}
+
+/*
+Opens a Store. The directory holds the active file. The buffers must have been
+created with CreateBuffer; their order must not change between invocations.
+The host is used as path identity and for generated Message-IDs.
+*/
+func Open(dir string, host string, buffers ...string) (*Store,error) {
+	s := &Store{
+		dir:     dir,
+		groups:  make(map[string]*group),
+		byId:    make(map[string]*article),
+		pending: make(map[string]bool),
+	}
+	s.Posting = &posting.Pipeline{Store:s,Stamper:posting.NewCounterStamper(host)}
+	if err := s.readActive(); err!=nil { return nil,err }
+	for i,p := range buffers {
+		c,err := openCycbuf(uint16(i),p)
+		if err!=nil { s.closeBufs(); return nil,err }
+		s.bufs = append(s.bufs,c)
+	}
+	if len(s.bufs)==0 { return nil,fmt.Errorf("cnfs: no buffers") }
+	for _,c := range s.bufs {
+		if err := c.scan(s.indexRecord); err!=nil { s.closeBufs(); return nil,err }
+	}
+	if err := s.writeActive(); err!=nil { s.closeBufs(); return nil,err }
+	return s,nil
+}
+
+func (s *Store) closeBufs() (err error) {
+	for _,c := range s.bufs {
+		if e := c.close(); err==nil { err = e }
+	}
+	return
+}
+
+// Writes the active file and closes the buffers.
+func (s *Store) Close() error {
+	s.lock.Lock()
+	err := s.writeActive()
+	s.lock.Unlock()
+	if e := s.closeBufs(); err==nil { err = e }
+	return err
+}
+
+// Returns a Handler, that is backed by this Store.
+func (s *Store) Handler() *fastnntp.Handler {
+	return &fastnntp.Handler{
+		GroupCaps: s,
+		ArticleCaps: s,
+		PostingCaps: s.Posting,
+		GroupListingCaps: s,
+	}
+}
+
+/*
+The meta data of a record:
+
+	<message-id> group:num group:num ...
+	subject TAB from TAB date TAB references TAB bytes TAB lines
+
+Records without the second line are served by reading the whole article.
+*/
+func appendMeta(buf []byte, id string, a *article, pa *posting.Article, size int) []byte {
+	buf = append(buf,id...)
+	for i,g := range a.groups {
+		buf = append(append(buf,' '),g...)
+		buf = strconv.AppendInt(append(buf,':'),a.nums[i],10)
+	}
+	buf = append(buf,'\n')
+	for _,f := range []string{"Subject","From","Date","References"} {
+		buf = append(appendOvField(buf,pa.Header.Get(f)),'\t')
+	}
+	buf = strconv.AppendInt(buf,int64(size),10)
+	buf = strconv.AppendInt(append(buf,'\t'),posting.CountLines(pa.Body),10)
+	return buf
+}
+
+func appendOvField(buf, f []byte) []byte {
+	for _,c := range f {
+		switch c {
+		case '\t','\r','\n': c = ' '
+		}
+		buf = append(buf,c)
+	}
+	return buf
+}
+
+// Adds a record, found while scanning a buffer, to the index.
+func (s *Store) indexRecord(t Token, meta []byte) string {
+	if i := bytes.IndexByte(meta,'\n'); i>=0 { meta = meta[:i] }
+	fs := bytes.Fields(meta)
+	if len(fs)==0 { return "" }
+	id := string(fs[0])
+	if old,ok := s.byId[id]; ok { s.unindex(id,old) }
+	a := &article{tok:t}
+	for _,f := range fs[1:] {
+		i := bytes.LastIndexByte(f,':')
+		if i<0 { continue }
+		n,err := strconv.ParseInt(string(f[i+1:]),10,64)
+		if err!=nil { continue }
+		g,ok := s.groups[string(f[:i])]
+		if !ok { continue }
+		if n>g.high { g.high = n }
+		g.insert(n,id)
+		a.groups = append(a.groups,g.name)
+		a.nums = append(a.nums,n)
+	}
+	s.byId[id] = a
+	return id
+}
+
+func (s *Store) unindex(id string, a *article) {
+	delete(s.byId,id)
+	for i,gn := range a.groups {
+		if g,ok := s.groups[gn]; ok { g.remove(a.nums[i]) }
+	}
+}
+
+/*
+Removes the entries of overwritten records from the index. Returns true, if one
+of them carried an article number, that is neither in the active file nor in
+any other record, so that the active file has to be written.
+*/
+func (s *Store) expire(dead []entry) (lost bool) {
+	for _,e := range dead {
+		a,ok := s.byId[e.id]
+		if !ok || a.tok!=e.tok { continue }
+		s.unindex(e.id,a)
+		for i,gn := range a.groups {
+			g,ok := s.groups[gn]
+			if !ok || a.nums[i]<=g.saved { continue }
+			if n := len(g.nums); n==0 || g.nums[n-1]<a.nums[i] { lost = true }
+		}
+	}
+	return
+}
+
+func (s *Store) readActive() error {
+	f,err := os.Open(filepath.Join(s.dir,"active"))
+	if os.IsNotExist(err) { return nil }
+	if err!=nil { return err }
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fs := bytes.Fields(sc.Bytes())
+		if len(fs)<4 || len(fs[3])==0 { continue }
+		high,err := strconv.ParseInt(string(fs[1]),10,64)
+		if err!=nil { continue }
+		s.groups[string(fs[0])] = &group{name:string(fs[0]),high:high,saved:high,status:fs[3][0],ids:make(map[int64]string)}
+	}
+	return sc.Err()
+}
+
+func (s *Store) writeActive() error {
+	names := make([]string,0,len(s.groups))
+	for n := range s.groups { names = append(names,n) }
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _,n := range names {
+		g := s.groups[n]
+		fmt.Fprintf(&b,"%s %010d %010d %c\n",g.name,g.high,g.low(),g.status)
+	}
+	fn := filepath.Join(s.dir,"active")
+	f,err := os.Create(fn+".tmp")
+	if err!=nil { return err }
+	_,err = f.Write(b.Bytes())
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	if err!=nil { return err }
+	if err = os.Rename(fn+".tmp",fn); err!=nil { return err }
+	for _,g := range s.groups { g.saved = g.high }
+	return nil
+}
+
+/*
+Adds a group or updates its status. The status is one of 'y' (posting permitted),
+'n' (posting not permitted) or 'm' (moderated).
+*/
+func (s *Store) AddGroup(name string, status byte) error {
+	s.lock.Lock(); defer s.lock.Unlock()
+	if g,ok := s.groups[name]; ok {
+		g.status = status
+	} else {
+		s.groups[name] = &group{name:name,status:status,ids:make(map[int64]string)}
+	}
+	return s.writeActive()
+}
+
+// Returns the status of a group. Implements posting.ActiveSource.
+func (s *Store) GroupStatus(group []byte) (status byte, ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	g,ok := s.groups[string(group)]
+	if !ok { return 0,false }
+	return g.status,true
+}
+
+// Returns the high water mark of a group. Implements posting.NumberSource.
+func (s *Store) GroupHigh(group []byte) (high int64, ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	g,ok := s.groups[string(group)]
+	if !ok { return 0,false }
+	return g.high,true
+}
+
+// ---------------------------------------------------------------------------
+// posting.Store
+
+func (s *Store) CheckPostId(id []byte) (wanted bool, possible bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	_,ok := s.byId[string(id)]
+	return !(ok || s.pending[string(id)]),true
+}
+func (s *Store) CheckPost() (possible bool) { return true }
+
+/*
+Stores an article in all groups of its Newsgroups field, that exist in the Store.
+If the article has been numbered by the Pipeline, these numbers are used; if
+one of them is already taken, the article is rejected. Articles, that belong to
+no known group, are rejected.
+
+Articles are written in parallel; the buffers are used in turn.
+*/
+func (s *Store) StoreArticle(pa *posting.Article) (rejected bool,failed bool) {
+	id := string(pa.MessageId())
+	if id=="" || bytes.IndexAny([]byte(id)," \t\r\n")>=0 { return true,false }
+	ngs := posting.SplitNewsgroups(pa.Header.Get("Newsgroups"))
+	if pa.Numbers!=nil {
+		// The groups and numbers assigned by the Pipeline.
+		ngs = ngs[:0]
+		for _,g := range pa.Numbers.Groups { ngs = append(ngs,[]byte(g)) }
+	}
+	
+	a := new(article)
+	s.lock.Lock()
+	if _,ok := s.byId[id]; ok || s.pending[id] { s.lock.Unlock(); return true,false }
+	if pa.Numbers!=nil {
+		// An assigned number, that is already taken, would lose the article in that group.
+		for i,ng := range ngs {
+			if g,ok := s.groups[string(ng)]; ok && g.ids[pa.Numbers.Numbers[i]]!="" { s.lock.Unlock(); return true,false }
+		}
+	}
+	for i,ng := range ngs {
+		g,ok := s.groups[string(ng)]
+		if !ok { continue }
+		dup := false
+		for _,og := range a.groups { dup = dup || og==g.name }
+		if dup { continue }
+		num := g.high+1
+		if pa.Numbers!=nil { num = pa.Numbers.Numbers[i] }
+		if num>g.high { g.high = num }
+		a.groups = append(a.groups,g.name)
+		a.nums = append(a.nums,num)
+	}
+	if len(a.groups)==0 { s.lock.Unlock(); return true,false }
+	s.pending[id] = true
+	s.lock.Unlock()
+	
+	c := s.bufs[int(atomic.AddUint32(&s.next,1))%len(s.bufs)]
+	data := pa.Bytes()
+	meta := appendMeta(nil,id,a,pa,len(data))
+	tok,dead,err := c.reserve(recordSize(meta,data),id)
+	if err==nil {
+		// Drop the records, that are about to be overwritten, saving their high water marks.
+		s.lock.Lock()
+		if s.expire(dead) { err = s.writeActive() }
+		s.lock.Unlock()
+	}
+	if err==nil { err = c.put(tok,meta,data) }
+	
+	s.lock.Lock(); defer s.lock.Unlock()
+	delete(s.pending,id)
+	if err!=nil { return false,true }
+	a.tok = tok
+	s.byId[id] = a
+	for i,gn := range a.groups {
+		if g,ok := s.groups[gn]; ok { g.insert(a.nums[i],id) }
+	}
+	return false,false
+}
+
+// Returns the token of an article.
+func (s *Store) Token(id []byte) (t Token,ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	a,ok := s.byId[string(id)]
+	if ok { t = a.tok }
+	return
+}
+
+/*
+Reads an article by its token. Returns ErrMissing, if it has been overwritten.
+*/
+func (s *Store) Read(t Token) (art []byte,err error) {
+	if int(t.Buffer)>=len(s.bufs) { return nil,ErrBadToken }
+	_,art,err = s.bufs[t.Buffer].read(t)
+	return
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.PostingCaps
+
+func (s *Store) PerformPost(id []byte, r *fastnntp.DotReader) (rejected bool,failed bool) {
+	return s.Posting.PerformPost(id,r)
+}
+func (s *Store) PerformPostSession(id []byte, r *fastnntp.DotReader, sess *fastnntp.Session) (rejected bool,failed bool,reason string) {
+	return s.Posting.PerformPostSession(id,r,sess)
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.GroupCaps
+
+func (s *Store) GetGroup(g *fastnntp.Group) bool {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	grp,ok := s.groups[string(g.Group)]
+	if !ok { return false }
+	g.Number = int64(len(grp.nums))
+	g.Low = grp.low()
+	g.High = grp.high
+	return true
+}
+func (s *Store) ListGroup(g *fastnntp.Group, w *fastnntp.DotWriter, first, last int64) {
+	s.lock.RLock()
+	grp,ok := s.groups[string(g.Group)]
+	var nums []int64
+	if ok {
+		if last<first { last = grp.high }
+		for _,n := range grp.nums[grp.search(first):] {
+			if n>last { break }
+			nums = append(nums,n)
+		}
+	}
+	s.lock.RUnlock()
+	buf := make([]byte,0,32)
+	for _,n := range nums {
+		w.Write(append(fastnntp.AppendUint(buf[:0],n),'\r','\n'))
+	}
+}
+func (s *Store) CursorMoveGroup(g *fastnntp.Group, i int64, backward bool, id_buf []byte) (ni int64, id []byte, ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	grp,ok := s.groups[string(g.Group)]
+	if !ok { return }
+	j := grp.search(i)
+	if backward {
+		j--
+	} else if j<len(grp.nums) && grp.nums[j]==i {
+		j++
+	}
+	if j<0 || j>=len(grp.nums) { return 0,nil,false }
+	ni = grp.nums[j]
+	return ni,append(id_buf,grp.ids[ni]...),true
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.ArticleCaps
+
+func (s *Store) lookup(a *fastnntp.Article) (t Token, id string, ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	if a.HasNum {
+		grp,ok := s.groups[string(a.Group)]
+		if !ok { return t,"",false }
+		id,ok = grp.ids[a.Number]
+		if !ok { return t,"",false }
+	} else {
+		id = string(a.MessageId)
+	}
+	art,ok := s.byId[id]
+	if !ok { return t,"",false }
+	return art.tok,id,true
+}
+
+// Drops an article from the index, if its record has been overwritten.
+func (s *Store) missing(id string, t Token, err error) {
+	if err!=ErrMissing { return }
+	s.lock.Lock()
+	if art,ok := s.byId[id]; ok && art.tok==t { s.unindex(id,art) }
+	s.lock.Unlock()
+}
+
+// Reads an article, dropping it from the index, if it has been overwritten.
+func (s *Store) fetch(a *fastnntp.Article) ([]byte,bool) {
+	t,id,ok := s.lookup(a)
+	if !ok { return nil,false }
+	data,err := s.Read(t)
+	s.missing(id,t,err)
+	if err!=nil { return nil,false }
+	if !a.HasId { a.MessageId = append(a.MessageId[:0],id...) }
+	return data,true
+}
+
+// Reads the meta data of an article, dropping it from the index, if it has been overwritten.
+func (s *Store) fetchMeta(a *fastnntp.Article) ([]byte,bool) {
+	t,id,ok := s.lookup(a)
+	if !ok { return nil,false }
+	if int(t.Buffer)>=len(s.bufs) { return nil,false }
+	meta,_,err := s.bufs[t.Buffer].readMeta(t)
+	s.missing(id,t,err)
+	if err!=nil { return nil,false }
+	if !a.HasId { a.MessageId = append(a.MessageId[:0],id...) }
+	return meta,true
+}
+
+func (s *Store) StatArticle(a *fastnntp.Article) bool {
+	_,ok := s.fetchMeta(a)
+	return ok
+}
+
+func (s *Store) GetArticle(a *fastnntp.Article, head, body bool) func(w *fastnntp.DotWriter) {
+	data,ok := s.fetch(a)
+	if !ok { return nil }
+	if !head || !body {
+		i := bytes.Index(data,[]byte("\r\n\r\n"))
+		switch {
+		case i<0 && head:
+		case i<0: data = nil
+		case head: data = data[:i+2]
+		default: data = data[i+4:]
+		}
+	}
+	return func(w *fastnntp.DotWriter) { w.Write(data) }
+}
+
+/*
+Writes the overview of the requested articles. The fields are taken from the meta
+data of the records, or from the articles, if the meta data lacks them.
+*/
+func (s *Store) WriteOverview(ar *fastnntp.ArticleRange) func(w fastnntp.IOverview) {
+	var nums []int64
+	var arts []*fastnntp.Article
+	if ar.HasNum {
+		s.lock.RLock()
+		grp,ok := s.groups[string(ar.Group)]
+		if ok {
+			for _,n := range grp.nums[grp.search(ar.Number):] {
+				if n>ar.LastNumber { break }
+				nums = append(nums,n)
+				arts = append(arts,&fastnntp.Article{Group:ar.Group,Number:n,HasNum:true})
+			}
+		}
+		s.lock.RUnlock()
+	} else {
+		nums = append(nums,0)
+		arts = append(arts,&fastnntp.Article{MessageId:ar.MessageId,HasId:true})
+	}
+	type ov struct{
+		num int64
+		fs [][]byte // Subject, From, Date, Message-ID, References
+		bytes, lines int64
+	}
+	var ovs []ov
+	for i,a := range arts {
+		meta,ok := s.fetchMeta(a)
+		if !ok { continue }
+		if j := bytes.IndexByte(meta,'\n'); j>=0 {
+			fs := bytes.Split(meta[j+1:],[]byte("\t"))
+			if len(fs)==6 {
+				o := ov{num:nums[i],fs:[][]byte{fs[0],fs[1],fs[2],a.MessageId,fs[3]}}
+				o.bytes,_ = strconv.ParseInt(string(fs[4]),10,64)
+				o.lines,_ = strconv.ParseInt(string(fs[5]),10,64)
+				ovs = append(ovs,o)
+				continue
+			}
+		}
+		data,ok := s.fetch(a)
+		if !ok { continue }
+		head,body := data,[]byte(nil)
+		if j := bytes.Index(data,[]byte("\r\n\r\n")); j>=0 { head,body = data[:j],data[j+4:] }
+		h := posting.ParseHeader(head)
+		fs := [][]byte{h.Get("Subject"),h.Get("From"),h.Get("Date"),h.Get("Message-ID"),h.Get("References")}
+		for _,f := range fs { ovClean(f) }
+		ovs = append(ovs,ov{nums[i],fs,int64(len(data)),posting.CountLines(body)})
+	}
+	if len(ovs)==0 { return nil }
+	return func(w fastnntp.IOverview) {
+		for _,o := range ovs {
+			if w.WriteEntry(o.num,o.fs[0],o.fs[1],o.fs[2],o.fs[3],o.fs[4],o.bytes,o.lines)!=nil { return }
+		}
+	}
+}
+
+func ovClean(b []byte) []byte {
+	for i,c := range b {
+		switch c {
+		case '\t','\r','\n': b[i] = ' '
+		}
+	}
+	return b
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.GroupListingCaps
+
+func (s *Store) ListGroups(wm *fastnntp.WildMat, ila fastnntp.IListActive) bool {
+	type info struct{
+		name string
+		high, low int64
+		status byte
+	}
+	s.lock.RLock()
+	grps := make([]info,0,len(s.groups))
+	for _,g := range s.groups { grps = append(grps,info{g.name,g.high,g.low(),g.status}) }
+	s.lock.RUnlock()
+	sort.Slice(grps,func(i,j int) bool { return grps[i].name<grps[j].name })
+	for _,g := range grps {
+		if ila.WriteFullInfo([]byte(g.name),g.high,g.low,g.status,nil)!=nil { break }
+	}
+	return true
+}
+
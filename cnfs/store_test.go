@@ -0,0 +1,193 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package cnfs
+
+import "github.com/byte-mug/fastnntp"
+import "github.com/byte-mug/fastnntp/posting"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "testing"
+
+type testStore struct{
+	*Store
+	dir  string
+	bufs []string
+}
+
+func openTestStore(t *testing.T, bufSize int64, nbufs int) *testStore {
+	dir,err := ioutil.TempDir("","cnfs")
+	if err!=nil { t.Fatal(err) }
+	ts := &testStore{dir:dir}
+	for i := 0; i<nbufs; i++ {
+		fn := filepath.Join(dir,fmt.Sprintf("buf%d",i))
+		if err = CreateBuffer(fn,bufSize); err!=nil { t.Fatal(err) }
+		ts.bufs = append(ts.bufs,fn)
+	}
+	ts.reopen(t)
+	return ts
+}
+
+func (ts *testStore) reopen(t *testing.T) {
+	s,err := Open(ts.dir,"news.example",ts.bufs...)
+	if err!=nil { t.Fatal(err) }
+	ts.Store = s
+}
+
+// Drops the Store without writing the active file, as after a crash.
+func (ts *testStore) crash(t *testing.T) {
+	for _,c := range ts.Store.bufs { c.f.Close() }
+	ts.reopen(t)
+}
+
+func (ts *testStore) remove() {
+	ts.Close()
+	os.RemoveAll(ts.dir)
+}
+
+func testArticle(id, groups, subject string, body string) *posting.Article {
+	h := posting.ParseHeader([]byte("Newsgroups: "+groups+"\r\nMessage-ID: "+id+"\r\nSubject: "+subject+"\r\nFrom: a@b.example\r\n"))
+	return &posting.Article{Header:h,Body:[]byte(body)}
+}
+
+type ovEntry struct{
+	num int64
+	subject, msgId string
+	bytes, lines int64
+}
+type ovList []ovEntry
+func (l *ovList) WriteEntry(num int64, subject, from, date, msgId, refs []byte, lng, lines int64) error {
+	*l = append(*l,ovEntry{num,string(subject),string(msgId),lng,lines})
+	return nil
+}
+
+func (ts *testStore) overview(group string, first, last int64) (l ovList) {
+	ar := &fastnntp.ArticleRange{Article:fastnntp.Article{Group:[]byte(group),Number:first,HasNum:true},LastNumber:last}
+	if fn := ts.WriteOverview(ar); fn!=nil { fn(&l) }
+	return
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	ts := openTestStore(t,1<<20,3)
+	defer ts.remove()
+	ts.AddGroup("alt.binaries.test",'y')
+	ts.AddGroup("alt.test",'y')
+	
+	// Every article is offered twice, as by two peers using TAKETHIS.
+	const workers,each = 16,40
+	var stored int32
+	var wg sync.WaitGroup
+	for w := 0; w<2*workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i<each; i++ {
+				a := testArticle(fmt.Sprintf("<%d.%d@x>",w%workers,i),"alt.binaries.test,alt.test","test","line\r\n")
+				rej,fail := ts.StoreArticle(a)
+				if fail { t.Error("store failed") }
+				if !rej { atomic.AddInt32(&stored,1) }
+			}
+		}(w)
+	}
+	wg.Wait()
+	if stored!=workers*each { t.Fatalf("%d articles stored, want %d",stored,workers*each) }
+	check := func() {
+		for _,g := range []string{"alt.binaries.test","alt.test"} {
+			grp := &fastnntp.Group{Group:[]byte(g)}
+			ts.GetGroup(grp)
+			if grp.Number!=workers*each || grp.Low!=1 || grp.High!=workers*each {
+				t.Errorf("%s: %d articles %d-%d",g,grp.Number,grp.Low,grp.High)
+			}
+		}
+		for w := 0; w<workers; w++ {
+			for i := 0; i<each; i++ {
+				id := fmt.Sprintf("<%d.%d@x>",w,i)
+				tok,ok := ts.Token([]byte(id))
+				if !ok { t.Fatalf("%s not indexed",id) }
+				if _,err := ts.Read(tok); err!=nil { t.Fatalf("%s: %v",id,err) }
+			}
+		}
+	}
+	check()
+	ts.Close()
+	ts.reopen(t)
+	check()
+}
+
+func TestOverviewMeta(t *testing.T) {
+	ts := openTestStore(t,1<<20,1)
+	defer ts.remove()
+	ts.AddGroup("misc.test",'y')
+	a := testArticle("<1@x>","misc.test","tab\there","one\r\ntwo\r\n")
+	size := int64(len(a.Bytes()))
+	if rej,fail := ts.StoreArticle(a); rej || fail { t.Fatal("store failed") }
+	want := fmt.Sprint(ovList{{1,"tab here","<1@x>",size,2}})
+	if l := ts.overview("misc.test",1,10); fmt.Sprint(l)!=want { t.Errorf("overview %v, want %s",l,want) }
+	
+	// The overview comes from the meta data: a damaged article body does not matter.
+	tok,_ := ts.Token([]byte("<1@x>"))
+	c := ts.Store.bufs[tok.Buffer]
+	ml,_,_,_ := c.header(tok)
+	c.f.WriteAt([]byte("X"),tok.Offset+recHdrSize+ml+5)
+	if l := ts.overview("misc.test",1,10); fmt.Sprint(l)!=want { t.Errorf("overview %v, want %s",l,want) }
+	if !ts.StatArticle(&fastnntp.Article{MessageId:[]byte("<1@x>"),HasId:true}) { t.Error("STAT failed") }
+	if _,err := ts.Read(tok); err!=ErrMissing { t.Errorf("damaged article read: %v",err) }
+	
+	// Records with the first meta line only are served from the article.
+	art := testArticle("<2@x>","misc.test","old","body\r\n").Bytes()
+	tok,_,err := c.reserve(recordSize([]byte("<2@x> misc.test:2"),art),"<2@x>")
+	if err!=nil { t.Fatal(err) }
+	c.put(tok,[]byte("<2@x> misc.test:2"),art)
+	ts.crash(t)
+	want = fmt.Sprint(ovEntry{2,"old","<2@x>",int64(len(art)),1})
+	if l := ts.overview("misc.test",2,2); len(l)!=1 || fmt.Sprint(l[0])!=want { t.Errorf("overview %v, want %s",l,want) }
+}
+
+func TestHighWaterMark(t *testing.T) {
+	ts := openTestStore(t,16*blockSize,1)
+	defer ts.remove()
+	ts.AddGroup("misc.test",'y')
+	ts.AddGroup("misc.other",'y')
+	
+	// Fill the buffer several times over; misc.other gets only the first article.
+	store := func(id, groups string) {
+		if rej,fail := ts.StoreArticle(testArticle(id,groups,"x","body\r\n")); rej || fail { t.Fatalf("storing %s failed",id) }
+	}
+	store("<0@x>","misc.other")
+	for i := 1; i<=100; i++ { store(fmt.Sprintf("<%d@x>",i),"misc.test") }
+	if _,ok := ts.Token([]byte("<0@x>")); ok { t.Fatal("first article not overwritten") }
+	
+	ts.crash(t)
+	for g,want := range map[string]int64{"misc.test":100,"misc.other":1} {
+		if h,_ := ts.GroupHigh([]byte(g)); h!=want { t.Errorf("%s: high water mark %d after crash, want %d",g,h,want) }
+	}
+	store("<101@x>","misc.test,misc.other")
+	tok,_ := ts.Token([]byte("<101@x>"))
+	meta,_,_ := ts.Store.bufs[0].readMeta(tok)
+	if want := "<101@x> misc.test:101 misc.other:2\n"; !strings.HasPrefix(string(meta),want) { t.Errorf("numbered as %q",meta) }
+}
@@ -0,0 +1,84 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package control
+
+import "github.com/byte-mug/fastnntp/posting"
+
+/*
+The default cancel authorization: if the target carries a Cancel-Lock field, the
+cancel must carry a matching Cancel-Key (RFC 8315). Otherwise, the senders of
+both articles must be equal.
+*/
+func defaultCancelAuth(cancel *posting.Article, target *posting.Header) bool {
+	if locked,ok := posting.CheckCancelKey(cancel.Header,target); locked { return ok }
+	return sameSender(cancel,target)
+}
+
+func sameSender(cancel *posting.Article, target *posting.Header) bool {
+	s := senderOf(cancel.Header)
+	if s=="" { return false }
+	return s==addressOf(target.Get("From")) || (target.Has("Sender") && s==addressOf(target.Get("Sender")))
+}
+
+/*
+cancel <message-id>
+
+This is also used for the Supersedes field.
+
+The action is decided by the groups of the cancel message. If the rules differ
+between its groups, the most restrictive action applies.
+*/
+func (p *Processor) cancel(m *message, d *Decision) {
+	if len(d.Args)==0 { return }
+	a := m.Article
+	ngs := posting.SplitNewsgroups(a.Header.Get("Newsgroups"))
+	if len(ngs)==0 { ngs = append(ngs,nil) }
+	var most *Decision
+	for _,g := range ngs {
+		gd := *d
+		gd.Group = string(g)
+		p.decide(m,&gd)
+		if most==nil || gd.Action<most.Action { most = &gd }
+	}
+	d.Action,d.Err = most.Action,most.Err
+	defer p.log(d)
+	if d.Action!=Act || p.Articles==nil { return }
+	target := []byte(d.Args[0])
+	h := p.Articles.ArticleHeader(target)
+	if h==nil {
+		d.Err = ErrNotFound
+		if p.History!=nil && p.PreemptiveCancel { p.History.Cancel(target) }
+		return
+	}
+	auth := p.CancelAuth
+	if auth==nil { auth = defaultCancelAuth }
+	if !auth(a,h) {
+		d.Err = ErrNotPermitted
+		return
+	}
+	if d.Err = p.Articles.Delete(target); d.Err!=nil { return }
+	if p.History!=nil { d.Err = p.History.Cancel(target) }
+}
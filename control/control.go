@@ -0,0 +1,309 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Processing of control messages (RFC 5537, 5).
+
+A Processor is plugged into a posting.Pipeline as its Control step. It acts on
+cancel, newgroup, rmgroup and checkgroups messages, after they have been stored.
+Articles with a Supersedes field are handled as cancel messages for the
+superseded article (RFC 5537, 5.3), in addition to being stored.
+Whether a control message is acted upon, only logged, or silently dropped, is
+decided by a list of rules, similar to INN's control.ctl. A rule may require a
+PGP signature by a certain key (see package pgpverify).
+*/
+package control
+
+import "github.com/byte-mug/fastnntp"
+import "github.com/byte-mug/fastnntp/history"
+import "github.com/byte-mug/fastnntp/pgpverify"
+import "github.com/byte-mug/fastnntp/posting"
+import "bytes"
+import "errors"
+import "fmt"
+import "log"
+import "net/mail"
+import "strings"
+
+var(
+	ErrNotPermitted = errors.New("control: not permitted")
+	ErrBadGroupName = errors.New("control: invalid group name")
+	ErrNotFound     = errors.New("control: article not found")
+	ErrWrongSigner  = errors.New("control: signed by the wrong key")
+)
+
+// What to do with a control message.
+type Action int
+
+const(
+	Drop Action = iota // Ignore it.
+	Log                // Log it, but do not act.
+	Act                // Act on it, and log it.
+)
+
+func (a Action) String() string {
+	switch a {
+	case Drop: return "drop"
+	case Log: return "log"
+	case Act: return "act"
+	}
+	return fmt.Sprint("Action(",int(a),")")
+}
+
+/*
+A rule. The last rule, that matches a control message, decides its Action.
+*/
+type Rule struct{
+	// The type of the control message ("cancel", "newgroup", "rmgroup",
+	// "checkgroups"), or "*" for all.
+	Kind string
+	
+	// The affected groups. For cancel, these are the groups of the cancel
+	// message. If nil, all groups match.
+	Groups *fastnntp.WildMat
+	
+	// The address of the sender. If nil, all senders match.
+	Sender *fastnntp.WildMat
+	
+	Action Action
+	
+	// If not empty, the message must carry a valid X-PGP-Sig signature by a key
+	// of the Keyring with this user ID (see pgpverify.PublicKey.Is). Otherwise,
+	// Act is reduced to Log.
+	Signer string
+}
+
+/*
+Creates a rule. The groups are given as wildmat pattern. The sender is
+not restricted.
+*/
+func NewRule(kind, groups string, action Action) (*Rule,error) {
+	wm := fastnntp.ParseWildMat(groups)
+	if err := wm.Compile(); err!=nil { return nil,err }
+	return &Rule{Kind:kind,Groups:wm,Action:action},nil
+}
+
+func (r *Rule) matches(kind, group, sender string) bool {
+	if r.Kind!="*" && r.Kind!=kind { return false }
+	if r.Groups!=nil && !r.Groups.MatchString(group) { return false }
+	if r.Sender!=nil && !r.Sender.MatchString(sender) { return false }
+	return true
+}
+
+/*
+The groups of a server, as seen by the Processor.
+*/
+type GroupManager interface{
+	// Creates a group, or changes the status of an existing one. The status is
+	// one of 'y', 'n' or 'm'.
+	NewGroup(name string, status byte, desc string) error
+	
+	RemoveGroup(name string) error
+	
+	// Calls fn for every group.
+	EachGroup(fn func(name string, status byte))
+}
+
+/*
+The articles of a server, as seen by the Processor.
+*/
+type ArticleManager interface{
+	// Returns the header of an article, or nil, if it does not exist.
+	ArticleHeader(id []byte) *posting.Header
+	
+	// Deletes an article from all its groups.
+	Delete(id []byte) error
+}
+
+/*
+A decision about a control message, or about one of the changes, that a
+checkgroups message results in.
+*/
+type Decision struct{
+	Kind      string
+	Args      []string
+	MessageId string
+	Sender    string
+	
+	// The affected group, if any.
+	Group     string
+	
+	Action    Action
+	
+	// The result of the action.
+	Err       error
+	Note      string
+}
+
+func (d *Decision) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b,"control: %s %s",d.Action,d.Kind)
+	if len(d.Args)>0 { fmt.Fprintf(&b," %s",strings.Join(d.Args," ")) }
+	fmt.Fprintf(&b," from %q %s",d.Sender,d.MessageId)
+	if d.Group!="" { fmt.Fprintf(&b," group %s",d.Group) }
+	if d.Note!="" { fmt.Fprintf(&b,": %s",d.Note) }
+	if d.Err!=nil { fmt.Fprintf(&b,": %v",d.Err) }
+	return b.String()
+}
+
+/*
+The control message processor. It implements posting.ControlProcessor.
+*/
+type Processor struct{
+	// The rules. Control messages, that match no rule, are dropped.
+	Rules []*Rule
+	
+	// Required for newgroup, rmgroup and checkgroups.
+	Groups GroupManager
+	
+	// Required for cancel.
+	Articles ArticleManager
+	
+	// Decides, whether a cancel message may cancel the target article.
+	// If nil, a matching Cancel-Key is required for targets with a Cancel-Lock
+	// field; for other targets, the sender addresses of both must be equal.
+	CancelAuth func(cancel *posting.Article, target *posting.Header) bool
+	
+	// If not nil, the targets of cancels are marked as cancelled (see
+	// history.History.Cancel), so that they are refused, if they arrive later.
+	History *history.History
+	
+	// Marks the target of a cancel in the History, even if it has not arrived
+	// yet. The cancel can not be authorized in this case, as the target is
+	// unknown, so anyone may block any Message-ID in advance. Off by default.
+	PreemptiveCancel bool
+	
+	// The keys for Rules with a Signer.
+	Keyring *pgpverify.Keyring
+	
+	// Receives the decisions, that are not dropped. Defaults to the standard logger.
+	Log func(d *Decision)
+}
+
+var groupSyntax posting.Validator
+
+// A control message being processed.
+type message struct{
+	*posting.Article
+	verified bool
+	signer   *pgpverify.PublicKey
+	err      error
+}
+
+// Checks the signature of the message. The result is cached.
+func (m *message) verify(kr *pgpverify.Keyring, signer string) error {
+	if !m.verified {
+		m.verified = true
+		if kr==nil {
+			m.err = pgpverify.ErrUnknownKey
+		} else {
+			m.signer,m.err = kr.Verify(m.Header,m.Body)
+		}
+	}
+	if m.err!=nil { return m.err }
+	if !m.signer.Is(signer) { return ErrWrongSigner }
+	return nil
+}
+
+// Sets the Action of the decision, according to the rules.
+func (p *Processor) decide(m *message, d *Decision) {
+	var rule *Rule
+	for _,r := range p.Rules {
+		if r.matches(d.Kind,d.Group,d.Sender) { rule = r }
+	}
+	d.Action = Drop
+	if rule==nil { return }
+	d.Action = rule.Action
+	if rule.Signer=="" || d.Action!=Act { return }
+	if err := m.verify(p.Keyring,rule.Signer); err!=nil {
+		d.Action = Log
+		d.Err = err
+	}
+}
+
+func (p *Processor) log(d *Decision) {
+	if d.Action==Drop { return }
+	if p.Log!=nil {
+		p.Log(d)
+	} else {
+		log.Print(d)
+	}
+}
+
+// Returns the address of the sender: the Sender field, or, if absent, the From field.
+func senderOf(h *posting.Header) string {
+	v := h.Get("Sender")
+	if len(v)==0 { v = h.Get("From") }
+	return addressOf(v)
+}
+
+func addressOf(v []byte) string {
+	if a,err := mail.ParseAddress(string(v)); err==nil { return strings.ToLower(a.Address) }
+	return strings.ToLower(string(bytes.TrimSpace(v)))
+}
+
+// Returns the lines of a wire form body, without CRLF and dot-stuffing.
+func bodyLines(body []byte) (lines []string) {
+	for _,l := range bytes.Split(body,[]byte("\r\n")) {
+		if len(l)>0 && l[0]=='.' { l = l[1:] }
+		lines = append(lines,string(l))
+	}
+	for len(lines)>0 && lines[len(lines)-1]=="" { lines = lines[:len(lines)-1] }
+	return
+}
+
+/*
+Acts on a control message or superseding article according to the rules.
+*/
+func (p *Processor) ProcessControl(a *posting.Article) {
+	m := &message{Article:a}
+	if s := strings.TrimSpace(string(a.Header.Get("Supersedes"))); s!="" {
+		p.cancel(m,&Decision{
+			Kind:      "cancel",
+			Args:      []string{s},
+			MessageId: string(a.MessageId()),
+			Sender:    senderOf(a.Header),
+			Note:      "supersedes",
+		})
+	}
+	args := strings.Fields(string(a.Header.Get("Control")))
+	if len(args)==0 { return }
+	d := &Decision{
+		Kind:      strings.ToLower(args[0]),
+		Args:      args[1:],
+		MessageId: string(a.MessageId()),
+		Sender:    senderOf(a.Header),
+	}
+	switch d.Kind {
+	case "cancel": p.cancel(m,d)
+	case "newgroup": p.newgroup(m,d)
+	case "rmgroup": p.rmgroup(m,d)
+	case "checkgroups": p.checkgroups(m,d)
+	default:
+		p.decide(m,d)
+		d.Note = "unsupported control message"
+		p.log(d)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package control
+
+import "sort"
+import "strings"
+
+/*
+Extracts the description of a group from the body of a newgroup message
+(RFC 5537, 5.2.1): the line following "For your newsgroups file:" has the form
+
+	name TAB description
+*/
+func description(body []byte, name string) string {
+	lines := bodyLines(body)
+	for i,l := range lines {
+		if !strings.EqualFold(strings.TrimSpace(l),"For your newsgroups file:") { continue }
+		for _,dl := range lines[i+1:] {
+			fs := strings.Fields(dl)
+			if len(fs)==0 { continue }
+			if fs[0]!=name { return "" }
+			return strings.Join(fs[1:]," ")
+		}
+	}
+	return ""
+}
+
+func isModerated(desc string) bool {
+	return strings.HasSuffix(desc,"(Moderated)")
+}
+
+/*
+newgroup <group> [moderated]
+*/
+func (p *Processor) newgroup(m *message, d *Decision) {
+	if len(d.Args)==0 { return }
+	d.Group = d.Args[0]
+	p.decide(m,d)
+	defer p.log(d)
+	if !groupSyntax.ValidNewsgroup([]byte(d.Group)) {
+		d.Err = ErrBadGroupName
+		return
+	}
+	if d.Action!=Act || p.Groups==nil { return }
+	status := byte('y')
+	if len(d.Args)>1 && strings.EqualFold(d.Args[1],"moderated") { status = 'm' }
+	d.Err = p.Groups.NewGroup(d.Group,status,description(m.Body,d.Group))
+}
+
+/*
+rmgroup <group>
+*/
+func (p *Processor) rmgroup(m *message, d *Decision) {
+	if len(d.Args)==0 { return }
+	d.Group = d.Args[0]
+	p.decide(m,d)
+	defer p.log(d)
+	if d.Action!=Act || p.Groups==nil { return }
+	d.Err = p.Groups.RemoveGroup(d.Group)
+}
+
+func inScope(name string, scope []string) bool {
+	for _,s := range scope {
+		if name==s || strings.HasPrefix(name,s+".") { return true }
+	}
+	return false
+}
+
+/*
+checkgroups [scope ...] [#serial]
+
+The body lists the groups of the hierarchies given by scope, one per line, as
+"name TAB description". If no scope is given, it consists of the top-level
+hierarchies of the listed groups. Groups of the scope, that are not listed, are
+removed; listed groups are created, or their moderation status is corrected.
+
+Each change is decided and logged separately.
+*/
+func (p *Processor) checkgroups(m *message, d *Decision) {
+	var scope []string
+	for _,arg := range d.Args {
+		if !strings.HasPrefix(arg,"#") { scope = append(scope,arg) }
+	}
+	listed := make(map[string]string)
+	tops := make(map[string]bool)
+	for _,l := range bodyLines(m.Body) {
+		fs := strings.Fields(l)
+		if len(fs)==0 || !groupSyntax.ValidNewsgroup([]byte(fs[0])) { continue }
+		listed[fs[0]] = strings.Join(fs[1:]," ")
+		tops[strings.SplitN(fs[0],".",2)[0]] = true
+	}
+	if len(scope)==0 {
+		for t := range tops { scope = append(scope,t) }
+		sort.Strings(scope)
+	}
+	
+	// An empty list would remove whole hierarchies.
+	if len(listed)==0 {
+		p.decide(m,d)
+		d.Note = "no groups listed"
+		p.log(d)
+		return
+	}
+	if p.Groups==nil { return }
+	
+	existing := make(map[string]byte)
+	p.Groups.EachGroup(func(name string, status byte) {
+		if inScope(name,scope) { existing[name] = status }
+	})
+	change := func(group, note string, fn func() error) {
+		c := &Decision{Kind:d.Kind,Args:d.Args,MessageId:d.MessageId,Sender:d.Sender,Group:group,Note:note}
+		p.decide(m,c)
+		if c.Action==Act { c.Err = fn() }
+		p.log(c)
+	}
+	var names []string
+	for n := range existing { names = append(names,n) }
+	for n := range listed { names = append(names,n) }
+	sort.Strings(names)
+	for i,n := range names {
+		if i>0 && names[i-1]==n { continue }
+		desc,ok := listed[n]
+		if ok && !inScope(n,scope) { continue }
+		status,exists := existing[n]
+		if !ok {
+			change(n,"remove",func() error { return p.Groups.RemoveGroup(n) })
+			continue
+		}
+		want := byte('y')
+		if isModerated(desc) { want = 'm' }
+		switch {
+		case !exists:
+			change(n,"create",func() error { return p.Groups.NewGroup(n,want,desc) })
+		case (status=='m')!=(want=='m'):
+			change(n,"change status",func() error { return p.Groups.NewGroup(n,want,desc) })
+		}
+	}
+}
@@ -89,6 +89,10 @@ var ErrIHaveFailed = &NNTPError{436, "Transfer failed; try again later"}
 // rejected due the server not wanting the article.
 var ErrIHaveRejected = &NNTPError{437, "Transfer rejected; do not retry"}
 
+// ErrDownloadQuota is returned when a download is refused, because the
+// download quota of the user is used up.
+var ErrDownloadQuota = &NNTPError{502, "Download quota exceeded"}
+
 // ErrAuthRequired is returned to indicate authentication is required
 // to proceed.
 var ErrAuthRequired = &NNTPError{450, "authorization required"}
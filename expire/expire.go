@@ -0,0 +1,389 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+The expire engine. It removes old articles according to retention policies,
+that are selected by group.
+
+The engine walks the overview database (see package overview), decides for
+each entry, whether it has expired, and removes it from the article storage and
+the overview, and marks its Message-ID as expired in the history database (see
+package history). After each full pass, the expired entries of the history
+database are removed.
+
+The walk is incremental: Step processes a limited number of entries, so that
+the engine can run in the background (see Start) without blocking the server
+for long.
+*/
+package expire
+
+import "github.com/byte-mug/fastnntp"
+import "github.com/byte-mug/fastnntp/history"
+import "github.com/byte-mug/fastnntp/overview"
+import "errors"
+import "fmt"
+import "io"
+import "sort"
+import "sync"
+import "time"
+
+/*
+A retention policy.
+*/
+type Policy struct{
+	// The groups, this policy applies to.
+	Groups *fastnntp.WildMat
+	
+	// Articles are removed, after they have been stored for MaxAge. If 0, there
+	// is no age limit.
+	MaxAge time.Duration
+	
+	// If set, the Expires field of an article replaces MaxAge for this article.
+	HonorExpires bool
+	
+	// Limits the lifetime, that can be requested by the Expires field. If 0,
+	// there is no limit.
+	MaxExpires time.Duration
+	
+	// If not 0, only the newest MaxArticles articles of a group are retained.
+	MaxArticles int64
+}
+
+/*
+Creates a policy for the groups matching the wildmat pattern.
+*/
+func NewPolicy(groups string) (*Policy,error) {
+	wm := fastnntp.ParseWildMat(groups)
+	if err := wm.Compile(); err!=nil { return nil,err }
+	return &Policy{Groups:wm},nil
+}
+
+// Reports, whether an entry has expired by its age.
+func (p *Policy) Expired(e *overview.Entry, now time.Time) bool {
+	if e.Arrived==0 { return false }
+	arrived := time.Unix(e.Arrived,0)
+	if p.HonorExpires && e.Expires!=0 {
+		end := time.Unix(e.Expires,0)
+		if p.MaxExpires>0 && end.After(arrived.Add(p.MaxExpires)) { end = arrived.Add(p.MaxExpires) }
+		return !now.Before(end)
+	}
+	if p.MaxAge<=0 { return false }
+	return !now.Before(arrived.Add(p.MaxAge))
+}
+
+/*
+The article storage. Spools, that are driven by the engine, implement this
+interface.
+*/
+type Storage interface{
+	// Removes an article from a group. The article itself is removed, once it
+	// belongs to no group anymore. The low water mark of the group is updated.
+	ExpireArticle(group string, num int64) error
+}
+
+// The result of the expiry of a group.
+type GroupReport struct{
+	Group   string
+	Scanned int64
+	
+	// The number of articles removed (or, on a dry run, to be removed).
+	Expired int64
+	
+	// The number of expired articles, that the storage failed to remove.
+	// They are retained, and tried again with the next pass.
+	Failed  int64
+	
+	// The new low water mark.
+	Low int64
+}
+
+// The result of a pass.
+type Report struct{
+	Started, Finished time.Time
+	DryRun bool
+	Groups []*GroupReport
+	
+	// The number of removed history entries.
+	History int
+}
+
+func (r *Report) Expired() (n int64) {
+	for _,g := range r.Groups { n += g.Expired }
+	return
+}
+
+func (r *Report) Failed() (n int64) {
+	for _,g := range r.Groups { n += g.Failed }
+	return
+}
+
+// Writes a human readable form of the report.
+func (r *Report) WriteTo(w io.Writer) (int64,error) {
+	cw := &countWriter{w:w}
+	mode := ""
+	if r.DryRun { mode = " (dry run)" }
+	fmt.Fprintf(cw,"expire%s: %s - %s\n",mode,r.Started.Format(time.RFC3339),r.Finished.Format(time.RFC3339))
+	for _,g := range r.Groups {
+		fmt.Fprintf(cw,"%s\tscanned %d\texpired %d\tfailed %d\tlow %d\n",g.Group,g.Scanned,g.Expired,g.Failed,g.Low)
+	}
+	fmt.Fprintf(cw,"total expired %d, failed %d, history entries removed %d\n",r.Expired(),r.Failed(),r.History)
+	return cw.n,cw.err
+}
+
+type countWriter struct{
+	w   io.Writer
+	n   int64
+	err error
+}
+func (c *countWriter) Write(p []byte) (int,error) {
+	if c.err!=nil { return 0,c.err }
+	n,err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n,err
+}
+
+var errBatchFull = errors.New("batch full")
+
+/*
+The expire engine.
+*/
+type Engine struct{
+	// The overview database. It is required.
+	Overview *overview.DB
+	
+	// If not nil, the Message-IDs of removed articles are marked as expired in
+	// it, and its expired entries are removed after each pass.
+	History *history.History
+	
+	// If not nil, expired articles are removed from it.
+	Storage Storage
+	
+	// The policies. The first policy, that matches a group, applies. Groups,
+	// that match no policy, are not expired.
+	Policies []*Policy
+	
+	// If set, nothing is removed; the report shows, what would have been removed.
+	DryRun bool
+	
+	// The number of entries processed by Step. Defaults to 1000.
+	Batch int
+	
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+	
+	lock   sync.Mutex
+	report *Report
+	groups []string
+	cur    *groupState
+	
+	stop chan struct{}
+	done chan struct{}
+}
+
+type groupState struct{
+	policy *Policy
+	next   int64
+	excess int64
+	rep    *GroupReport
+}
+
+func (e *Engine) now() time.Time {
+	if e.Now!=nil { return e.Now() }
+	return time.Now()
+}
+
+func (e *Engine) policy(group string) *Policy {
+	for _,p := range e.Policies {
+		if p.Groups.MatchString(group) { return p }
+	}
+	return nil
+}
+
+/*
+Processes the next batch of entries. If a pass is finished, its report is
+returned, and the next call starts a new pass.
+*/
+func (e *Engine) Step() (*Report,error) {
+	e.lock.Lock(); defer e.lock.Unlock()
+	now := e.now()
+	if e.report==nil {
+		e.report = &Report{Started:now,DryRun:e.DryRun}
+		e.groups = e.Overview.Groups()
+		sort.Strings(e.groups)
+	}
+	batch := e.Batch
+	if batch<=0 { batch = 1000 }
+	
+	for batch>0 {
+		if e.cur==nil {
+			if len(e.groups)==0 { return e.finish(now) }
+			g := e.groups[0]
+			e.groups = e.groups[1:]
+			p := e.policy(g)
+			if p==nil { continue }
+			count,low,_,ok := e.Overview.Stat(g)
+			if !ok { continue }
+			e.cur = &groupState{policy:p,next:low,rep:&GroupReport{Group:g,Low:low}}
+			if p.MaxArticles>0 && count>p.MaxArticles { e.cur.excess = count-p.MaxArticles }
+			e.report.Groups = append(e.report.Groups,e.cur.rep)
+		}
+		n,err := e.stepGroup(now,batch)
+		batch -= n
+		if err!=nil { return nil,err }
+	}
+	return nil,nil
+}
+
+// An entry, that has expired.
+type deadEntry struct{
+	num int64
+	id  []byte
+}
+
+// Processes up to max entries of the current group.
+func (e *Engine) stepGroup(now time.Time, max int) (n int,err error) {
+	g := e.cur
+	rep := g.rep
+	var dead []deadEntry
+	first := int64(-1)
+	end := true
+	err = e.Overview.Scan(rep.Group,g.next,1<<62,func(ent *overview.Entry) error {
+		if n>=max { end = false; return errBatchFull }
+		n++
+		g.next = ent.Number+1
+		if g.excess>0 || g.policy.Expired(ent,now) {
+			if g.excess>0 { g.excess-- }
+			dead = append(dead,deadEntry{ent.Number,append([]byte(nil),ent.MessageId...)})
+		} else if first<0 {
+			first = ent.Number
+		}
+		return nil
+	})
+	if err==errBatchFull { err = nil }
+	if err!=nil { return }
+	rep.Scanned += int64(n)
+	if e.DryRun {
+		rep.Expired += int64(len(dead))
+	} else {
+		removed := dead[:0]
+		for _,d := range dead {
+			if e.Storage!=nil && e.Storage.ExpireArticle(rep.Group,d.num)!=nil {
+				// The article is retained.
+				rep.Failed++
+				if first<0 || d.num<first { first = d.num }
+				continue
+			}
+			if err = e.Overview.Delete(rep.Group,d.num); err!=nil { return }
+			if e.History!=nil && len(d.id)>0 {
+				if err = e.History.MarkExpired(d.id); err!=nil { return }
+			}
+			rep.Expired++
+			removed = append(removed,d)
+		}
+		dead = removed
+	}
+	
+	// The low water mark is the first entry, that survives.
+	if len(dead)>0 && rep.Low>=dead[0].num {
+		if first>=0 {
+			rep.Low = first
+		} else {
+			rep.Low = g.next
+		}
+	}
+	if !end { return }
+	if !e.DryRun && rep.Expired>0 {
+		if err = e.Overview.Compact(rep.Group); err!=nil { return }
+		_,rep.Low,_,_ = e.Overview.Stat(rep.Group)
+	}
+	e.cur = nil
+	if n==0 { n = 1 } // Count empty groups, so that a step terminates.
+	return
+}
+
+func (e *Engine) finish(now time.Time) (r *Report,err error) {
+	r = e.report
+	e.report = nil
+	if e.History!=nil && !e.DryRun {
+		r.History,err = e.History.Expire()
+	}
+	r.Finished = e.now()
+	return
+}
+
+/*
+Performs a complete pass.
+*/
+func (e *Engine) Run() (*Report,error) {
+	for {
+		r,err := e.Step()
+		if r!=nil || err!=nil { return r,err }
+	}
+}
+
+/*
+Runs the engine in the background. Between two steps, it pauses for pause;
+between two passes, it pauses for interval. If report is not nil, it is called
+with the report of each pass, or with the error, if a pass failed.
+*/
+func (e *Engine) Start(pause, interval time.Duration, report func(r *Report, err error)) {
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	go e.loop(pause,interval,report,e.stop,e.done)
+}
+
+func (e *Engine) loop(pause, interval time.Duration, report func(r *Report, err error), stop, done chan struct{}) {
+	defer close(done)
+	for {
+		r,err := e.Step()
+		wait := pause
+		if r!=nil || err!=nil {
+			if report!=nil { report(r,err) }
+			wait = interval
+			if err!=nil {
+				// Start over with a new pass.
+				e.lock.Lock()
+				e.report,e.cur = nil,nil
+				e.lock.Unlock()
+			}
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Stops the background engine, started by Start, and waits for it.
+func (e *Engine) Stop() {
+	if e.stop==nil { return }
+	close(e.stop)
+	<-e.done
+	e.stop,e.done = nil,nil
+}
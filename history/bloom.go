@@ -0,0 +1,63 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package history
+
+import "encoding/binary"
+
+const bloomK = 7
+
+type bloom struct{
+	bits []uint64
+	m    uint64
+}
+
+func (b *bloom) init(m uint64) {
+	b.m = m
+	b.bits = make([]uint64,(m+63)/64)
+}
+
+// Double hashing over the two halves of the Message-ID hash.
+func (b *bloom) each(h *Hash, fn func(i uint64) bool) bool {
+	h1 := binary.BigEndian.Uint64(h[:8])
+	h2 := binary.BigEndian.Uint64(h[8:])|1
+	for k := uint64(0); k<bloomK; k++ {
+		if !fn((h1+k*h2)%b.m) { return false }
+	}
+	return true
+}
+
+func (b *bloom) add(h *Hash) {
+	b.each(h,func(i uint64) bool {
+		b.bits[i/64] |= 1<<(i%64)
+		return true
+	})
+}
+
+func (b *bloom) has(h *Hash) bool {
+	return b.each(h,func(i uint64) bool {
+		return b.bits[i/64]&(1<<(i%64))!=0
+	})
+}
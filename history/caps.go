@@ -0,0 +1,76 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package history
+
+import "github.com/byte-mug/fastnntp"
+
+/*
+Wraps a fastnntp.PostingCaps and adds history checking.
+
+Message-IDs, that are known to the History, are refused by CheckPostId.
+Articles, that are accepted, are added to the History, and articles, that are
+rejected, are remembered as rejected. Temporary failures are not recorded.
+
+If the wrapped PostingCaps implement fastnntp.SessionPostingCaps,
+fastnntp.SessionCheckCaps or fastnntp.SessionCheckPostCaps, the session is
+passed on.
+*/
+type PostingCaps struct{
+	fastnntp.PostingCaps
+	History *History
+}
+
+func (p *PostingCaps) CheckPostId(id []byte) (wanted bool, possible bool) {
+	return p.CheckPostIdSession(id,nil)
+}
+func (p *PostingCaps) CheckPostIdSession(id []byte, s *fastnntp.Session) (wanted bool, possible bool) {
+	if p.History.Has(id) { return false,true }
+	if sc,ok := p.PostingCaps.(fastnntp.SessionCheckCaps); ok { return sc.CheckPostIdSession(id,s) }
+	return p.PostingCaps.CheckPostId(id)
+}
+func (p *PostingCaps) CheckPostSession(s *fastnntp.Session) (possible bool, reason string) {
+	if sc,ok := p.PostingCaps.(fastnntp.SessionCheckPostCaps); ok { return sc.CheckPostSession(s) }
+	return p.PostingCaps.CheckPost(),""
+}
+func (p *PostingCaps) PerformPost(id []byte, r *fastnntp.DotReader) (rejected bool,failed bool) {
+	rejected,failed,_ = p.PerformPostSession(id,r,nil)
+	return
+}
+func (p *PostingCaps) PerformPostSession(id []byte, r *fastnntp.DotReader, s *fastnntp.Session) (rejected bool,failed bool,reason string) {
+	if sp,ok := p.PostingCaps.(fastnntp.SessionPostingCaps); ok {
+		rejected,failed,reason = sp.PerformPostSession(id,r,s)
+	} else {
+		rejected,failed = p.PostingCaps.PerformPost(id,r)
+	}
+	
+	// POSTed articles have no Message-ID yet.
+	if len(id)==0 { return }
+	switch {
+	case rejected: p.History.Reject(id)
+	case !failed: p.History.Add(id)
+	}
+	return
+}
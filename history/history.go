@@ -0,0 +1,442 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+A Message-ID history database.
+
+The history remembers the Message-IDs of articles, that have been accepted or
+rejected, so that transit servers can answer CHECK and IHAVE without asking
+the article storage. Message-IDs are stored as hashes.
+
+The database consists of two files: "history", an append-only log of
+fixed-size records, and "history.index", an on-disk hash table pointing into
+the log. A bloom filter in memory answers most misses without disk access.
+*/
+package history
+
+import "crypto/sha256"
+import "encoding/binary"
+import "errors"
+import "os"
+import "path/filepath"
+import "sync"
+import "time"
+
+var ErrCorrupt = errors.New("history: corrupt database")
+
+const(
+	hashSize   = 16
+	recordSize = 40
+	
+	flagRejected  = 1
+	flagCancelled = 2
+	flagExpired   = 4
+	
+	idxMagic   = "FNHI"
+	idxHdrSize = 24
+	minSlots   = 1<<16
+)
+
+// The hash of a Message-ID.
+type Hash [hashSize]byte
+
+func HashOf(id []byte) (h Hash) {
+	s := sha256.Sum256(id)
+	copy(h[:],s[:])
+	return
+}
+
+func (h *Hash) slot(n uint64) uint64 { return binary.BigEndian.Uint64(h[:8])%n }
+
+/*
+A history entry.
+*/
+type Record struct{
+	Arrived time.Time
+	
+	// After this time, the entry may be removed by Expire. Zero, if never.
+	Expires time.Time
+	
+	// Set, if the article has been rejected.
+	Rejected bool
+	
+	// Set, if the article has been cancelled or superseded.
+	Cancelled bool
+	
+	// Set, if the expire engine has removed the article (from one of its
+	// groups, at least).
+	Expired bool
+}
+
+func unix(t time.Time) int64 {
+	if t.IsZero() { return 0 }
+	return t.Unix()
+}
+func fromUnix(i int64) time.Time {
+	if i==0 { return time.Time{} }
+	return time.Unix(i,0)
+}
+
+/*
+A record of the log:
+
+	hash    [16]byte
+	arrived int64
+	expires int64
+	flags   uint32
+	unused  uint32
+*/
+func encodeRecord(b []byte, h *Hash, r *Record) {
+	copy(b,h[:])
+	binary.BigEndian.PutUint64(b[16:],uint64(unix(r.Arrived)))
+	binary.BigEndian.PutUint64(b[24:],uint64(unix(r.Expires)))
+	var fl uint32
+	if r.Rejected { fl |= flagRejected }
+	if r.Cancelled { fl |= flagCancelled }
+	if r.Expired { fl |= flagExpired }
+	binary.BigEndian.PutUint32(b[32:],fl)
+	binary.BigEndian.PutUint32(b[36:],0)
+}
+func decodeRecord(b []byte, h *Hash, r *Record) {
+	copy(h[:],b)
+	r.Arrived  = fromUnix(int64(binary.BigEndian.Uint64(b[16:])))
+	r.Expires  = fromUnix(int64(binary.BigEndian.Uint64(b[24:])))
+	fl := binary.BigEndian.Uint32(b[32:])
+	r.Rejected  = fl&flagRejected!=0
+	r.Cancelled = fl&flagCancelled!=0
+	r.Expired   = fl&flagExpired!=0
+}
+
+/*
+A History database. It is safe for concurrent use.
+*/
+type History struct{
+	// How long accepted Message-IDs are remembered. If 0, forever.
+	Remember time.Duration
+	
+	// How long rejected Message-IDs are remembered. If 0, they are not remembered.
+	RememberRejected time.Duration
+	
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+	
+	dir   string
+	lock  sync.RWMutex
+	log   *os.File
+	idx   *os.File
+	n     uint64 // Number of records in the log.
+	slots uint64
+	bloom bloom
+}
+
+func (h *History) now() time.Time {
+	if h.Now!=nil { return h.Now() }
+	return time.Now()
+}
+
+/*
+Opens or creates the history database in the directory dir.
+
+If the index is missing, damaged or behind the log (after a crash), it is
+rebuilt from the log.
+*/
+func Open(dir string) (*History,error) {
+	h := &History{dir:dir}
+	var err error
+	h.log,err = os.OpenFile(h.path("history"),os.O_RDWR|os.O_CREATE,0644)
+	if err!=nil { return nil,err }
+	fi,err := h.log.Stat()
+	if err!=nil { h.log.Close(); return nil,err }
+	
+	// A partially written last record is cut off.
+	h.n = uint64(fi.Size()/recordSize)
+	if fi.Size()%recordSize!=0 {
+		if err = h.log.Truncate(int64(h.n)*recordSize); err!=nil { h.log.Close(); return nil,err }
+	}
+	
+	if err = h.openIndex(); err!=nil { h.log.Close(); return nil,err }
+	return h,nil
+}
+
+func (h *History) path(name string) string { return filepath.Join(h.dir,name) }
+
+func (h *History) openIndex() (err error) {
+	h.idx,err = os.OpenFile(h.path("history.index"),os.O_RDWR|os.O_CREATE,0644)
+	if err!=nil { return }
+	var hdr [idxHdrSize]byte
+	_,err = h.idx.ReadAt(hdr[:],0)
+	indexed := binary.BigEndian.Uint64(hdr[16:])
+	h.slots = binary.BigEndian.Uint64(hdr[8:])
+	if err!=nil || string(hdr[:4])!=idxMagic || h.slots<minSlots || indexed>h.n {
+		h.idx.Close()
+		return h.rebuild(0)
+	}
+	fi,err := h.idx.Stat()
+	if err!=nil { return }
+	if fi.Size()!=idxHdrSize+int64(h.slots)*8 {
+		h.idx.Close()
+		return h.rebuild(0)
+	}
+	
+	h.bloom.init(h.slots*8)
+	err = h.eachRecord(func(i uint64, hs *Hash, r *Record) error {
+		h.bloom.add(hs)
+		if i>=indexed { return h.insert(hs,i) }
+		return nil
+	})
+	if err!=nil { return }
+	if indexed<h.n { return h.writeIndexed() }
+	return
+}
+
+func (h *History) eachRecord(fn func(i uint64, hs *Hash, r *Record) error) error {
+	buf := make([]byte,recordSize*1024)
+	var hs Hash
+	var r Record
+	for i := uint64(0); i<h.n; {
+		k := h.n-i
+		if k>1024 { k = 1024 }
+		b := buf[:k*recordSize]
+		if _,err := h.log.ReadAt(b,int64(i)*recordSize); err!=nil { return err }
+		for j := uint64(0); j<k; j++ {
+			decodeRecord(b[j*recordSize:],&hs,&r)
+			if err := fn(i+j,&hs,&r); err!=nil { return err }
+		}
+		i += k
+	}
+	return nil
+}
+
+// Creates a new index with at least the given number of slots.
+func (h *History) rebuild(slots uint64) (err error) {
+	if slots<minSlots { slots = minSlots }
+	for slots<h.n*2 { slots *= 2 }
+	tmp := h.path("history.index.new")
+	h.idx,err = os.OpenFile(tmp,os.O_RDWR|os.O_CREATE|os.O_TRUNC,0644)
+	if err!=nil { return }
+	var hdr [idxHdrSize]byte
+	copy(hdr[:],idxMagic)
+	binary.BigEndian.PutUint64(hdr[8:],slots)
+	if _,err = h.idx.WriteAt(hdr[:],0); err==nil { err = h.idx.Truncate(idxHdrSize+int64(slots)*8) }
+	if err!=nil { h.idx.Close(); os.Remove(tmp); return }
+	h.slots = slots
+	h.bloom.init(slots*8)
+	err = h.eachRecord(func(i uint64, hs *Hash, r *Record) error {
+		h.bloom.add(hs)
+		return h.insert(hs,i)
+	})
+	if err==nil { err = h.writeIndexed() }
+	if err==nil { err = h.idx.Sync() }
+	if err==nil { err = os.Rename(tmp,h.path("history.index")) }
+	if err!=nil { h.idx.Close(); os.Remove(tmp) }
+	return
+}
+
+func (h *History) writeIndexed() error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],h.n)
+	_,err := h.idx.WriteAt(b[:],16)
+	return err
+}
+
+// Adds record i to the hash table. A slot contains the record number plus one.
+func (h *History) insert(hs *Hash, i uint64) error {
+	var b [8]byte
+	for s := hs.slot(h.slots);; s = (s+1)%h.slots {
+		if _,err := h.idx.ReadAt(b[:],idxHdrSize+int64(s)*8); err!=nil { return err }
+		if binary.BigEndian.Uint64(b[:])!=0 { continue }
+		binary.BigEndian.PutUint64(b[:],i+1)
+		_,err := h.idx.WriteAt(b[:],idxHdrSize+int64(s)*8)
+		return err
+	}
+}
+
+// Finds the record number of a hash.
+func (h *History) find(hs *Hash, r *Record) (uint64,bool,error) {
+	if !h.bloom.has(hs) { return 0,false,nil }
+	var b [8]byte
+	var rb [recordSize]byte
+	var other Hash
+	for s := hs.slot(h.slots);; s = (s+1)%h.slots {
+		if _,err := h.idx.ReadAt(b[:],idxHdrSize+int64(s)*8); err!=nil { return 0,false,err }
+		i := binary.BigEndian.Uint64(b[:])
+		if i==0 { return 0,false,nil }
+		i--
+		if i>=h.n { return 0,false,ErrCorrupt }
+		if _,err := h.log.ReadAt(rb[:],int64(i)*recordSize); err!=nil { return 0,false,err }
+		decodeRecord(rb[:],&other,r)
+		if other==*hs { return i,true,nil }
+	}
+}
+
+func (h *History) Close() error {
+	h.lock.Lock(); defer h.lock.Unlock()
+	e1 := h.log.Close()
+	e2 := h.idx.Close()
+	if e1!=nil { return e1 }
+	return e2
+}
+
+/*
+Looks up a Message-ID. Entries, that have expired, but have not been removed
+yet, are returned as well.
+*/
+func (h *History) Lookup(id []byte) (r Record,ok bool,err error) {
+	hs := HashOf(id)
+	h.lock.RLock(); defer h.lock.RUnlock()
+	_,ok,err = h.find(&hs,&r)
+	return
+}
+
+/*
+Reports, whether the Message-ID is known and its entry has not expired.
+*/
+func (h *History) Has(id []byte) bool {
+	r,ok,_ := h.Lookup(id)
+	if !ok { return false }
+	return r.Expires.IsZero() || r.Expires.After(h.now())
+}
+
+/*
+Stores an entry. An existing entry for the same Message-ID is replaced.
+*/
+func (h *History) Put(id []byte, r Record) error {
+	hs := HashOf(id)
+	var b [recordSize]byte
+	encodeRecord(b[:],&hs,&r)
+	h.lock.Lock(); defer h.lock.Unlock()
+	var old Record
+	i,ok,err := h.find(&hs,&old)
+	if err!=nil { return err }
+	if ok {
+		_,err = h.log.WriteAt(b[:],int64(i)*recordSize)
+		return err
+	}
+	if (h.n+1)*2>h.slots {
+		h.idx.Close()
+		if err = h.rebuild(h.slots*2); err!=nil { return err }
+	}
+	i = h.n
+	if _,err = h.log.WriteAt(b[:],int64(i)*recordSize); err!=nil { return err }
+	h.n++
+	h.bloom.add(&hs)
+	if err = h.insert(&hs,i); err!=nil { return err }
+	return h.writeIndexed()
+}
+
+// Remembers an accepted article, that arrived now.
+func (h *History) Add(id []byte) error {
+	now := h.now()
+	r := Record{Arrived:now}
+	if h.Remember>0 { r.Expires = now.Add(h.Remember) }
+	return h.Put(id,r)
+}
+
+/*
+Remembers a rejected article for RememberRejected. If RememberRejected is 0,
+nothing is done. Entries of accepted articles are not replaced.
+*/
+func (h *History) Reject(id []byte) error {
+	if h.RememberRejected<=0 { return nil }
+	if r,ok,_ := h.Lookup(id); ok && !r.Rejected { return nil }
+	now := h.now()
+	return h.Put(id,Record{Arrived:now,Expires:now.Add(h.RememberRejected),Rejected:true})
+}
+
+/*
+Marks a Message-ID as cancelled. If it is unknown, an entry is created, so that
+the article is refused, should it arrive later. Such an entry expires like the
+entry of an accepted article.
+*/
+func (h *History) Cancel(id []byte) error {
+	r,ok,err := h.Lookup(id)
+	if err!=nil { return err }
+	if !ok {
+		now := h.now()
+		r = Record{Arrived:now}
+		if h.Remember>0 { r.Expires = now.Add(h.Remember) }
+	}
+	r.Cancelled = true
+	return h.Put(id,r)
+}
+
+/*
+Marks a Message-ID, whose article has been removed from the storage. The entry
+is kept for at least Remember from now, so that the article is refused, should
+it be offered again. If it is unknown, an entry is created.
+*/
+func (h *History) MarkExpired(id []byte) error {
+	r,ok,err := h.Lookup(id)
+	if err!=nil { return err }
+	now := h.now()
+	if !ok { r = Record{Arrived:now} }
+	if h.Remember>0 {
+		if end := now.Add(h.Remember); r.Expires.Before(end) { r.Expires = end }
+	} else {
+		r.Expires = time.Time{}
+	}
+	r.Expired = true
+	return h.Put(id,r)
+}
+
+/*
+Removes all entries, that have expired, and rewrites the database.
+Returns the number of removed entries.
+*/
+func (h *History) Expire() (n int,err error) {
+	now := unix(h.now())
+	h.lock.Lock(); defer h.lock.Unlock()
+	tmp := h.path("history.new")
+	f,err := os.Create(tmp)
+	if err!=nil { return }
+	var kept uint64
+	buf := make([]byte,0,recordSize*1024)
+	var rb [recordSize]byte
+	err = h.eachRecord(func(i uint64, hs *Hash, r *Record) error {
+		if e := unix(r.Expires); e!=0 && e<=now { n++; return nil }
+		encodeRecord(rb[:],hs,r)
+		buf = append(buf,rb[:]...)
+		kept++
+		if len(buf)==cap(buf) {
+			_,err := f.Write(buf)
+			buf = buf[:0]
+			return err
+		}
+		return nil
+	})
+	if err==nil { _,err = f.Write(buf) }
+	if err==nil { err = f.Sync() }
+	if err!=nil { f.Close(); os.Remove(tmp); return 0,err }
+	if err = os.Rename(tmp,h.path("history")); err!=nil { f.Close(); return 0,err }
+	h.log.Close()
+	h.log = f
+	h.n = kept
+	
+	// The old index does not match the new log. If we crash before the rebuild
+	// is complete, the index is rebuilt on open, as its record count is too high.
+	h.idx.Close()
+	err = h.rebuild(0)
+	return
+}
@@ -0,0 +1,201 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package history
+
+import "encoding/binary"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func tempHistory(t *testing.T) (*History,string) {
+	dir,err := ioutil.TempDir("","history")
+	if err!=nil { t.Fatal(err) }
+	h,err := Open(dir)
+	if err!=nil { os.RemoveAll(dir); t.Fatal(err) }
+	return h,dir
+}
+
+func reopen(t *testing.T, h *History, dir string) *History {
+	if h!=nil { h.Close() }
+	h,err := Open(dir)
+	if err!=nil { t.Fatal(err) }
+	return h
+}
+
+func id(i int) []byte { return []byte(fmt.Sprintf("<%d@example.org>",i)) }
+
+func sameRecord(a, b Record) bool {
+	return a.Arrived.Equal(b.Arrived) && a.Expires.Equal(b.Expires) &&
+		a.Rejected==b.Rejected && a.Cancelled==b.Cancelled && a.Expired==b.Expired
+}
+
+func TestRecordEncoding(t *testing.T) {
+	hs := HashOf([]byte("<x@y>"))
+	at := time.Unix(1600000000,0)
+	for _,r := range []Record{
+		{},
+		{Arrived:at},
+		{Arrived:at,Expires:at.Add(time.Hour),Rejected:true},
+		{Arrived:at,Cancelled:true,Expired:true},
+	} {
+		var b [recordSize]byte
+		var h2 Hash
+		var r2 Record
+		encodeRecord(b[:],&hs,&r)
+		decodeRecord(b[:],&h2,&r2)
+		if h2!=hs || !sameRecord(r,r2) { t.Errorf("%+v decoded as %+v",r,r2) }
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	h,dir := tempHistory(t)
+	defer os.RemoveAll(dir)
+	at := time.Unix(1600000000,0)
+	
+	// Enough entries to grow the index.
+	const n = minSlots/2+1000
+	for i := 0; i<n; i++ {
+		r := Record{Arrived:at.Add(time.Duration(i)*time.Second),Rejected:i%3==0,Cancelled:i%5==0}
+		if err := h.Put(id(i),r); err!=nil { t.Fatal(err) }
+	}
+	if h.slots<=minSlots { t.Errorf("index not grown: %d slots",h.slots) }
+	
+	// Replacing does not add records.
+	if err := h.Put(id(7),Record{Arrived:at,Expired:true}); err!=nil { t.Fatal(err) }
+	if h.n!=n { t.Errorf("%d records, want %d",h.n,n) }
+	
+	check := func(h *History) {
+		for i := 0; i<n; i++ {
+			want := Record{Arrived:at.Add(time.Duration(i)*time.Second),Rejected:i%3==0,Cancelled:i%5==0}
+			if i==7 { want = Record{Arrived:at,Expired:true} }
+			r,ok,err := h.Lookup(id(i))
+			if !ok || err!=nil || !sameRecord(r,want) { t.Fatalf("entry %d: %+v %v %v",i,r,ok,err) }
+		}
+		for i := n; i<n+1000; i++ {
+			if _,ok,_ := h.Lookup(id(i)); ok { t.Fatalf("unknown entry %d found",i) }
+		}
+	}
+	check(h)
+	h = reopen(t,h,dir)
+	check(h)
+	h.Close()
+}
+
+func TestLifecycle(t *testing.T) {
+	h,dir := tempHistory(t)
+	defer os.RemoveAll(dir)
+	defer func() { h.Close() }()
+	now := time.Unix(1600000000,0)
+	h.Now = func() time.Time { return now }
+	h.Remember = 24*time.Hour
+	h.RememberRejected = time.Hour
+	
+	h.Add(id(1))
+	h.Reject(id(2))
+	h.Reject(id(1)) // does not replace the accepted entry
+	h.Cancel(id(3)) // not arrived yet
+	if r,_,_ := h.Lookup(id(1)); r.Rejected || !r.Expires.Equal(now.Add(24*time.Hour)) { t.Errorf("accepted: %+v",r) }
+	if r,_,_ := h.Lookup(id(2)); !r.Rejected || !r.Expires.Equal(now.Add(time.Hour)) { t.Errorf("rejected: %+v",r) }
+	if r,_,_ := h.Lookup(id(3)); !r.Cancelled { t.Errorf("cancelled: %+v",r) }
+	
+	// Rejections are forgotten first.
+	now = now.Add(2*time.Hour)
+	if h.Has(id(2)) || !h.Has(id(1)) { t.Error("Has after two hours") }
+	if n,err := h.Expire(); n!=1 || err!=nil { t.Errorf("Expire: %d %v",n,err) }
+	if _,ok,_ := h.Lookup(id(2)); ok { t.Error("expired entry kept") }
+	
+	// Marking an article as expired extends its entry.
+	now = now.Add(20*time.Hour)
+	if err := h.MarkExpired(id(1)); err!=nil { t.Fatal(err) }
+	now = now.Add(10*time.Hour)
+	if n,_ := h.Expire(); n!=1 { t.Errorf("Expire removed %d entries, want 1 (the cancel)",n) }
+	r,ok,_ := h.Lookup(id(1))
+	if !ok || !r.Expired || !h.Has(id(1)) { t.Errorf("marked entry: %+v %v",r,ok) }
+	
+	h.Remember = 0
+	h.MarkExpired(id(4))
+	now = now.Add(1000*time.Hour)
+	h.Expire()
+	if !h.Has(id(4)) { t.Error("entry without Remember expired") }
+	
+	h = reopen(t,h,dir)
+	if !h.Has(id(4)) || h.Has(id(2)) { t.Error("state lost after reopen") }
+}
+
+func TestCorruption(t *testing.T) {
+	h,dir := tempHistory(t)
+	defer os.RemoveAll(dir)
+	for i := 0; i<100; i++ { h.Add(id(i)) }
+	h.Close()
+	check := func(what string, n int) {
+		h = reopen(t,nil,dir)
+		defer h.Close()
+		for i := 0; i<n; i++ {
+			if !h.Has(id(i)) { t.Fatalf("%s: entry %d lost",what,i) }
+		}
+	}
+	log := filepath.Join(dir,"history")
+	index := filepath.Join(dir,"history.index")
+	
+	// A partially written record is cut off.
+	f,_ := os.OpenFile(log,os.O_WRONLY|os.O_APPEND,0644)
+	f.Write(make([]byte,recordSize/2))
+	f.Close()
+	check("partial record",100)
+	if fi,_ := os.Stat(log); fi.Size()!=100*recordSize { t.Errorf("log size %d",fi.Size()) }
+	
+	// Records, that were written before a crash, but not indexed.
+	f,_ = os.OpenFile(log,os.O_WRONLY|os.O_APPEND,0644)
+	for i := 100; i<110; i++ {
+		var b [recordSize]byte
+		hs := HashOf(id(i))
+		encodeRecord(b[:],&hs,&Record{Arrived:time.Now()})
+		f.Write(b[:])
+	}
+	f.Close()
+	check("unindexed records",110)
+	
+	// A missing, damaged or truncated index is rebuilt.
+	os.Remove(index)
+	check("missing index",110)
+	data,_ := ioutil.ReadFile(index)
+	data[0] = 'X'
+	ioutil.WriteFile(index,data,0644)
+	check("bad magic",110)
+	ioutil.WriteFile(index,data[:1000],0644)
+	check("truncated index",110)
+	
+	// A slot pointing behind the log is reported.
+	h = reopen(t,nil,dir)
+	hs := HashOf(id(200))
+	h.bloom.add(&hs)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],1<<40)
+	h.idx.WriteAt(b[:],idxHdrSize+int64(hs.slot(h.slots))*8)
+	if _,_,err := h.Lookup(id(200)); err!=ErrCorrupt { t.Errorf("bad slot: %v",err) }
+	h.Close()
+}
@@ -0,0 +1,62 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package memstore
+
+import "github.com/byte-mug/fastnntp"
+
+// ---------------------------------------------------------------------------
+// fastnntp.LoginCaps
+
+// If no users are configured, authentication is considered done.
+func (s *Store) AuthinfoDone(h *fastnntp.Handler) bool {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	return len(s.users)==0
+}
+func (s *Store) AuthinfoCheckPrivilege(p fastnntp.LoginPriv, h *fastnntp.Handler) bool {
+	return !(s.AuthRequired && !s.AuthinfoDone(h))
+}
+func (s *Store) AuthinfoUserOny(user []byte, oldh *fastnntp.Handler) (bool,*fastnntp.Handler) {
+	return false,nil
+}
+func (s *Store) AuthinfoUserPass(user, password []byte, oldh *fastnntp.Handler) (bool,*fastnntp.Handler) {
+	s.lock.RLock()
+	pw,ok := s.users[string(user)]
+	s.lock.RUnlock()
+	if !ok || pw!=string(password) { return false,nil }
+	nh := *oldh
+	nh.LoginCaps = &userLogin{string(user)}
+	return true,&nh
+}
+
+// The LoginCaps of an authenticated session.
+type userLogin struct{
+	user string
+}
+func (u *userLogin) AuthinfoDone(h *fastnntp.Handler) bool { return true }
+func (u *userLogin) AuthinfoCheckPrivilege(p fastnntp.LoginPriv, h *fastnntp.Handler) bool { return true }
+func (u *userLogin) AuthinfoUserOny(user []byte, oldh *fastnntp.Handler) (bool,*fastnntp.Handler) { return false,nil }
+func (u *userLogin) AuthinfoUserPass(user, password []byte, oldh *fastnntp.Handler) (bool,*fastnntp.Handler) { return false,nil }
+
@@ -0,0 +1,469 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+An in-memory news store, implementing all capability interfaces of fastnntp.
+
+It is meant for tests, demos and small deployments. Everything is lost, when the
+process exits.
+*/
+package memstore
+
+import "github.com/byte-mug/fastnntp"
+import "github.com/byte-mug/fastnntp/posting"
+import "sort"
+import "sync"
+
+type article struct{
+	id    []byte
+	head  []byte // Wire form, CRLF line endings.
+	body  []byte // Wire form, dot-stuffed.
+	
+	// Overview fields.
+	subject, from, date, refs []byte
+	bytes, lines int64
+	
+	// The groups and numbers of the article.
+	groups []*group
+	nums   []int64
+}
+
+type group struct{
+	name   []byte
+	status byte
+	desc   []byte
+	high   int64
+	nums   []int64 // sorted
+	arts   map[int64]*article
+}
+
+func (g *group) low() int64 {
+	if len(g.nums)==0 { return g.high+1 }
+	return g.nums[0]
+}
+
+// Returns the index of the first number >= n.
+func (g *group) search(n int64) int {
+	return sort.Search(len(g.nums),func(i int) bool { return g.nums[i]>=n })
+}
+
+// Adds an article under the given number, keeping the numbers sorted.
+func (g *group) insert(n int64,a *article) {
+	i := g.search(n)
+	g.nums = append(g.nums,0)
+	copy(g.nums[i+1:],g.nums[i:])
+	g.nums[i] = n
+	g.arts[n] = a
+	if n>g.high { g.high = n }
+}
+
+func (g *group) remove(n int64) {
+	delete(g.arts,n)
+	i := g.search(n)
+	if i<len(g.nums) && g.nums[i]==n {
+		g.nums = append(g.nums[:i],g.nums[i+1:]...)
+	}
+}
+
+/*
+The in-memory store. Use New to create one.
+
+The Store implements fastnntp.GroupCaps, fastnntp.ArticleCaps,
+fastnntp.PostingCaps, fastnntp.GroupListingCaps and fastnntp.LoginCaps,
+as well as posting.Store, control.GroupManager and control.ArticleManager.
+*/
+type Store struct{
+	lock   sync.RWMutex
+	groups map[string]*group
+	byId   map[string]*article
+	users  map[string]string
+	
+	// The posting pipeline, used for POST, IHAVE and TAKETHIS.
+	// It may be reconfigured before the Store is used.
+	Posting *posting.Pipeline
+	
+	// If set and users are configured, posting requires authentication.
+	AuthRequired bool
+}
+
+/*
+Creates a new Store. The host is used as path identity and as the right hand
+side of generated Message-IDs.
+*/
+func New(host string) *Store {
+	s := &Store{
+		groups: make(map[string]*group),
+		byId  : make(map[string]*article),
+		users : make(map[string]string),
+	}
+	s.Posting = &posting.Pipeline{Store:s,Stamper:posting.NewCounterStamper(host)}
+	return s
+}
+
+// Returns a Handler, that is backed by this Store.
+func (s *Store) Handler() *fastnntp.Handler {
+	return &fastnntp.Handler{
+		GroupCaps: s,
+		ArticleCaps: s,
+		PostingCaps: s.Posting,
+		GroupListingCaps: s,
+		LoginCaps: s,
+	}
+}
+
+/*
+Adds a group or updates its status and description. The status is one of
+'y' (posting permitted), 'n' (posting not permitted) or 'm' (moderated).
+*/
+func (s *Store) AddGroup(name string, status byte, desc string) {
+	s.lock.Lock(); defer s.lock.Unlock()
+	if g,ok := s.groups[name]; ok {
+		g.status = status
+		g.desc = []byte(desc)
+		return
+	}
+	s.groups[name] = &group{
+		name:   []byte(name),
+		status: status,
+		desc:   []byte(desc),
+		arts:   make(map[int64]*article),
+	}
+}
+
+// Creates a group or updates it. Implements control.GroupManager.
+func (s *Store) NewGroup(name string, status byte, desc string) error {
+	s.AddGroup(name,status,desc)
+	return nil
+}
+
+/*
+Removes a group. Articles, that are in no other group, are deleted. Removing a
+group, that does not exist, is not an error. Implements control.GroupManager.
+*/
+func (s *Store) RemoveGroup(name string) error {
+	s.lock.Lock(); defer s.lock.Unlock()
+	g,ok := s.groups[name]
+	if !ok { return nil }
+	delete(s.groups,name)
+	for _,a := range g.arts {
+		j := 0
+		for i,og := range a.groups {
+			if og==g { continue }
+			a.groups[j],a.nums[j] = og,a.nums[i]
+			j++
+		}
+		a.groups,a.nums = a.groups[:j],a.nums[:j]
+		if j==0 { delete(s.byId,string(a.id)) }
+	}
+	return nil
+}
+
+// Calls fn for every group. Implements control.GroupManager.
+func (s *Store) EachGroup(fn func(name string, status byte)) {
+	s.lock.RLock()
+	type ent struct{
+		name   string
+		status byte
+	}
+	ents := make([]ent,0,len(s.groups))
+	for n,g := range s.groups { ents = append(ents,ent{n,g.status}) }
+	s.lock.RUnlock()
+	for _,e := range ents { fn(e.name,e.status) }
+}
+
+// Returns the header of an article, or nil. Implements control.ArticleManager.
+func (s *Store) ArticleHeader(id []byte) *posting.Header {
+	s.lock.RLock()
+	a,ok := s.byId[string(id)]
+	s.lock.RUnlock()
+	if !ok { return nil }
+	return posting.ParseHeader(a.head)
+}
+
+/*
+Deletes an article from all its groups. Deleting an article, that does not
+exist, is not an error. Implements control.ArticleManager.
+*/
+func (s *Store) Delete(id []byte) error {
+	s.lock.Lock(); defer s.lock.Unlock()
+	a,ok := s.byId[string(id)]
+	if !ok { return nil }
+	delete(s.byId,string(id))
+	for i,g := range a.groups { g.remove(a.nums[i]) }
+	return nil
+}
+
+/*
+Removes an article from one group. The article is deleted, once it belongs to
+no group anymore. Implements expire.Storage.
+*/
+func (s *Store) ExpireArticle(group string, num int64) error {
+	s.lock.Lock(); defer s.lock.Unlock()
+	g,ok := s.groups[group]
+	if !ok { return nil }
+	a,ok := g.arts[num]
+	if !ok { return nil }
+	g.remove(num)
+	j := 0
+	for i,og := range a.groups {
+		if og==g && a.nums[i]==num { continue }
+		a.groups[j],a.nums[j] = og,a.nums[i]
+		j++
+	}
+	a.groups,a.nums = a.groups[:j],a.nums[:j]
+	if j==0 { delete(s.byId,string(a.id)) }
+	return nil
+}
+
+// Adds a user for AUTHINFO USER/PASS.
+func (s *Store) AddUser(user, password string) {
+	s.lock.Lock(); defer s.lock.Unlock()
+	s.users[user] = password
+}
+
+// Returns the status of a group. Implements posting.ActiveSource.
+func (s *Store) GroupStatus(group []byte) (status byte, ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	g,ok := s.groups[string(group)]
+	if !ok { return 0,false }
+	return g.status,true
+}
+
+// Returns the high water mark of a group. Implements posting.NumberSource.
+func (s *Store) GroupHigh(group []byte) (high int64, ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	g,ok := s.groups[string(group)]
+	if !ok { return 0,false }
+	return g.high,true
+}
+
+// ---------------------------------------------------------------------------
+// posting.Store
+
+func (s *Store) CheckPostId(id []byte) (wanted bool, possible bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	_,ok := s.byId[string(id)]
+	return !ok,true
+}
+func (s *Store) CheckPost() (possible bool) { return true }
+
+/*
+Stores an article in all groups of its Newsgroups field, that exist in the Store.
+If the article has been numbered by the Pipeline, these numbers are used; if
+one of them is already taken, the article is rejected. Articles, that belong to
+no known group, are rejected.
+*/
+func (s *Store) StoreArticle(pa *posting.Article) (rejected bool,failed bool) {
+	id := pa.MessageId()
+	if len(id)==0 { return true,false }
+	h := pa.Header
+	a := &article{
+		id:      append([]byte(nil),id...),
+		head:    h.Bytes(),
+		body:    pa.Body,
+		subject: ovClean(h.Get("Subject")),
+		from:    ovClean(h.Get("From")),
+		date:    ovClean(h.Get("Date")),
+		refs:    ovClean(h.Get("References")),
+		lines:   posting.CountLines(pa.Body),
+	}
+	a.bytes = int64(len(a.head)+2+len(a.body))
+	ngs := posting.SplitNewsgroups(h.Get("Newsgroups"))
+	if pa.Numbers!=nil {
+		// The groups and numbers assigned by the Pipeline.
+		ngs = ngs[:0]
+		for _,g := range pa.Numbers.Groups { ngs = append(ngs,[]byte(g)) }
+	}
+	
+	s.lock.Lock(); defer s.lock.Unlock()
+	if _,ok := s.byId[string(id)]; ok { return true,false }
+	if pa.Numbers!=nil {
+		// An assigned number, that is already taken, would lose the article in that group.
+		for i,ng := range ngs {
+			if g,ok := s.groups[string(ng)]; ok && g.arts[pa.Numbers.Numbers[i]]!=nil { return true,false }
+		}
+	}
+	for i,ng := range ngs {
+		g,ok := s.groups[string(ng)]
+		if !ok { continue }
+		dup := false
+		for _,og := range a.groups { dup = dup || og==g }
+		if dup { continue }
+		num := g.high+1
+		if pa.Numbers!=nil { num = pa.Numbers.Numbers[i] }
+		g.insert(num,a)
+		a.groups = append(a.groups,g)
+		a.nums = append(a.nums,num)
+	}
+	if len(a.groups)==0 { return true,false }
+	s.byId[string(a.id)] = a
+	return false,false
+}
+
+// Replaces TAB, CR and LF, which are not allowed in overview fields.
+func ovClean(b []byte) []byte {
+	for i,c := range b {
+		switch c {
+		case '\t','\r','\n': b[i] = ' '
+		}
+	}
+	return b
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.PostingCaps
+
+func (s *Store) PerformPost(id []byte, r *fastnntp.DotReader) (rejected bool,failed bool) {
+	return s.Posting.PerformPost(id,r)
+}
+func (s *Store) PerformPostSession(id []byte, r *fastnntp.DotReader, sess *fastnntp.Session) (rejected bool,failed bool,reason string) {
+	return s.Posting.PerformPostSession(id,r,sess)
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.GroupCaps
+
+func (s *Store) GetGroup(g *fastnntp.Group) bool {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	grp,ok := s.groups[string(g.Group)]
+	if !ok { return false }
+	g.Number = int64(len(grp.nums))
+	g.Low = grp.low()
+	g.High = grp.high
+	return true
+}
+func (s *Store) ListGroup(g *fastnntp.Group, w *fastnntp.DotWriter, first, last int64) {
+	s.lock.RLock()
+	grp,ok := s.groups[string(g.Group)]
+	var nums []int64
+	if ok {
+		if last<first { last = grp.high }
+		i := grp.search(first)
+		for _,n := range grp.nums[i:] {
+			if n>last { break }
+			nums = append(nums,n)
+		}
+	}
+	s.lock.RUnlock()
+	buf := make([]byte,0,32)
+	for _,n := range nums {
+		w.Write(append(fastnntp.AppendUint(buf[:0],n),'\r','\n'))
+	}
+}
+func (s *Store) CursorMoveGroup(g *fastnntp.Group, i int64, backward bool, id_buf []byte) (ni int64, id []byte, ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	grp,ok := s.groups[string(g.Group)]
+	if !ok { return }
+	j := grp.search(i)
+	if backward {
+		j--
+	} else if j<len(grp.nums) && grp.nums[j]==i {
+		j++
+	}
+	if j<0 || j>=len(grp.nums) { return 0,nil,false }
+	ni = grp.nums[j]
+	return ni,append(id_buf,grp.arts[ni].id...),true
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.ArticleCaps
+
+func (s *Store) lookup(a *fastnntp.Article) *article {
+	if a.HasNum {
+		grp,ok := s.groups[string(a.Group)]
+		if !ok { return nil }
+		return grp.arts[a.Number]
+	}
+	return s.byId[string(a.MessageId)]
+}
+
+func (s *Store) StatArticle(a *fastnntp.Article) bool {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	art := s.lookup(a)
+	if art==nil { return false }
+	if !a.HasId { a.MessageId = append(a.MessageId[:0],art.id...) }
+	return true
+}
+func (s *Store) GetArticle(a *fastnntp.Article, head, body bool) func(w *fastnntp.DotWriter) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	art := s.lookup(a)
+	if art==nil { return nil }
+	if !a.HasId { a.MessageId = append(a.MessageId[:0],art.id...) }
+	return func(w *fastnntp.DotWriter) {
+		if head { w.Write(art.head) }
+		if head && body { w.Write(crlf) }
+		if body { w.Write(art.body) }
+	}
+}
+var crlf = []byte("\r\n")
+
+func (s *Store) WriteOverview(ar *fastnntp.ArticleRange) func(w fastnntp.IOverview) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	var arts []*article
+	var nums []int64
+	if ar.HasNum {
+		grp,ok := s.groups[string(ar.Group)]
+		if !ok { return nil }
+		i := grp.search(ar.Number)
+		for _,n := range grp.nums[i:] {
+			if n>ar.LastNumber { break }
+			arts = append(arts,grp.arts[n])
+			nums = append(nums,n)
+		}
+	} else if art := s.byId[string(ar.MessageId)]; art!=nil {
+		arts = append(arts,art)
+		nums = append(nums,0)
+	}
+	if len(arts)==0 { return nil }
+	return func(w fastnntp.IOverview) {
+		for i,a := range arts {
+			w.WriteEntry(nums[i],a.subject,a.from,a.date,a.id,a.refs,a.bytes,a.lines)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.GroupListingCaps
+
+func (s *Store) ListGroups(wm *fastnntp.WildMat, ila fastnntp.IListActive) bool {
+	s.lock.RLock()
+	grps := make([]*group,0,len(s.groups))
+	for _,g := range s.groups { grps = append(grps,g) }
+	sort.Slice(grps,func(i,j int) bool { return string(grps[i].name)<string(grps[j].name) })
+	// AddGroup replaces the description, but never modifies it in place.
+	type entry struct{
+		high,low int64
+		status   byte
+		desc     []byte
+	}
+	ents := make([]entry,len(grps))
+	for i,g := range grps { ents[i] = entry{g.high,g.low(),g.status,g.desc} }
+	s.lock.RUnlock()
+	for i,g := range grps {
+		if ila.WriteFullInfo(g.name,ents[i].high,ents[i].low,ents[i].status,ents[i].desc)!=nil { break }
+	}
+	return true
+}
+
@@ -0,0 +1,157 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package memstore
+
+import "github.com/byte-mug/fastnntp"
+import "github.com/byte-mug/fastnntp/posting"
+import "fmt"
+import "sync"
+import "testing"
+
+func testArticle(id, groups string) *posting.Article {
+	h := posting.ParseHeader([]byte("Newsgroups: "+groups+"\r\nMessage-ID: "+id+"\r\nSubject: test\r\n"))
+	return &posting.Article{Header:h,Body:[]byte("body\r\n")}
+}
+
+func store(t *testing.T, s *Store, id, groups string) {
+	if rej,fail := s.StoreArticle(testArticle(id,groups)); rej || fail {
+		t.Fatalf("storing %s: rejected=%v failed=%v",id,rej,fail)
+	}
+}
+
+func has(s *Store, id string) bool {
+	return s.StatArticle(&fastnntp.Article{MessageId:[]byte(id),HasId:true})
+}
+
+// Returns the Message-ID of an article number, or "".
+func byNum(s *Store, group string, num int64) string {
+	a := &fastnntp.Article{Group:[]byte(group),Number:num,HasNum:true}
+	if !s.StatArticle(a) { return "" }
+	return string(a.MessageId)
+}
+
+func stat(s *Store, group string) (count, low, high int64) {
+	g := &fastnntp.Group{Group:[]byte(group)}
+	if !s.GetGroup(g) { return -1,-1,-1 }
+	return g.Number,g.Low,g.High
+}
+
+type listActive []string
+
+func (l *listActive) GetListActiveMode() fastnntp.ListActiveMode { return fastnntp.LAM_Full }
+func (l *listActive) WriteActive(group []byte, high, low int64, status byte) error { return nil }
+func (l *listActive) WriteNewsgroups(group []byte, description []byte) error { return nil }
+func (l *listActive) WriteFullInfo(group []byte, high, low int64, status byte, description []byte) error {
+	*l = append(*l,fmt.Sprintf("%s %d %d %c %s",group,high,low,status,description))
+	return nil
+}
+
+func TestStoreLookup(t *testing.T) {
+	s := New("news.example")
+	s.AddGroup("misc.test",'y',"Testing")
+	s.AddGroup("misc.other",'m',"Other")
+	store(t,s,"<1@x>","misc.test")
+	store(t,s,"<2@x>","misc.test,misc.other,misc.unknown")
+	if rej,_ := s.StoreArticle(testArticle("<2@x>","misc.test")); !rej { t.Error("duplicate accepted") }
+	if rej,_ := s.StoreArticle(testArticle("<3@x>","misc.unknown")); !rej { t.Error("article without a known group accepted") }
+	
+	if !has(s,"<1@x>") || !has(s,"<2@x>") || has(s,"<3@x>") { t.Error("wrong articles present") }
+	if byNum(s,"misc.test",1)!="<1@x>" || byNum(s,"misc.test",2)!="<2@x>" || byNum(s,"misc.other",1)!="<2@x>" {
+		t.Error("articles stored under wrong numbers")
+	}
+	if c,l,h := stat(s,"misc.test"); c!=2 || l!=1 || h!=2 { t.Errorf("misc.test: %d %d %d",c,l,h) }
+	if st,ok := s.GroupStatus([]byte("misc.other")); !ok || st!='m' { t.Errorf("status %c %v",st,ok) }
+	if h := s.ArticleHeader([]byte("<2@x>")); h==nil || string(h.Get("Subject"))!="test" { t.Error("ArticleHeader") }
+	
+	var l listActive
+	s.ListGroups(nil,&l)
+	if len(l)!=2 || l[0]!="misc.other 1 1 m Other" || l[1]!="misc.test 2 1 y Testing" { t.Errorf("ListGroups: %q",l) }
+	
+	// Pipeline-assigned numbers are used, unless taken.
+	a := testArticle("<4@x>","misc.test")
+	a.Numbers = &posting.Numbering{Groups:[]string{"misc.test"},Numbers:[]int64{10}}
+	if rej,_ := s.StoreArticle(a); rej || byNum(s,"misc.test",10)!="<4@x>" { t.Error("assigned number not used") }
+	a = testArticle("<5@x>","misc.test")
+	a.Numbers = &posting.Numbering{Groups:[]string{"misc.test"},Numbers:[]int64{10}}
+	if rej,_ := s.StoreArticle(a); !rej || has(s,"<5@x>") { t.Error("taken number reused") }
+}
+
+func TestRemove(t *testing.T) {
+	s := New("news.example")
+	s.AddGroup("misc.test",'y',"")
+	s.AddGroup("misc.other",'y',"")
+	for i := 1; i<=4; i++ { store(t,s,fmt.Sprintf("<%d@x>",i),"misc.test,misc.other") }
+	store(t,s,"<5@x>","misc.test")
+	
+	if err := s.Delete([]byte("<1@x>")); err!=nil { t.Fatal(err) }
+	if err := s.Delete([]byte("<9@x>")); err!=nil { t.Errorf("deleting an unknown article: %v",err) }
+	if has(s,"<1@x>") || byNum(s,"misc.other",1)!="" { t.Error("deleted article present") }
+	if c,l,h := stat(s,"misc.other"); c!=3 || l!=2 || h!=4 { t.Errorf("misc.other after Delete: %d %d %d",c,l,h) }
+	
+	// Expiry removes the article from one group only.
+	if err := s.ExpireArticle("misc.test",2); err!=nil { t.Fatal(err) }
+	if byNum(s,"misc.test",2)!="" || byNum(s,"misc.other",2)!="<2@x>" || !has(s,"<2@x>") { t.Error("ExpireArticle") }
+	s.ExpireArticle("misc.other",2)
+	if has(s,"<2@x>") { t.Error("article expired from all groups is present") }
+	
+	// Removing a group deletes the articles, that are in no other group.
+	if err := s.RemoveGroup("misc.test"); err!=nil { t.Fatal(err) }
+	if err := s.RemoveGroup("misc.test"); err!=nil { t.Errorf("removing an unknown group: %v",err) }
+	if has(s,"<5@x>") { t.Error("article of the removed group present") }
+	if !has(s,"<3@x>") || byNum(s,"misc.other",3)!="<3@x>" { t.Error("crosspost lost with the removed group") }
+	if c,_,_ := stat(s,"misc.test"); c!=-1 { t.Error("removed group present") }
+	var names []string
+	s.EachGroup(func(name string, status byte) { names = append(names,name) })
+	if len(names)!=1 || names[0]!="misc.other" { t.Errorf("EachGroup: %q",names) }
+}
+
+// Run with -race: listing must not race with changes to the groups.
+func TestConcurrentListing(t *testing.T) {
+	s := New("news.example")
+	s.AddGroup("misc.test",'y',"")
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i<200; i++ {
+			s.AddGroup("misc.test","ynm"[i%3],fmt.Sprint("description ",i))
+			store(t,s,fmt.Sprintf("<%d@x>",i),"misc.test")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i<1000; i++ {
+			var l listActive
+			s.ListGroups(nil,&l)
+		}
+	}()
+	close(start)
+	wg.Wait()
+	if c,_,h := stat(s,"misc.test"); c!=200 || h!=200 { t.Errorf("misc.test: %d articles, high %d",c,h) }
+}
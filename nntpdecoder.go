@@ -30,6 +30,7 @@ import "io"
 import "io/ioutil"
 import "sync"
 import "math"
+import "net"
 
 const crlf = "\r\n"
 
@@ -85,14 +86,19 @@ func (h *Handler) ServeConn(conn io.ReadWriteCloser) error {
 	rdr := AcquireReader().Init(conn)
 	defer rdr.Release()
 	nh.r = rdr
-	nh.w = conn
+	nh.conn = conn
 	nh.h = h
+	if ra,ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		nh.session.RemoteAddr = ra.RemoteAddr()
+	}
+	nh.throttle()
 	return nh.servceConn()
 }
 
 type nntpHandler struct {
 	r *Reader
 	w io.Writer
+	conn io.Writer // The connection; w may be a throttled writer on top of it.
 	h *Handler
 	end bool
 	group *Group
@@ -106,21 +112,57 @@ type nntpHandler struct {
 	tmpIdBuffer []byte // Secondary ID buffer, to prevent destructive overwrites of idBuffer.
 	userNameBuf []byte
 	userName    []byte
+	session     Session
+	counter     countingWriter
 }
 
 func (h *nntpHandler) release() {
 	if h==nil { return }
 	h.r = nil
 	h.w = nil
+	h.conn = nil
 	h.h = nil
 	if h.group!=nil { pool_Group_put(h.group) }
 	h.group = nil
 	h.userName = nil
+	h.session = Session{}
 	h.groupCursor = 0
 	h.groupCurId = nil
 	pool_nntpHandler.Put(h)
 }
 
+// Sets up the session writer, throttled if the LoginCaps implement ThrottleCaps.
+func (h *nntpHandler) throttle() {
+	h.w = h.conn
+	if tc,ok := h.h.LoginCaps.(ThrottleCaps); ok { h.w = tc.ThrottleWriter(h.conn,&h.session) }
+}
+
+// Counts the bytes written to the underlying writer.
+type countingWriter struct{
+	w io.Writer
+	n int64
+}
+func (c *countingWriter) Write(b []byte) (int,error) {
+	n,e := c.w.Write(b)
+	c.n += int64(n)
+	return n,e
+}
+
+/*
+Returns the writer for a download response. If dac is not nil, the bytes
+written to it are counted, and reported to dac by downloadDone.
+*/
+func (h *nntpHandler) downloadWriter(dac DownloadAccountingCaps) io.Writer {
+	if dac==nil { return h.w }
+	h.counter = countingWriter{w:h.w}
+	return &h.counter
+}
+func (h *nntpHandler) downloadDone(dac DownloadAccountingCaps) {
+	if dac==nil { return }
+	dac.AccountDownload(&h.session,h.counter.n)
+	h.counter = countingWriter{}
+}
+
 type handleFunc func(h *nntpHandler,args [][]byte) error
 var nntpCommands = map[string]handleFunc{
 	// RFC-3977    5.   Session Administration Commands
@@ -203,6 +245,11 @@ func (h *nntpHandler) writeError(ne *NNTPError) error {
 	_,e := h.w.Write(out)
 	return e
 }
+// Like writeError, but replaces the text with reason, if not empty.
+func (h *nntpHandler) writeErrorReason(ne *NNTPError, reason string) error {
+	if reason=="" { return h.writeError(ne) }
+	return h.writeMessage(int64(ne.Code),reason)
+}
 func (h *nntpHandler) writeMessage(code int64, msg string) error {
 	out := h.outBuffer
 	out = AppendUint(out,code)
@@ -576,6 +623,8 @@ func handleStat(h *nntpHandler,args [][]byte) error {
      420                   Current article number is invalid
 */
 func handleArticleInternal(h *nntpHandler,args [][]byte,code int64,head, body bool) error {
+	dac,_ := h.h.ArticleCaps.(DownloadAccountingCaps)
+	
 	out := h.outBuffer
 	out = AppendUint(out,code)
 	out = append(out,' ')
@@ -619,6 +668,11 @@ func handleArticleInternal(h *nntpHandler,args [][]byte,code int64,head, body bo
 		article.MessageId = args[0]
 	}
 	
+	// The arguments are checked first, so that 412 and 420 take precedence.
+	if dac!=nil {
+		if ok,reason := dac.AllowDownload(&h.session); !ok { return h.writeErrorReason(ErrDownloadQuota,reason) }
+	}
+	
 	setid := !article.HasId
 	w := h.h.GetArticle(article,head,body)
 	if w==nil {
@@ -642,7 +696,8 @@ func handleArticleInternal(h *nntpHandler,args [][]byte,code int64,head, body bo
 	out = append(out,article.MessageId...)
 	out = append(out,crlf...)
 	
-	bw := AcquireBufferedWriter(h.w)
+	defer h.downloadDone(dac)
+	bw := AcquireBufferedWriter(h.downloadWriter(dac))
 	defer func(){
 		bw.Flush()
 		ReleaseBufferedWriter(bw)
@@ -751,6 +806,31 @@ func handleArticle(h *nntpHandler,args [][]byte) error {
 
 // RFC-3977    6.3.   Article Posting
 
+// Hands the article over to the PostingCaps, passing the session if supported.
+func (h *nntpHandler) performPost(id []byte, r *DotReader) (rejected bool,failed bool,reason string) {
+	if spc,ok := h.h.PostingCaps.(SessionPostingCaps); ok {
+		return spc.PerformPostSession(id,r,&h.session)
+	}
+	rejected,failed = h.h.PerformPost(id,r)
+	return
+}
+
+// Asks the PostingCaps, whether an article is wanted, passing the session if supported.
+func (h *nntpHandler) checkPostId(id []byte) (wanted bool, possible bool) {
+	if scc,ok := h.h.PostingCaps.(SessionCheckCaps); ok {
+		return scc.CheckPostIdSession(id,&h.session)
+	}
+	return h.h.CheckPostId(id)
+}
+
+// Asks the PostingCaps, whether posting is possible, passing the session if supported.
+func (h *nntpHandler) checkPost() (possible bool, reason string) {
+	if scc,ok := h.h.PostingCaps.(SessionCheckPostCaps); ok {
+		return scc.CheckPostSession(&h.session)
+	}
+	return h.h.CheckPost(),""
+}
+
 /*
 
    Indicating capability: POST
@@ -775,13 +855,13 @@ func handlePost(h *nntpHandler,args [][]byte) error {
 	// Check Permissions
 	if !h.h.AuthinfoCheckPrivilege(LoginPriv_Post,h.h) { return h.issueCommandNotPermitted() }
 	
-	if !h.h.CheckPost() { return h.writeError(ErrPostingNotPermitted) }
+	if ok,reason := h.checkPost(); !ok { return h.writeErrorReason(ErrPostingNotPermitted,reason) }
 	if e := h.writeMessage(340, "Send article to be posted"); e!=nil { return e }
 	dotr := h.r.DotReader()
-	r,f := h.h.PerformPost(nil, dotr)
+	r,f,reason := h.performPost(nil, dotr)
 	io.Copy(ioutil.Discard,dotr) // Eat up excess data.
 	
-	if r||f { return h.writeError(ErrPostingFailed) }
+	if r||f { return h.writeErrorReason(ErrPostingFailed,reason) }
 	return h.writeMessage(240, "Article received OK")
 }
 
@@ -815,16 +895,16 @@ func handleIHave(h *nntpHandler,args [][]byte) error {
 	
 	if len(args)==0 { return h.writeError(ErrSyntax) }
 	id := args[0]
-	wanted,possible := h.h.CheckPostId(id)
+	wanted,possible := h.checkPostId(id)
 	if !wanted { return h.writeError(ErrNotWanted) }
 	if !possible { return h.writeError(ErrIHaveNotPossible) }
 	if e := h.writeMessage(335, "Send article to be transferred"); e!=nil { return e }
 	dotr := h.r.DotReader()
-	rejected,failed := h.h.PerformPost(id, dotr)
+	rejected,failed,reason := h.performPost(id, dotr)
 	io.Copy(ioutil.Discard,dotr) // Eat up excess data.
 	
-	if rejected { return h.writeError(ErrIHaveRejected) }
-	if failed { return h.writeError(ErrIHaveFailed) }
+	if rejected { return h.writeErrorReason(ErrIHaveRejected,reason) }
+	if failed { return h.writeErrorReason(ErrIHaveFailed,reason) }
 	return h.writeMessage(235, "Article transferred OK")
 }
 
@@ -853,7 +933,7 @@ func handleCheck(h *nntpHandler,args [][]byte) error {
 	if len(args)==0 { return h.writeError(ErrSyntax) }
 	id := args[0]
 	code := int64(238)
-	wanted,possible := h.h.CheckPostId(id)
+	wanted,possible := h.checkPostId(id)
 	if !possible { code = 431 }
 	if !wanted { code = 438 }
 	out := h.outBuffer
@@ -888,12 +968,12 @@ func handleTakethis(h *nntpHandler,args [][]byte) error {
 	id := args[0]
 	
 	dotr := h.r.DotReader()
-	if h.h.AuthinfoCheckPrivilege(LoginPriv_Post,h.h) {
+	if !h.h.AuthinfoCheckPrivilege(LoginPriv_Post,h.h) {
 		io.Copy(ioutil.Discard,dotr) // Eat!
 		return h.issueCommandNotPermitted() // SHOUT!
 	}
 	
-	r,f := h.h.PerformPost(id, dotr)
+	r,f,_ := h.performPost(id, dotr)
 	io.Copy(ioutil.Discard,dotr) // Eat up excess data.
 	
 	code := int64(239)
@@ -942,6 +1022,8 @@ func handleTakethis(h *nntpHandler,args [][]byte) error {
      message-id    Message-id of article
 */
 func handleHeaders(h *nntpHandler,args [][]byte, okResponse string, mode int ) error {
+	dac,_ := h.h.ArticleCaps.(DownloadAccountingCaps)
+	
 	use_nothing := len(args)==0
 	use_num := false
 	if !use_nothing { use_num = isDigit(args[0][0]) }
@@ -980,6 +1062,11 @@ func handleHeaders(h *nntpHandler,args [][]byte, okResponse string, mode int ) e
 		article.Number = 0
 		article.MessageId = args[0]
 	}
+	
+	// The arguments are checked first, so that 412 and 420 take precedence.
+	if dac!=nil {
+		if ok,reason := dac.AllowDownload(&h.session); !ok { return h.writeErrorReason(ErrDownloadQuota,reason) }
+	}
 	w := h.h.WriteOverview(article)
 	if w==nil {
 		if use_nothing {
@@ -992,7 +1079,8 @@ func handleHeaders(h *nntpHandler,args [][]byte, okResponse string, mode int ) e
 		panic("unreachable")
 	}
 	
-	bw := AcquireBufferedWriter(h.w)
+	defer h.downloadDone(dac)
+	bw := AcquireBufferedWriter(h.downloadWriter(dac))
 	defer func(){
 		bw.Flush()
 		ReleaseBufferedWriter(bw)
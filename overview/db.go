@@ -0,0 +1,383 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+A persistent overview database.
+
+Each group has a data file ("<group>.DAT"), to which overview lines are appended,
+and an index file ("<group>.IDX") with a fixed-size entry per article number,
+pointing into the data file. Range scans read the index entries of the range and
+the corresponding lines. The files of a group are opened, when it is first used,
+and only a limited number of groups is kept open. Message-IDs are looked up
+through an on-disk hash table ("ids").
+
+Expired entries are only marked in the index; Compact rewrites the files of a group
+without them. The data files are self-describing: if an index file does not match
+its data file (after a crash), it is rebuilt from it.
+*/
+package overview
+
+import "github.com/byte-mug/fastnntp"
+import "github.com/byte-mug/fastnntp/posting"
+import "bytes"
+import "errors"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+var ErrBadGroupName = errors.New("overview: invalid group name")
+
+// An overview entry.
+type Entry struct{
+	Number int64
+	Subject, From, Date, MessageId, References []byte
+	Bytes, Lines int64
+	
+	// Arrival time of the article (Unix time).
+	Arrived int64
+	
+	// Expiry time requested by the Expires field (Unix time), or 0.
+	Expires int64
+}
+
+func clean(b []byte) []byte {
+	for i,c := range b {
+		switch c {
+		case '\t','\r','\n': b[i] = ' '
+		}
+	}
+	return b
+}
+
+/*
+Creates an Entry from the header of an article. The size of the article and the
+number of lines of its body must be provided by the caller.
+*/
+func EntryFromHeader(h *posting.Header, bytes, lines int64) *Entry {
+	e := &Entry{
+		Subject:    clean(h.Get("Subject")),
+		From:       clean(h.Get("From")),
+		Date:       clean(h.Get("Date")),
+		MessageId:  clean(h.Get("Message-ID")),
+		References: clean(h.Get("References")),
+		Bytes:      bytes,
+		Lines:      lines,
+		Arrived:    time.Now().Unix(),
+	}
+	if exp := h.Get("Expires"); len(exp)>0 {
+		if t,err := parseDate(exp); err==nil { e.Expires = t.Unix() }
+	}
+	return e
+}
+
+/*
+The overview database. Use Open to open one.
+*/
+type DB struct{
+	// The maximum number of groups, whose files are kept open. Defaults to 256.
+	MaxOpen int
+	
+	dir    string
+	lock   sync.RWMutex
+	groups map[string]*groupFile
+	names  map[uint64]string // by hash
+	ids    *idIndex
+	clock  uint64
+}
+
+const defaultMaxOpen = 256
+
+// Opens the database in the given directory, creating it if necessary.
+func Open(dir string) (*DB,error) {
+	if err := os.MkdirAll(dir,0755); err!=nil { return nil,err }
+	db := &DB{dir:dir,groups:make(map[string]*groupFile),names:make(map[uint64]string)}
+	dats,err := filepath.Glob(filepath.Join(dir,"*.DAT"))
+	if err!=nil { return nil,err }
+	for _,fn := range dats {
+		db.register(newGroup(dir,strings.TrimSuffix(filepath.Base(fn),".DAT")))
+	}
+	ids,fresh,err := openIds(filepath.Join(dir,"ids"))
+	if err!=nil { return nil,err }
+	db.ids = ids
+	if fresh {
+		if err = db.fillIds(); err!=nil { db.Close(); return nil,err }
+	}
+	return db,nil
+}
+
+// Fills a fresh Message-ID index from the data files.
+func (db *DB) fillIds() error {
+	for name := range db.groups {
+		g,err := db.group(name,false)
+		if err!=nil { return err }
+		err = g.scan(g.low,g.high,func(e *Entry) error {
+			return db.ids.put(hash64(e.MessageId),g.hash,e.Number)
+		})
+		if err!=nil { return err }
+	}
+	return db.ids.commit(filepath.Join(db.dir,"ids"))
+}
+
+// Closes all files.
+func (db *DB) Close() (err error) {
+	db.lock.Lock(); defer db.lock.Unlock()
+	for _,g := range db.groups {
+		if e := g.close(); err==nil { err = e }
+	}
+	if db.ids!=nil {
+		if e := db.ids.close(); err==nil { err = e }
+	}
+	return
+}
+
+func validGroupName(name string) bool {
+	return name!="" && name[0]!='.' && !strings.ContainsAny(name,"/\\ \t\r\n\x00")
+}
+
+func (db *DB) register(g *groupFile) {
+	db.groups[g.name] = g
+	db.names[g.hash] = g.name
+}
+
+func (db *DB) touch(g *groupFile) {
+	atomic.StoreUint64(&g.used,atomic.AddUint64(&db.clock,1))
+}
+
+// Closes the least recently used group, if MaxOpen groups are open. The write lock must be held.
+func (db *DB) evict() {
+	max := db.MaxOpen
+	if max<=0 { max = defaultMaxOpen }
+	open := 0
+	var lru *groupFile
+	for _,g := range db.groups {
+		if g.dat==nil { continue }
+		open++
+		if lru==nil || atomic.LoadUint64(&g.used)<atomic.LoadUint64(&lru.used) { lru = g }
+	}
+	if open>=max { lru.close() }
+}
+
+/*
+Returns the files of a group, opening them, if necessary. Returns nil, if the
+group does not exist, and create is not set. The write lock must be held.
+*/
+func (db *DB) group(name string, create bool) (*groupFile,error) {
+	g,ok := db.groups[name]
+	if !ok {
+		if !create { return nil,nil }
+		if !validGroupName(name) { return nil,ErrBadGroupName }
+		g = newGroup(db.dir,name)
+	}
+	if g.dat==nil {
+		db.evict()
+		if err := g.load(); err!=nil { return nil,err }
+	}
+	if !ok { db.register(g) }
+	db.touch(g)
+	return g,nil
+}
+
+/*
+Calls fn with the files of an existing group. Only the read lock is held, unless
+the files have to be opened.
+*/
+func (db *DB) withGroup(name string, fn func(g *groupFile) error) error {
+	db.lock.RLock()
+	g,ok := db.groups[name]
+	if !ok { db.lock.RUnlock(); return nil }
+	if g.dat!=nil {
+		defer db.lock.RUnlock()
+		db.touch(g)
+		return fn(g)
+	}
+	db.lock.RUnlock()
+	db.lock.Lock(); defer db.lock.Unlock()
+	g,err := db.group(name,false)
+	if g==nil { return err }
+	return fn(g)
+}
+
+// Adds an entry for the article e.Number in the group.
+func (db *DB) Add(group string, e *Entry) error {
+	db.lock.Lock(); defer db.lock.Unlock()
+	g,err := db.group(group,true)
+	if err!=nil { return err }
+	if err = db.ids.put(hash64(e.MessageId),g.hash,e.Number); err!=nil { return err }
+	return g.add(e)
+}
+
+/*
+Adds the entries of a (crossposted) article, given its groups and the numbers
+it got in them.
+*/
+func (db *DB) AddArticle(e *Entry, groups []string, nums []int64) error {
+	for i,g := range groups {
+		c := *e
+		c.Number = nums[i]
+		if err := db.Add(g,&c); err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+Calls fn for every entry in the range first-last of the group, in order.
+The Entry passed to fn is only valid during the call.
+*/
+func (db *DB) Scan(group string, first, last int64, fn func(e *Entry) error) error {
+	return db.withGroup(group,func(g *groupFile) error {
+		return g.scan(first,last,fn)
+	})
+}
+
+// Returns the entry of an article, or nil.
+func (db *DB) Get(group string, num int64) *Entry {
+	var r *Entry
+	db.Scan(group,num,num,func(e *Entry) error {
+		c := *e
+		r = &c
+		return nil
+	})
+	return r
+}
+
+/*
+Returns a group and number of an article, given its Message-ID. A crossposted
+article is found in any of its groups, that still hold it.
+*/
+func (db *DB) Lookup(id []byte) (group string, num int64, ok bool) {
+	db.lock.RLock()
+	locs,err := db.ids.find(hash64(id))
+	names := make([]string,len(locs))
+	for i,l := range locs { names[i] = db.names[l.group] }
+	db.lock.RUnlock()
+	if err!=nil { return "",0,false }
+	
+	// The index holds hashes only.
+	for i,l := range locs {
+		if names[i]=="" { continue }
+		e := db.Get(names[i],l.num)
+		if e!=nil && bytes.Equal(e.MessageId,id) { return names[i],l.num,true }
+	}
+	return "",0,false
+}
+
+// Returns the number of entries and the low and high water marks of a group.
+func (db *DB) Stat(group string) (count, low, high int64, ok bool) {
+	db.withGroup(group,func(g *groupFile) error {
+		count,low,high,ok = g.count,g.low,g.high,true
+		return nil
+	})
+	return
+}
+
+// Returns the names of all groups.
+func (db *DB) Groups() (names []string) {
+	db.lock.RLock(); defer db.lock.RUnlock()
+	for n := range db.groups { names = append(names,n) }
+	return
+}
+
+// Removes the entry of an article from a group.
+func (db *DB) Delete(group string, num int64) error {
+	db.lock.Lock(); defer db.lock.Unlock()
+	g,err := db.group(group,false)
+	if g==nil { return err }
+	return g.del(num,db.ids)
+}
+
+/*
+Removes all entries of a group, for which fn returns true. Returns the number of
+removed entries. The space is only reclaimed by Compact.
+*/
+func (db *DB) Expire(group string, fn func(e *Entry) bool) (n int,err error) {
+	db.lock.Lock(); defer db.lock.Unlock()
+	g,err := db.group(group,false)
+	if g==nil { return 0,err }
+	var dead []int64
+	err = g.scan(g.low,g.high,func(e *Entry) error {
+		if fn(e) { dead = append(dead,e.Number) }
+		return nil
+	})
+	for _,num := range dead {
+		if err!=nil { break }
+		err = g.del(num,db.ids)
+		n++
+	}
+	return
+}
+
+// Rewrites the files of a group, reclaiming the space of removed entries.
+func (db *DB) Compact(group string) error {
+	db.lock.Lock(); defer db.lock.Unlock()
+	g,err := db.group(group,false)
+	if g==nil { return err }
+	return g.compact()
+}
+
+/*
+Serves the OVER and HDR commands from the database. It can be used as the
+WriteOverview method of any ArticleCaps implementation.
+*/
+func (db *DB) WriteOverview(ar *fastnntp.ArticleRange) func(w fastnntp.IOverview) {
+	var ents []Entry
+	collect := func(e *Entry) error {
+		c := *e
+		c.Subject = append([]byte(nil),e.Subject...)
+		c.From = append([]byte(nil),e.From...)
+		c.Date = append([]byte(nil),e.Date...)
+		c.MessageId = append([]byte(nil),e.MessageId...)
+		c.References = append([]byte(nil),e.References...)
+		ents = append(ents,c)
+		return nil
+	}
+	if ar.HasNum {
+		db.Scan(string(ar.Group),ar.Number,ar.LastNumber,collect)
+	} else if g,n,ok := db.Lookup(ar.MessageId); ok {
+		db.Scan(g,n,n,collect)
+		if len(ents)>0 { ents[0].Number = 0 }
+	}
+	if len(ents)==0 { return nil }
+	return func(w fastnntp.IOverview) {
+		for i := range ents {
+			e := &ents[i]
+			if w.WriteEntry(e.Number,e.Subject,e.From,e.Date,e.MessageId,e.References,e.Bytes,e.Lines)!=nil { return }
+		}
+	}
+}
+
+/*
+Wraps an ArticleCaps implementation, serving WriteOverview from the database.
+*/
+type ArticleCaps struct{
+	fastnntp.ArticleCaps
+	DB *DB
+}
+func (a *ArticleCaps) WriteOverview(ar *fastnntp.ArticleRange) func(w fastnntp.IOverview) {
+	return a.DB.WriteOverview(ar)
+}
+
@@ -0,0 +1,266 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package overview
+
+import "github.com/byte-mug/fastnntp/posting"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func tempDB(t *testing.T) (*DB,string) {
+	dir,err := ioutil.TempDir("","overview")
+	if err!=nil { t.Fatal(err) }
+	db,err := Open(dir)
+	if err!=nil { os.RemoveAll(dir); t.Fatal(err) }
+	return db,dir
+}
+
+func reopen(t *testing.T, db *DB, dir string) *DB {
+	if db!=nil { db.Close() }
+	db,err := Open(dir)
+	if err!=nil { t.Fatal(err) }
+	return db
+}
+
+func testEntry(group string, num int64) *Entry {
+	return &Entry{
+		Number: num,
+		Subject: []byte(fmt.Sprintf("subject %d",num)),
+		From: []byte("a@b.example"),
+		Date: []byte("Mon, 1 Jun 2020 00:00:00 +0000"),
+		MessageId: []byte(fmt.Sprintf("<%s.%d@x>",group,num)),
+		Bytes: 100+num,
+		Lines: num,
+		Arrived: 1591000000+num,
+	}
+}
+
+func sameEntry(a, b *Entry) bool {
+	return a!=nil && b!=nil && a.Number==b.Number && string(a.Subject)==string(b.Subject) &&
+		string(a.From)==string(b.From) && string(a.Date)==string(b.Date) &&
+		string(a.MessageId)==string(b.MessageId) && string(a.References)==string(b.References) &&
+		a.Bytes==b.Bytes && a.Lines==b.Lines && a.Arrived==b.Arrived && a.Expires==b.Expires
+}
+
+func TestLineRoundTrip(t *testing.T) {
+	e := testEntry("g",42)
+	e.References,e.Expires = []byte("<a@b> <c@d>"),1600000000
+	var d Entry
+	if !parseLine(appendLine(nil,e),&d) || !sameEntry(e,&d) { t.Errorf("%+v parsed as %+v",e,d) }
+	for _,l := range []string{"","#\tx\n","1\t2\t3\n","x\ta\tb\tc\td\te\t1\t2\t3\t4\n"} {
+		if parseLine([]byte(l),&d) { t.Errorf("%q parsed",l) }
+	}
+	
+	h := posting.ParseHeader([]byte("Subject: a\tb\r\n\tc\r\nMessage-ID: <x@y>\r\nExpires: Tue, 2 Jun 2020 00:00:00 +0000\r\n"))
+	e = EntryFromHeader(h,10,2)
+	if string(e.Subject)!="a b c" || e.Expires!=1591056000 || e.Bytes!=10 || e.Lines!=2 { t.Errorf("from header: %+v",e) }
+}
+
+func TestDBRoundTrip(t *testing.T) {
+	db,dir := tempDB(t)
+	defer os.RemoveAll(dir)
+	want := make(map[string]map[int64]bool)
+	add := func(g string, num int64) {
+		if err := db.Add(g,testEntry(g,num)); err!=nil { t.Fatal(err) }
+		if want[g]==nil { want[g] = make(map[int64]bool) }
+		want[g][num] = true
+	}
+	// Out of order, so that the index is rebased.
+	for _,n := range []int64{10,11,12,5,20,1} { add("misc.test",n) }
+	for n := int64(1); n<=50; n++ { add("alt.test",n) }
+	for n := int64(1); n<=50; n+=7 { db.Delete("alt.test",n); delete(want["alt.test"],n) }
+	n,err := db.Expire("alt.test",func(e *Entry) bool { return e.Number%2==0 })
+	if err!=nil || n!=21 { t.Errorf("Expire: %d %v",n,err) }
+	for n := int64(2); n<=50; n+=2 { delete(want["alt.test"],n) }
+	
+	check := func(db *DB, what string) {
+		for g,nums := range want {
+			var low,high int64 = 1<<62,0
+			for num := int64(0); num<=60; num++ {
+				e := db.Get(g,num)
+				if !nums[num] {
+					if e!=nil { t.Errorf("%s: %s:%d present",what,g,num) }
+					continue
+				}
+				if !sameEntry(e,testEntry(g,num)) { t.Errorf("%s: %s:%d is %+v",what,g,num,e) }
+				if grp,n,ok := db.Lookup([]byte(fmt.Sprintf("<%s.%d@x>",g,num))); !ok || grp!=g || n!=num {
+					t.Errorf("%s: Lookup %s:%d gave %s:%d %v",what,g,num,grp,n,ok)
+				}
+				if num<low { low = num }
+				if num>high { high = num }
+			}
+			count,l,_,ok := db.Stat(g)
+			if !ok || count!=int64(len(nums)) || l!=low { t.Errorf("%s: Stat %s: %d %d, want %d %d",what,g,count,l,len(nums),low) }
+		}
+		if _,_,ok := db.Lookup([]byte("<alt.test.2@x>")); ok { t.Errorf("%s: expired entry found by Message-ID",what) }
+	}
+	check(db,"open")
+	db = reopen(t,db,dir)
+	check(db,"reopened")
+	for g := range want {
+		if err := db.Compact(g); err!=nil { t.Fatal(err) }
+	}
+	check(db,"compacted")
+	
+	// The high water mark survives compaction, even if the last entry is gone.
+	db.Delete("alt.test",49)
+	delete(want["alt.test"],49)
+	db.Compact("alt.test")
+	db = reopen(t,db,dir)
+	check(db,"reopened after compaction")
+	if _,_,high,_ := db.Stat("alt.test"); high!=50 { t.Errorf("high water mark %d, want 50",high) }
+	db.Close()
+}
+
+// A crossposted article is found by its Message-ID, until it is gone from all groups.
+func TestCrosspostExpiry(t *testing.T) {
+	db,dir := tempDB(t)
+	defer os.RemoveAll(dir)
+	e := testEntry("x",0)
+	groups,nums := []string{"a.test","b.test","c.test"},[]int64{1,5,9}
+	if err := db.AddArticle(e,groups,nums); err!=nil { t.Fatal(err) }
+	db.Add("a.test",testEntry("a.test",2))
+	lookup := func(what string, want ...string) {
+		g,n,ok := db.Lookup(e.MessageId)
+		if len(want)==0 {
+			if ok { t.Errorf("%s: found in %s:%d",what,g,n) }
+			return
+		}
+		for i,w := range want {
+			if ok && g==w && n==nums[i] { return }
+		}
+		t.Errorf("%s: Lookup gave %s:%d %v, want one of %v",what,g,n,ok,want)
+	}
+	lookup("added","a.test","b.test","c.test")
+	
+	expire := func(group string) {
+		if n,err := db.Expire(group,func(x *Entry) bool { return string(x.MessageId)==string(e.MessageId) }); n!=1 || err!=nil {
+			t.Fatalf("Expire %s: %d %v",group,n,err)
+		}
+	}
+	expire("a.test")
+	lookup("expired from a.test","","b.test","c.test")
+	db = reopen(t,db,dir)
+	lookup("reopened","","b.test","c.test")
+	
+	// The index is filled again from the data files.
+	db.Close()
+	os.Remove(filepath.Join(dir,"ids"))
+	db = reopen(t,nil,dir)
+	lookup("index rebuilt","","b.test","c.test")
+	
+	expire("c.test")
+	lookup("expired from c.test","","b.test")
+	expire("b.test")
+	lookup("expired everywhere")
+	if count,low,high,_ := db.Stat("b.test"); count!=0 || low!=6 || high!=5 { t.Errorf("b.test: %d %d %d, want 0 6 5",count,low,high) }
+	if count,low,_,_ := db.Stat("a.test"); count!=1 || low!=2 { t.Errorf("a.test: %d %d, want 1 2",count,low) }
+	db.Close()
+}
+
+func TestLazyOpen(t *testing.T) {
+	db,dir := tempDB(t)
+	defer os.RemoveAll(dir)
+	db.MaxOpen = 3
+	open := func() (n int) {
+		for _,g := range db.groups {
+			if g.dat!=nil { n++ }
+		}
+		return
+	}
+	for i := 0; i<10; i++ {
+		g := fmt.Sprintf("group.%d",i)
+		for n := int64(1); n<=5; n++ { db.Add(g,testEntry(g,n)) }
+		if open()>3 { t.Fatalf("%d groups open",open()) }
+	}
+	db = reopen(t,db,dir)
+	defer db.Close()
+	db.MaxOpen = 3
+	if open()!=0 { t.Errorf("%d groups opened by Open",open()) }
+	for i := 9; i>=0; i-- {
+		g := fmt.Sprintf("group.%d",i)
+		if _,_,ok := db.Lookup([]byte(fmt.Sprintf("<%s.3@x>",g))); !ok { t.Errorf("%s not found",g) }
+		if open()>3 { t.Fatalf("%d groups open",open()) }
+	}
+	if len(db.Groups())!=10 { t.Errorf("groups %v",db.Groups()) }
+}
+
+func TestCorruption(t *testing.T) {
+	db,dir := tempDB(t)
+	defer os.RemoveAll(dir)
+	for n := int64(1); n<=20; n++ { db.Add("misc.test",testEntry("misc.test",n)) }
+	db.Delete("misc.test",5)
+	db.Close()
+	check := func(what string, last int64) {
+		db := reopen(t,nil,dir)
+		defer db.Close()
+		for n := int64(1); n<=20; n++ {
+			e := db.Get("misc.test",n)
+			if n==5 || n>last {
+				if e!=nil { t.Errorf("%s: %d present",what,n) }
+			} else if !sameEntry(e,testEntry("misc.test",n)) {
+				t.Errorf("%s: %d is %+v",what,n,e)
+			} else if _,_,ok := db.Lookup(e.MessageId); !ok { t.Errorf("%s: %d not found by Message-ID",what,n) }
+		}
+	}
+	dat := filepath.Join(dir,"misc.test.DAT")
+	idx := filepath.Join(dir,"misc.test.IDX")
+	ids := filepath.Join(dir,"ids")
+	
+	// A missing or damaged index is rebuilt from the data file.
+	os.Remove(idx)
+	check("missing index",20)
+	data,_ := ioutil.ReadFile(idx)
+	ioutil.WriteFile(idx,data[:len(data)-10],0644)
+	check("truncated index",20)
+	data,_ = ioutil.ReadFile(idx)
+	data[idxHdrSize+3*entrySize+7] ^= 0x40 // offset of entry 4
+	ioutil.WriteFile(idx,data,0644)
+	check("bad offset",20)
+	
+	// A partially written last line is cut off.
+	f,_ := os.OpenFile(dat,os.O_WRONLY|os.O_APPEND,0644)
+	f.WriteString("21\tpartial")
+	f.Close()
+	check("partial line",20)
+	
+	// A missing or damaged Message-ID index is filled again.
+	os.Remove(ids)
+	check("missing ids",20)
+	data,_ = ioutil.ReadFile(ids)
+	data[0] = 'X'
+	ioutil.WriteFile(ids,data,0644)
+	check("damaged ids",20)
+	
+	// Stale entries in the Message-ID index are not returned.
+	db = reopen(t,nil,dir)
+	db.ids.put(hash64([]byte("<stale@x>")),hash64([]byte("misc.test")),3)
+	db.ids.put(hash64([]byte("<other@x>")),hash64([]byte("no.such.group")),3)
+	for _,id := range []string{"<stale@x>","<other@x>"} {
+		if _,_,ok := db.Lookup([]byte(id)); ok { t.Errorf("stale entry %s found",id) }
+	}
+	db.Close()
+}
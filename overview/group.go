@@ -0,0 +1,434 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package overview
+
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "io"
+import "net/mail"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "time"
+
+func parseDate(b []byte) (time.Time,error) { return mail.ParseDate(string(b)) }
+
+const(
+	idxMagic   = "FNOV"
+	idxHdrSize = 16
+	entrySize  = 32
+	
+	flagDeleted = 1
+)
+
+/*
+An index entry:
+
+	offset  int64   position of the line in the data file
+	length  uint32  length of the line
+	flags   uint32
+	arrived int64
+	expires int64
+
+An entry with length 0 is unused.
+*/
+type idxEntry struct{
+	off     int64
+	length  uint32
+	flags   uint32
+	arrived int64
+	expires int64
+}
+
+func (e *idxEntry) live() bool { return e.length>0 && e.flags&flagDeleted==0 }
+
+func (e *idxEntry) encode(b []byte) {
+	binary.BigEndian.PutUint64(b[0:],uint64(e.off))
+	binary.BigEndian.PutUint32(b[8:],e.length)
+	binary.BigEndian.PutUint32(b[12:],e.flags)
+	binary.BigEndian.PutUint64(b[16:],uint64(e.arrived))
+	binary.BigEndian.PutUint64(b[24:],uint64(e.expires))
+}
+func (e *idxEntry) decode(b []byte) {
+	e.off     = int64(binary.BigEndian.Uint64(b[0:]))
+	e.length  = binary.BigEndian.Uint32(b[8:])
+	e.flags   = binary.BigEndian.Uint32(b[12:])
+	e.arrived = int64(binary.BigEndian.Uint64(b[16:]))
+	e.expires = int64(binary.BigEndian.Uint64(b[24:]))
+}
+
+/*
+The files of a group. A line of the data file has the form
+
+	num TAB subject TAB from TAB date TAB message-id TAB references TAB bytes TAB lines TAB arrived TAB expires LF
+
+The lines of removed entries start with '#' instead of the number.
+*/
+type groupFile struct{
+	dir, name string
+	hash      uint64 // of the name
+	used      uint64 // when the files were last used
+	dat, idx  *os.File // nil, while the files are closed
+	datSize   int64
+	base      int64 // Article number of the first index entry.
+	n         int64 // Number of index entries.
+	
+	count, low, high int64
+}
+
+func newGroup(dir, name string) *groupFile {
+	return &groupFile{dir:dir,name:name,hash:hash64([]byte(name))}
+}
+
+// Opens the files, rebuilding the index, if it does not match the data file.
+func (g *groupFile) load() (err error) {
+	if err = g.open(); err!=nil { return }
+	if !g.verify() {
+		g.close()
+		if err = rebuild(g.dir,g.name); err!=nil { return }
+		err = g.open()
+	}
+	return
+}
+
+func (g *groupFile) path(ext string) string { return filepath.Join(g.dir,g.name+ext) }
+
+func (g *groupFile) open() (err error) {
+	g.dat,err = os.OpenFile(g.path(".DAT"),os.O_RDWR|os.O_CREATE,0644)
+	if err!=nil { return }
+	g.idx,err = os.OpenFile(g.path(".IDX"),os.O_RDWR|os.O_CREATE,0644)
+	if err!=nil { g.dat.Close(); g.dat = nil; return }
+	fi,err := g.dat.Stat()
+	if err!=nil { g.close(); return }
+	g.datSize = fi.Size()
+	fi,err = g.idx.Stat()
+	if err!=nil { g.close(); return }
+	var h [idxHdrSize]byte
+	if fi.Size()<idxHdrSize {
+		copy(h[:],idxMagic)
+		if _,err = g.idx.WriteAt(h[:],0); err!=nil { g.close(); return }
+		g.n = 0
+	} else {
+		if _,err = g.idx.ReadAt(h[:],0); err!=nil { g.close(); return }
+		g.base = int64(binary.BigEndian.Uint64(h[8:]))
+		g.n = (fi.Size()-idxHdrSize)/entrySize
+	}
+	return g.stats()
+}
+
+func (g *groupFile) close() error {
+	if g.dat==nil { return nil }
+	e1 := g.dat.Close()
+	e2 := g.idx.Close()
+	g.dat,g.idx = nil,nil
+	if e1!=nil { return e1 }
+	return e2
+}
+
+func (g *groupFile) entry(num int64) (e idxEntry,err error) {
+	var b [entrySize]byte
+	if num<g.base || num>=g.base+g.n { return }
+	if _,err = g.idx.ReadAt(b[:],idxHdrSize+(num-g.base)*entrySize); err!=nil { return }
+	e.decode(b[:])
+	return
+}
+func (g *groupFile) setEntry(num int64, e *idxEntry) error {
+	var b [entrySize]byte
+	e.encode(b[:])
+	_,err := g.idx.WriteAt(b[:],idxHdrSize+(num-g.base)*entrySize)
+	if num>=g.base+g.n { g.n = num-g.base+1 }
+	return err
+}
+
+// Iterates over the index entries of the range, in chunks.
+func (g *groupFile) entries(first, last int64, fn func(num int64, e *idxEntry) error) error {
+	if first<g.base { first = g.base }
+	if last>=g.base+g.n { last = g.base+g.n-1 }
+	buf := make([]byte,1024*entrySize)
+	var e idxEntry
+	for first<=last {
+		k := last-first+1
+		if k>1024 { k = 1024 }
+		b := buf[:k*entrySize]
+		if _,err := g.idx.ReadAt(b,idxHdrSize+(first-g.base)*entrySize); err!=nil { return err }
+		for i := int64(0); i<k; i++ {
+			e.decode(b[i*entrySize:])
+			if err := fn(first+i,&e); err!=nil { return err }
+		}
+		first += k
+	}
+	return nil
+}
+
+// Recalculates count, low and high. The index always extends up to high.
+func (g *groupFile) stats() error {
+	g.count,g.low,g.high = 0,0,g.base+g.n-1
+	if g.high<0 { g.high = 0 }
+	err := g.entries(g.base,g.base+g.n-1,func(num int64, e *idxEntry) error {
+		if !e.live() { return nil }
+		if g.count==0 { g.low = num }
+		g.count++
+		return nil
+	})
+	if g.count==0 { g.low = g.high+1 }
+	return err
+}
+
+// Checks, that the index matches the data file.
+func (g *groupFile) verify() bool {
+	var end int64
+	pfx := make([]byte,21)
+	err := g.entries(g.base,g.base+g.n-1,func(num int64, e *idxEntry) error {
+		if e.length==0 { return nil }
+		if e.off+int64(e.length)>end { end = e.off+int64(e.length) }
+		if !e.live() { return nil }
+		p := strconv.AppendInt(pfx[:0],num,10)
+		p = append(p,'\t')
+		got := make([]byte,len(p))
+		if _,err := g.dat.ReadAt(got,e.off); err!=nil || !bytes.Equal(got,p) { return io.ErrUnexpectedEOF }
+		return nil
+	})
+	return err==nil && end==g.datSize
+}
+
+func appendLine(b []byte, e *Entry) []byte {
+	b = strconv.AppendInt(b,e.Number,10)
+	for _,f := range [][]byte{e.Subject,e.From,e.Date,e.MessageId,e.References} {
+		b = append(append(b,'\t'),f...)
+	}
+	for _,v := range [...]int64{e.Bytes,e.Lines,e.Arrived,e.Expires} {
+		b = strconv.AppendInt(append(b,'\t'),v,10)
+	}
+	return append(b,'\n')
+}
+
+func parseLine(line []byte, e *Entry) bool {
+	fs := bytes.Split(bytes.TrimRight(line,"\n"),[]byte("\t"))
+	if len(fs)<10 { return false }
+	var err error
+	if e.Number,err = strconv.ParseInt(string(fs[0]),10,64); err!=nil { return false }
+	e.Subject,e.From,e.Date,e.MessageId,e.References = fs[1],fs[2],fs[3],fs[4],fs[5]
+	e.Bytes,_   = strconv.ParseInt(string(fs[6]),10,64)
+	e.Lines,_   = strconv.ParseInt(string(fs[7]),10,64)
+	e.Arrived,_ = strconv.ParseInt(string(fs[8]),10,64)
+	e.Expires,_ = strconv.ParseInt(string(fs[9]),10,64)
+	return true
+}
+
+// Moves the base of the index down to num.
+func (g *groupFile) rebase(num int64) error {
+	shift := g.base-num
+	data := make([]byte,g.n*entrySize)
+	if _,err := g.idx.ReadAt(data,idxHdrSize); err!=nil && err!=io.EOF { return err }
+	var h [idxHdrSize]byte
+	copy(h[:],idxMagic)
+	binary.BigEndian.PutUint64(h[8:],uint64(num))
+	tmp := g.path(".IDX.new")
+	f,err := os.Create(tmp)
+	if err!=nil { return err }
+	f.Write(h[:])
+	f.Write(make([]byte,shift*entrySize))
+	_,err = f.Write(data)
+	if err==nil { err = f.Sync() }
+	if err!=nil { f.Close(); os.Remove(tmp); return err }
+	if err = os.Rename(tmp,g.path(".IDX")); err!=nil { f.Close(); return err }
+	g.idx.Close()
+	g.idx = f
+	g.base = num
+	g.n += shift
+	return nil
+}
+
+func (g *groupFile) add(e *Entry) error {
+	if g.n==0 {
+		g.base = e.Number
+		var h [idxHdrSize]byte
+		copy(h[:],idxMagic)
+		binary.BigEndian.PutUint64(h[8:],uint64(e.Number))
+		if _,err := g.idx.WriteAt(h[:],0); err!=nil { return err }
+	} else if e.Number<g.base {
+		if err := g.rebase(e.Number); err!=nil { return err }
+	}
+	if old,err := g.entry(e.Number); err==nil && old.live() {
+		g.dat.WriteAt([]byte{'#'},old.off)
+		g.count--
+	}
+	line := appendLine(nil,e)
+	if _,err := g.dat.WriteAt(line,g.datSize); err!=nil { return err }
+	ie := idxEntry{off:g.datSize,length:uint32(len(line)),arrived:e.Arrived,expires:e.Expires}
+	g.datSize += int64(len(line))
+	if err := g.setEntry(e.Number,&ie); err!=nil { return err }
+	if g.count==0 || e.Number<g.low { g.low = e.Number }
+	if e.Number>g.high { g.high = e.Number }
+	g.count++
+	return nil
+}
+
+func (g *groupFile) scan(first, last int64, fn func(e *Entry) error) error {
+	var ent Entry
+	return g.entries(first,last,func(num int64, e *idxEntry) error {
+		if !e.live() { return nil }
+		line := make([]byte,e.length)
+		if _,err := g.dat.ReadAt(line,e.off); err!=nil { return err }
+		if !parseLine(line,&ent) || ent.Number!=num { return nil }
+		return fn(&ent)
+	})
+}
+
+func (g *groupFile) del(num int64, ids *idIndex) error {
+	e,err := g.entry(num)
+	if err!=nil || !e.live() { return err }
+	line := make([]byte,e.length)
+	if _,err = g.dat.ReadAt(line,e.off); err==nil {
+		var ent Entry
+		if parseLine(line,&ent) {
+			if err = ids.remove(hash64(ent.MessageId),g.hash,num); err!=nil { return err }
+		}
+	}
+	e.flags |= flagDeleted
+	if err = g.setEntry(num,&e); err!=nil { return err }
+	g.dat.WriteAt([]byte{'#'},e.off)
+	g.count--
+	if num!=g.low { return nil }
+	
+	// Advance the low water mark to the next live entry.
+	g.low = g.high+1
+	err = g.entries(num+1,g.high,func(n int64, e *idxEntry) error {
+		if !e.live() { return nil }
+		g.low = n
+		return io.EOF // Stop.
+	})
+	if err==io.EOF { err = nil }
+	return err
+}
+
+// Writes new files, containing only the live entries.
+func (g *groupFile) compact() error {
+	dtmp,itmp := g.path(".DAT.new"),g.path(".IDX.new")
+	df,err := os.Create(dtmp)
+	if err!=nil { return err }
+	dw := bufio.NewWriter(df)
+	type rec struct{
+		num int64
+		e   idxEntry
+	}
+	var recs []rec
+	var off int64
+	err = g.entries(g.base,g.base+g.n-1,func(num int64, e *idxEntry) error {
+		if !e.live() { return nil }
+		line := make([]byte,e.length)
+		if _,err := g.dat.ReadAt(line,e.off); err!=nil { return err }
+		dw.Write(line)
+		ne := *e
+		ne.off = off
+		off += int64(e.length)
+		recs = append(recs,rec{num,ne})
+		return nil
+	})
+	if err==nil { err = dw.Flush() }
+	if err==nil { err = df.Sync() }
+	df.Close()
+	if err!=nil { os.Remove(dtmp); return err }
+	
+	base := g.high+1
+	if len(recs)>0 { base = recs[0].num }
+	idx := make([]byte,idxHdrSize)
+	copy(idx,idxMagic)
+	binary.BigEndian.PutUint64(idx[8:],uint64(base))
+	var b [entrySize]byte
+	for _,r := range recs {
+		for int64(len(idx))<idxHdrSize+(r.num-base)*entrySize { idx = append(idx,make([]byte,entrySize)...) }
+		r.e.encode(b[:])
+		idx = append(idx,b[:]...)
+	}
+	// Keep the high water mark.
+	for int64(len(idx))<idxHdrSize+(g.high-base+1)*entrySize { idx = append(idx,make([]byte,entrySize)...) }
+	if err = writeFileSync(itmp,idx); err!=nil { os.Remove(dtmp); return err }
+	
+	// The data file is renamed first: If we crash in between, the old index does
+	// not match the new data file and is rebuilt, when the group is opened.
+	g.close()
+	if err = os.Rename(dtmp,g.path(".DAT")); err!=nil { return err }
+	if err = os.Rename(itmp,g.path(".IDX")); err!=nil { return err }
+	return g.open()
+}
+
+func writeFileSync(fn string, data []byte) error {
+	f,err := os.Create(fn)
+	if err!=nil { return err }
+	_,err = f.Write(data)
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	return err
+}
+
+// Rebuilds the index of a group from its data file.
+func rebuild(dir, name string) error {
+	dat,err := os.Open(filepath.Join(dir,name+".DAT"))
+	if err!=nil { return err }
+	type rec struct{
+		num int64
+		e   idxEntry
+	}
+	var recs []rec
+	r := bufio.NewReader(dat)
+	var off int64
+	var ent Entry
+	for {
+		line,err := r.ReadBytes('\n')
+		if len(line)>0 && line[len(line)-1]=='\n' && parseLine(line,&ent) {
+			recs = append(recs,rec{ent.Number,idxEntry{off,uint32(len(line)),0,ent.Arrived,ent.Expires}})
+		}
+		off += int64(len(line))
+		if err!=nil { break }
+	}
+	// A partially written last line is cut off.
+	if err = dat.Close(); err!=nil { return err }
+	if len(recs)>0 {
+		last := recs[len(recs)-1]
+		if err = os.Truncate(filepath.Join(dir,name+".DAT"),last.e.off+int64(last.e.length)); err!=nil { return err }
+	} else if err = os.Truncate(filepath.Join(dir,name+".DAT"),0); err!=nil {
+		return err
+	}
+	sort.SliceStable(recs,func(i,j int) bool { return recs[i].num<recs[j].num })
+	idx := make([]byte,idxHdrSize)
+	copy(idx,idxMagic)
+	var b [entrySize]byte
+	if len(recs)>0 {
+		base := recs[0].num
+		binary.BigEndian.PutUint64(idx[8:],uint64(base))
+		for _,rc := range recs {
+			pos := idxHdrSize+(rc.num-base)*entrySize
+			for int64(len(idx))<pos+entrySize { idx = append(idx,make([]byte,entrySize)...) }
+			rc.e.encode(b[:])
+			copy(idx[pos:],b[:])
+		}
+	}
+	return writeFileSync(filepath.Join(dir,name+".IDX"),idx)
+}
+
@@ -0,0 +1,218 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package overview
+
+import "encoding/binary"
+import "hash/fnv"
+import "io"
+import "os"
+
+const(
+	idsMagic    = "FNID"
+	idsHdrSize  = 24
+	idsSlotSize = 24
+	idsMinSlots = 1<<12
+)
+
+/*
+The Message-ID index: an on-disk hash table with linear probing, so that
+neither memory nor the time to open the database grow with the number of
+articles. A slot holds
+
+	id     uint64  hash of the Message-ID (0, if the slot is free)
+	group  uint64  hash of the group name
+	num    int64   article number
+
+A crossposted article has a slot for each of its groups, so that it can still be
+found, when it is removed from one of them. The header holds the number of
+slots and of used slots. As only hashes are
+stored, the entries are verified against the data files. After a crash, the
+index may lack entries or contain stale ones.
+*/
+type idIndex struct{
+	fn    string
+	f     *os.File
+	slots uint64
+	used  uint64
+}
+
+func hash64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	if v := h.Sum64(); v!=0 { return v }
+	return 1
+}
+
+/*
+Opens the index. If it is missing or damaged, an empty one is created, and
+fresh is set; it has to be filled from the data files.
+*/
+func openIds(fn string) (x *idIndex,fresh bool,err error) {
+	x = &idIndex{fn:fn}
+	x.f,err = os.OpenFile(fn,os.O_RDWR,0)
+	if err==nil {
+		var h [idsHdrSize]byte
+		fi,e := x.f.Stat()
+		if _,err = x.f.ReadAt(h[:],0); err==nil && e==nil && string(h[:4])==idsMagic {
+			x.slots = binary.BigEndian.Uint64(h[8:])
+			x.used  = binary.BigEndian.Uint64(h[16:])
+			if x.slots>=idsMinSlots && fi.Size()==idsHdrSize+int64(x.slots)*idsSlotSize { return x,false,nil }
+		}
+		x.f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil,false,err
+	}
+	// The fresh index is built aside, so that a crash does not leave a partial one.
+	x.fn = fn+".new"
+	if x.f,err = createIds(x.fn,idsMinSlots); err!=nil { return nil,false,err }
+	x.slots,x.used = idsMinSlots,0
+	return x,true,nil
+}
+
+// Moves a fresh index into place, once it has been filled.
+func (x *idIndex) commit(fn string) error {
+	if err := x.f.Sync(); err!=nil { return err }
+	if err := os.Rename(x.fn,fn); err!=nil { return err }
+	x.fn = fn
+	return nil
+}
+
+func createIds(fn string, slots uint64) (*os.File,error) {
+	f,err := os.OpenFile(fn,os.O_RDWR|os.O_CREATE|os.O_TRUNC,0644)
+	if err!=nil { return nil,err }
+	var h [idsHdrSize]byte
+	copy(h[:],idsMagic)
+	binary.BigEndian.PutUint64(h[8:],slots)
+	if _,err = f.WriteAt(h[:],0); err==nil { err = f.Truncate(idsHdrSize+int64(slots)*idsSlotSize) }
+	if err!=nil { f.Close(); return nil,err }
+	return f,nil
+}
+
+func (x *idIndex) close() error { return x.f.Close() }
+
+func (x *idIndex) writeUsed() error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],x.used)
+	_,err := x.f.WriteAt(b[:],16)
+	return err
+}
+
+func (x *idIndex) slot(i uint64) (id, group uint64, num int64, err error) {
+	var b [idsSlotSize]byte
+	if _,err = x.f.ReadAt(b[:],idsHdrSize+int64(i)*idsSlotSize); err!=nil { return }
+	return binary.BigEndian.Uint64(b[0:]),binary.BigEndian.Uint64(b[8:]),int64(binary.BigEndian.Uint64(b[16:])),nil
+}
+func (x *idIndex) setSlot(i uint64, id, group uint64, num int64) error {
+	var b [idsSlotSize]byte
+	binary.BigEndian.PutUint64(b[0:],id)
+	binary.BigEndian.PutUint64(b[8:],group)
+	binary.BigEndian.PutUint64(b[16:],uint64(num))
+	_,err := x.f.WriteAt(b[:],idsHdrSize+int64(i)*idsSlotSize)
+	return err
+}
+
+// Returns the slot of a Message-ID hash in a group, or the free slot, where it belongs.
+func (x *idIndex) probe(id, group uint64) (i uint64, found bool, num int64, err error) {
+	for i = id%x.slots;; i = (i+1)%x.slots {
+		var sid,sg uint64
+		if sid,sg,num,err = x.slot(i); err!=nil || sid==0 { return }
+		if sid==id && sg==group { return i,true,num,nil }
+	}
+}
+
+type idLoc struct{
+	group uint64
+	num   int64
+}
+
+// Returns the locations (group hash and number) of a Message-ID hash.
+func (x *idIndex) find(id uint64) (locs []idLoc, err error) {
+	for i := id%x.slots;; i = (i+1)%x.slots {
+		sid,sg,sn,err := x.slot(i)
+		if err!=nil || sid==0 { return locs,err }
+		if sid==id { locs = append(locs,idLoc{sg,sn}) }
+	}
+}
+
+// Stores the location of a Message-ID hash in a group, replacing an earlier one.
+func (x *idIndex) put(id, group uint64, num int64) error {
+	if (x.used+1)*2>x.slots {
+		if err := x.grow(); err!=nil { return err }
+	}
+	i,found,_,err := x.probe(id,group)
+	if err!=nil { return err }
+	if err = x.setSlot(i,id,group,num); err!=nil || found { return err }
+	x.used++
+	return x.writeUsed()
+}
+
+/*
+Removes a Message-ID hash, if it points to the given location. The entries
+behind it are moved back, so that no probe sequence is broken.
+*/
+func (x *idIndex) remove(id, group uint64, num int64) error {
+	i,found,n,err := x.probe(id,group)
+	if err!=nil || !found || n!=num { return err }
+	for j := (i+1)%x.slots;; j = (j+1)%x.slots {
+		sid,sg,sn,err := x.slot(j)
+		if err!=nil { return err }
+		if sid==0 { break }
+		// The entry stays, if its home slot lies cyclically within (i,j].
+		k := sid%x.slots
+		if (i<=j && i<k && k<=j) || (i>j && (i<k || k<=j)) { continue }
+		if err = x.setSlot(i,sid,sg,sn); err!=nil { return err }
+		i = j
+	}
+	if err = x.setSlot(i,0,0,0); err!=nil { return err }
+	x.used--
+	return x.writeUsed()
+}
+
+// Doubles the number of slots.
+func (x *idIndex) grow() error {
+	tmp := x.fn+".new"
+	f,err := createIds(tmp,x.slots*2)
+	if err!=nil { return err }
+	nx := &idIndex{fn:x.fn,f:f,slots:x.slots*2}
+	buf := make([]byte,1024*idsSlotSize)
+	for i := uint64(0); i<x.slots && err==nil; i += 1024 {
+		b := buf
+		if k := x.slots-i; k<1024 { b = buf[:k*idsSlotSize] }
+		if _,err = x.f.ReadAt(b,idsHdrSize+int64(i)*idsSlotSize); err==io.EOF { err = nil }
+		for len(b)>0 && err==nil {
+			if id := binary.BigEndian.Uint64(b); id!=0 {
+				err = nx.put(id,binary.BigEndian.Uint64(b[8:]),int64(binary.BigEndian.Uint64(b[16:])))
+			}
+			b = b[idsSlotSize:]
+		}
+	}
+	if err==nil { err = f.Sync() }
+	if err==nil { err = os.Rename(tmp,x.fn) }
+	if err!=nil { f.Close(); os.Remove(tmp); return err }
+	x.f.Close()
+	x.f,x.slots,x.used = f,nx.slots,nx.used
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package overview
+
+import "io/ioutil"
+import "math/rand"
+import "os"
+import "path/filepath"
+import "testing"
+
+func tempIds(t *testing.T) (*idIndex,string) {
+	dir,err := ioutil.TempDir("","ids")
+	if err!=nil { t.Fatal(err) }
+	x,fresh,err := openIds(filepath.Join(dir,"ids"))
+	if err!=nil || !fresh { os.RemoveAll(dir); t.Fatalf("new index: fresh=%v %v",fresh,err) }
+	if err = x.commit(filepath.Join(dir,"ids")); err!=nil { t.Fatal(err) }
+	return x,dir
+}
+
+// Checks the index against a model.
+func checkIds(t *testing.T, x *idIndex, model map[uint64]idLoc, absent []uint64) {
+	if x.used!=uint64(len(model)) { t.Errorf("%d slots used, want %d",x.used,len(model)) }
+	for id,l := range model {
+		locs,err := x.find(id)
+		if err!=nil || len(locs)!=1 || locs[0]!=l { t.Fatalf("%x: %v %v, want %v",id,locs,err,l) }
+	}
+	for _,id := range absent {
+		if locs,_ := x.find(id); len(locs)!=0 { t.Fatalf("removed %x found",id) }
+	}
+}
+
+func TestIdIndex(t *testing.T) {
+	x,dir := tempIds(t)
+	defer os.RemoveAll(dir)
+	rnd := rand.New(rand.NewSource(1))
+	model := make(map[uint64]idLoc)
+	var ids []uint64
+	
+	// Enough entries to grow the table twice.
+	for i := 0; i<4*idsMinSlots/2; i++ {
+		id := rnd.Uint64()|1
+		l := idLoc{rnd.Uint64(),int64(i)}
+		if err := x.put(id,l.group,l.num); err!=nil { t.Fatal(err) }
+		model[id] = l
+		ids = append(ids,id)
+	}
+	if x.slots!=4*idsMinSlots { t.Errorf("%d slots",x.slots) }
+	checkIds(t,x,model,nil)
+	
+	// Replacing the location within the group keeps the count.
+	x.put(ids[0],model[ids[0]].group,1)
+	model[ids[0]] = idLoc{model[ids[0]].group,1}
+	
+	// A removal with another location is ignored.
+	x.remove(ids[1],0,0)
+	x.remove(ids[2],model[ids[2]].group,model[ids[2]].num+1)
+	
+	var gone []uint64
+	rnd.Shuffle(len(ids),func(i,j int) { ids[i],ids[j] = ids[j],ids[i] })
+	for _,id := range ids[:len(ids)/2] {
+		if err := x.remove(id,model[id].group,model[id].num); err!=nil { t.Fatal(err) }
+		delete(model,id)
+		gone = append(gone,id)
+	}
+	checkIds(t,x,model,gone)
+	
+	x.close()
+	x,fresh,err := openIds(filepath.Join(dir,"ids"))
+	if err!=nil || fresh { t.Fatalf("reopen: fresh=%v %v",fresh,err) }
+	defer x.close()
+	checkIds(t,x,model,gone)
+}
+
+// Clusters, that wrap around the end of the table, are removed correctly.
+func TestIdIndexWrap(t *testing.T) {
+	x,dir := tempIds(t)
+	defer os.RemoveAll(dir)
+	defer x.close()
+	model := make(map[uint64]idLoc)
+	var all []uint64
+	for _,home := range []uint64{idsMinSlots-2,idsMinSlots-1,0} {
+		for k := uint64(1); k<=4; k++ {
+			id := home+k*idsMinSlots
+			x.put(id,home,int64(k))
+			model[id] = idLoc{home,int64(k)}
+			all = append(all,id)
+		}
+	}
+	checkIds(t,x,model,nil)
+	var gone []uint64
+	for _,i := range []int{0,5,4,11,2} {
+		id := all[i]
+		x.remove(id,model[id].group,model[id].num)
+		delete(model,id)
+		gone = append(gone,id)
+		checkIds(t,x,model,gone)
+	}
+}
+
+// A crossposted article has a location per group.
+func TestIdIndexCrosspost(t *testing.T) {
+	x,dir := tempIds(t)
+	defer os.RemoveAll(dir)
+	defer x.close()
+	const id = 7
+	for g := uint64(1); g<=3; g++ { x.put(id,g,int64(10*g)) }
+	x.put(id+idsMinSlots,1,5) // Same home slot.
+	x.put(id,2,21)
+	locs,_ := x.find(id)
+	if len(locs)!=3 || locs[0]!=(idLoc{1,10}) || locs[1]!=(idLoc{2,21}) || locs[2]!=(idLoc{3,30}) { t.Errorf("locations %v",locs) }
+	x.remove(id,1,10)
+	x.remove(id,3,30)
+	locs,_ = x.find(id)
+	if len(locs)!=1 || locs[0]!=(idLoc{2,21}) { t.Errorf("locations after removal %v",locs) }
+	if locs,_ = x.find(id+idsMinSlots); len(locs)!=1 || locs[0]!=(idLoc{1,5}) { t.Errorf("colliding id: %v",locs) }
+}
+
+func TestIdIndexDamaged(t *testing.T) {
+	x,dir := tempIds(t)
+	defer os.RemoveAll(dir)
+	x.put(5,1,1)
+	x.close()
+	fn := filepath.Join(dir,"ids")
+	data,_ := ioutil.ReadFile(fn)
+	for name,bad := range map[string][]byte{
+		"magic":     append([]byte("XXXX"),data[4:]...),
+		"truncated": data[:len(data)-1],
+		"empty":     nil,
+	} {
+		ioutil.WriteFile(fn,bad,0644)
+		x,fresh,err := openIds(fn)
+		if err!=nil || !fresh { t.Errorf("%s: fresh=%v %v",name,fresh,err) }
+		if x!=nil { x.close() }
+	}
+}
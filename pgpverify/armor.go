@@ -0,0 +1,95 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package pgpverify
+
+import "bytes"
+import "encoding/base64"
+import "errors"
+
+var ErrArmor = errors.New("pgpverify: invalid armor")
+
+const crc24Init = 0xB704CE
+const crc24Poly = 0x1864CFB
+
+func crc24(data []byte) uint32 {
+	crc := uint32(crc24Init)
+	for _,b := range data {
+		crc ^= uint32(b)<<16
+		for i := 0; i<8; i++ {
+			crc <<= 1
+			if crc&0x1000000!=0 { crc ^= crc24Poly }
+		}
+	}
+	return crc&0xFFFFFF
+}
+
+/*
+Decodes the radix-64 data of an armored block (RFC 4880, 6): the base64 lines,
+optionally followed by a checksum line "=XXXX". If present, the checksum is
+checked.
+*/
+func decodeRadix64(lines [][]byte) ([]byte,error) {
+	var b64 []byte
+	var sum []byte
+	for _,l := range lines {
+		l = bytes.TrimSpace(l)
+		if len(l)==0 { continue }
+		if l[0]=='=' { sum = l[1:]; break }
+		b64 = append(b64,l...)
+	}
+	data := make([]byte,base64.StdEncoding.DecodedLen(len(b64)))
+	n,err := base64.StdEncoding.Decode(data,b64)
+	if err!=nil { return nil,ErrArmor }
+	data = data[:n]
+	if len(sum)>0 {
+		var c [3]byte
+		if k,err := base64.StdEncoding.Decode(c[:],sum); err!=nil || k!=3 { return nil,ErrArmor }
+		if uint32(c[0])<<16|uint32(c[1])<<8|uint32(c[2])!=crc24(data) { return nil,ErrArmor }
+	}
+	return data,nil
+}
+
+/*
+Decodes all armored blocks ("-----BEGIN PGP ...-----") of the input.
+*/
+func decodeArmor(in []byte) (blocks [][]byte,err error) {
+	lines := bytes.Split(bytes.Replace(in,[]byte("\r\n"),[]byte("\n"),-1),[]byte("\n"))
+	for i := 0; i<len(lines); i++ {
+		if !bytes.HasPrefix(lines[i],[]byte("-----BEGIN PGP ")) { continue }
+		
+		// Skip the armor headers.
+		i++
+		for i<len(lines) && len(bytes.TrimSpace(lines[i]))>0 { i++ }
+		j := i
+		for j<len(lines) && !bytes.HasPrefix(lines[j],[]byte("-----END PGP ")) { j++ }
+		if j==len(lines) { return nil,ErrArmor }
+		data,err := decodeRadix64(lines[i:j])
+		if err!=nil { return nil,err }
+		blocks = append(blocks,data)
+		i = j
+	}
+	return
+}
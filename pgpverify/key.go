@@ -0,0 +1,228 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package pgpverify
+
+import "bytes"
+import "crypto/dsa"
+import "crypto/ed25519"
+import "crypto/md5"
+import "crypto/rsa"
+import "crypto/sha1"
+import "encoding/binary"
+import "io"
+import "io/ioutil"
+import "os"
+import "strings"
+import "time"
+
+// Public key algorithms (RFC 4880, 9.1).
+const(
+	AlgoRSA         = 1
+	AlgoRSASignOnly = 3
+	AlgoDSA         = 17
+	AlgoEdDSA       = 22
+)
+
+var oidEd25519 = []byte{0x2B,0x06,0x01,0x04,0x01,0xDA,0x47,0x0F,0x01}
+
+/*
+A public key or subkey.
+*/
+type PublicKey struct{
+	Version     int
+	Algo        int
+	Created     time.Time
+	KeyId       uint64
+	Fingerprint []byte
+	
+	// The user IDs of a primary key.
+	UserIds []string
+	
+	// For subkeys, the primary key. Nil for primary keys.
+	Primary *PublicKey
+	
+	// *rsa.PublicKey, *dsa.PublicKey or ed25519.PublicKey. Nil, if the
+	// algorithm is not supported for verification.
+	key interface{}
+}
+
+// Returns the primary key.
+func (k *PublicKey) Owner() *PublicKey {
+	if k.Primary!=nil { return k.Primary }
+	return k
+}
+
+/*
+Reports, whether one of the user IDs of the (primary) key is name. A user ID of
+the form "Name <address>" also matches the name and the address alone.
+*/
+func (k *PublicKey) Is(name string) bool {
+	for _,uid := range k.Owner().UserIds {
+		if uid==name { return true }
+		i := strings.LastIndexByte(uid,'<')
+		j := strings.LastIndexByte(uid,'>')
+		if i<0 || j<i { continue }
+		if strings.TrimSpace(uid[:i])==name || uid[i+1:j]==name { return true }
+	}
+	return false
+}
+
+// Parses the body of a public key or public subkey packet.
+func parsePublicKey(body []byte) (k *PublicKey,err error) {
+	if len(body)<6 { return nil,ErrPacket }
+	k = &PublicKey{Version:int(body[0])}
+	k.Created = time.Unix(int64(binary.BigEndian.Uint32(body[1:])),0)
+	var mat []byte
+	switch k.Version {
+	case 2,3:
+		if len(body)<8 { return nil,ErrPacket }
+		k.Algo,mat = int(body[7]),body[8:]
+	case 4:
+		k.Algo,mat = int(body[5]),body[6:]
+	default:
+		// Newer key versions are not supported.
+		return nil,nil
+	}
+	switch k.Algo {
+	case AlgoRSA,AlgoRSASignOnly:
+		var vs [][]byte
+		if vs,_,err = readMPIs(mat,2); err!=nil { return }
+		e := bigInt(vs[1])
+		if !e.IsInt64() || e.Int64()>1<<31 { return nil,ErrPacket }
+		k.key = &rsa.PublicKey{N:bigInt(vs[0]),E:int(e.Int64())}
+		if k.Version<4 {
+			// The Key ID of a V3 key are the low 64 bits of the modulus.
+			n := vs[0]
+			if len(n)<8 { return nil,ErrPacket }
+			k.KeyId = binary.BigEndian.Uint64(n[len(n)-8:])
+			fp := md5.New()
+			fp.Write(vs[0])
+			fp.Write(vs[1])
+			k.Fingerprint = fp.Sum(nil)
+			return
+		}
+	case AlgoDSA:
+		var vs [][]byte
+		if vs,_,err = readMPIs(mat,4); err!=nil { return }
+		k.key = &dsa.PublicKey{Parameters:dsa.Parameters{P:bigInt(vs[0]),Q:bigInt(vs[1]),G:bigInt(vs[2])},Y:bigInt(vs[3])}
+	case AlgoEdDSA:
+		if len(mat)<1 || len(mat)<1+int(mat[0]) { return nil,ErrPacket }
+		oid := mat[1:1+int(mat[0])]
+		q,_,err := readMPI(mat[1+int(mat[0]):])
+		if err!=nil { return nil,err }
+		// The point is prefixed by 0x40 (native encoding).
+		if bytes.Equal(oid,oidEd25519) && len(q)==33 && q[0]==0x40 {
+			k.key = ed25519.PublicKey(q[1:])
+		}
+	}
+	if k.Version<4 { return nil,ErrPacket }
+	fp := sha1.New()
+	fp.Write([]byte{0x99,byte(len(body)>>8),byte(len(body))})
+	fp.Write(body)
+	k.Fingerprint = fp.Sum(nil)
+	k.KeyId = binary.BigEndian.Uint64(k.Fingerprint[12:])
+	return
+}
+
+/*
+A set of public keys.
+
+The keyring is trusted as a whole: self-signatures, certifications and
+revocations are not checked.
+*/
+type Keyring struct{
+	// The primary keys.
+	Keys []*PublicKey
+	
+	// If true, signatures over SHA-1 digests are accepted. SHA-1 is broken for
+	// collisions, so this is off by default.
+	AllowSHA1 bool
+	
+	byId map[uint64][]*PublicKey
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{byId:make(map[uint64][]*PublicKey)}
+}
+
+// Reads a keyring, in binary or armored form.
+func ReadKeyring(r io.Reader) (*Keyring,error) {
+	data,err := ioutil.ReadAll(r)
+	if err!=nil { return nil,err }
+	kr := NewKeyring()
+	return kr,kr.Add(data)
+}
+
+// Reads a keyring file, in binary or armored form.
+func ReadKeyringFile(fn string) (*Keyring,error) {
+	f,err := os.Open(fn)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	return ReadKeyring(f)
+}
+
+// Adds the keys of a keyring, in binary or armored form.
+func (kr *Keyring) Add(data []byte) error {
+	if bytes.Contains(data,[]byte("-----BEGIN PGP ")) {
+		blocks,err := decodeArmor(data)
+		if err!=nil { return err }
+		for _,b := range blocks {
+			if err = kr.addPackets(b); err!=nil { return err }
+		}
+		return nil
+	}
+	return kr.addPackets(data)
+}
+
+func (kr *Keyring) addPackets(b []byte) error {
+	var cur *PublicKey
+	for len(b)>0 {
+		tag,body,rest,err := readPacket(b)
+		if err!=nil { return err }
+		b = rest
+		switch tag {
+		case tagPublicKey:
+			cur,err = parsePublicKey(body)
+			if err!=nil { return err }
+			if cur==nil { continue }
+			kr.Keys = append(kr.Keys,cur)
+			kr.byId[cur.KeyId] = append(kr.byId[cur.KeyId],cur)
+		case tagPublicSub:
+			if cur==nil { continue }
+			sub,err := parsePublicKey(body)
+			if err!=nil { return err }
+			if sub==nil { continue }
+			sub.Primary = cur
+			kr.byId[sub.KeyId] = append(kr.byId[sub.KeyId],sub)
+		case tagUserId:
+			if cur!=nil { cur.UserIds = append(cur.UserIds,string(body)) }
+		}
+	}
+	return nil
+}
+
+// Returns the keys and subkeys with the given Key ID.
+func (kr *Keyring) Lookup(id uint64) []*PublicKey { return kr.byId[id] }
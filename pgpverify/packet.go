@@ -0,0 +1,99 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package pgpverify
+
+import "errors"
+import "math/big"
+
+var ErrPacket = errors.New("pgpverify: invalid packet")
+
+// Packet tags (RFC 4880, 4.3).
+const(
+	tagSignature = 2
+	tagPublicKey = 6
+	tagUserId    = 13
+	tagPublicSub = 14
+)
+
+/*
+Reads the next packet. Old and new format headers are supported; partial body
+lengths are not, as they are not used for keys and signatures.
+*/
+func readPacket(b []byte) (tag int, body, rest []byte, err error) {
+	if len(b)<2 || b[0]&0x80==0 { return 0,nil,nil,ErrPacket }
+	var n int
+	if b[0]&0x40!=0 {
+		// New format.
+		tag = int(b[0]&0x3F)
+		switch l := b[1]; {
+		case l<192: n,b = int(l),b[2:]
+		case l<224:
+			if len(b)<3 { return 0,nil,nil,ErrPacket }
+			n,b = (int(l)-192)<<8+int(b[2])+192,b[3:]
+		case l==255:
+			if len(b)<6 { return 0,nil,nil,ErrPacket }
+			n,b = int(b[2])<<24|int(b[3])<<16|int(b[4])<<8|int(b[5]),b[6:]
+		default: return 0,nil,nil,ErrPacket
+		}
+	} else {
+		// Old format.
+		tag = int(b[0]>>2)&0xF
+		switch b[0]&3 {
+		case 0: n,b = int(b[1]),b[2:]
+		case 1:
+			if len(b)<3 { return 0,nil,nil,ErrPacket }
+			n,b = int(b[1])<<8|int(b[2]),b[3:]
+		case 2:
+			if len(b)<5 { return 0,nil,nil,ErrPacket }
+			n,b = int(b[1])<<24|int(b[2])<<16|int(b[3])<<8|int(b[4]),b[5:]
+		default:
+			// Indeterminate length: the rest of the input.
+			n,b = len(b)-1,b[1:]
+		}
+	}
+	if n<0 || n>len(b) { return 0,nil,nil,ErrPacket }
+	return tag,b[:n],b[n:],nil
+}
+
+// Reads a multiprecision integer (RFC 4880, 3.2).
+func readMPI(b []byte) (v []byte, rest []byte, err error) {
+	if len(b)<2 { return nil,nil,ErrPacket }
+	bits := int(b[0])<<8|int(b[1])
+	n := (bits+7)/8
+	if len(b)<2+n { return nil,nil,ErrPacket }
+	return b[2:2+n],b[2+n:],nil
+}
+
+func readMPIs(b []byte, k int) (vs [][]byte, rest []byte, err error) {
+	for i := 0; i<k; i++ {
+		var v []byte
+		if v,b,err = readMPI(b); err!=nil { return }
+		vs = append(vs,v)
+	}
+	return vs,b,nil
+}
+
+func bigInt(b []byte) *big.Int { return new(big.Int).SetBytes(b) }
@@ -0,0 +1,123 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package pgpverify
+
+import "bytes"
+import "encoding/base64"
+import "testing"
+
+// Encodes a packet with a new format header.
+func newPacket(tag int, body []byte) []byte {
+	b := []byte{0xC0|byte(tag)}
+	switch n := len(body); {
+	case n<192: b = append(b,byte(n))
+	case n<8384: b = append(b,byte((n-192)>>8+192),byte(n-192))
+	default: b = append(b,255,byte(n>>24),byte(n>>16),byte(n>>8),byte(n))
+	}
+	return append(b,body...)
+}
+
+// Encodes a packet with an old format header.
+func oldPacket(tag int, body []byte) []byte {
+	switch n := len(body); {
+	case n<256: return append([]byte{0x80|byte(tag)<<2,byte(n)},body...)
+	case n<65536: return append([]byte{0x81|byte(tag)<<2,byte(n>>8),byte(n)},body...)
+	default: return append([]byte{0x82|byte(tag)<<2,byte(n>>24),byte(n>>16),byte(n>>8),byte(n)},body...)
+	}
+}
+
+func armor(kind string, data []byte) []byte {
+	b64 := base64.StdEncoding.EncodeToString(data)
+	out := []byte("-----BEGIN PGP "+kind+"-----\nVersion: test\n\n")
+	for len(b64)>64 {
+		out = append(append(out,b64[:64]...),'\n')
+		b64 = b64[64:]
+	}
+	out = append(append(out,b64...),'\n')
+	c := crc24(data)
+	out = append(out,'=')
+	out = append(out,base64.StdEncoding.EncodeToString([]byte{byte(c>>16),byte(c>>8),byte(c)})...)
+	return append(out,"\n-----END PGP "+kind+"-----\n"...)
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	for _,n := range []int{0,1,191,192,255,256,8383,8384,65535,65536,100000} {
+		body := bytes.Repeat([]byte{0x5A},n)
+		for _,p := range [][]byte{newPacket(tagUserId,body),oldPacket(tagUserId,body)} {
+			tag,b,rest,err := readPacket(append(p,1,2,3))
+			if err!=nil || tag!=tagUserId || len(b)!=n || !bytes.Equal(rest,[]byte{1,2,3}) {
+				t.Errorf("length %d: tag %d, %d bytes, rest %v, %v",n,tag,len(b),rest,err)
+			}
+			// Every truncation is detected.
+			for _,k := range []int{0,1,len(p)-n,len(p)-1} {
+				if k>=len(p) || k<0 { continue }
+				if _,_,_,err = readPacket(p[:k]); err!=ErrPacket && n>0 { t.Errorf("length %d truncated to %d: %v",n,k,err) }
+			}
+		}
+	}
+	
+	// Indeterminate length.
+	if tag,b,rest,err := readPacket([]byte{0x80|tagUserId<<2|3,'a','b'}); err!=nil || tag!=tagUserId || string(b)!="ab" || len(rest)!=0 {
+		t.Errorf("indeterminate length: %d %q %v",tag,b,err)
+	}
+	// Not a packet, partial body length.
+	for _,p := range [][]byte{{0x00,0x01,0x00},{0xC0|tagUserId,224,0}} {
+		if _,_,_,err := readPacket(p); err!=ErrPacket { t.Errorf("%x: %v",p,err) }
+	}
+}
+
+func TestMPI(t *testing.T) {
+	v,rest,err := readMPI([]byte{0x00,0x09,0x01,0xFF,0xAA})
+	if err!=nil || !bytes.Equal(v,[]byte{0x01,0xFF}) || !bytes.Equal(rest,[]byte{0xAA}) { t.Errorf("%x %x %v",v,rest,err) }
+	for _,b := range [][]byte{nil,{0x00},{0x00,0x09,0x01}} {
+		if _,_,err = readMPI(b); err!=ErrPacket { t.Errorf("%x: %v",b,err) }
+	}
+	if _,_,err = readMPIs([]byte{0x00,0x08,0x01,0x00,0x10},2); err!=ErrPacket { t.Errorf("truncated second MPI: %v",err) }
+}
+
+func TestArmor(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"),30)
+	blocks,err := decodeArmor(append(armor("PUBLIC KEY BLOCK",data),armor("SIGNATURE",data[:7])...))
+	if err!=nil || len(blocks)!=2 || !bytes.Equal(blocks[0],data) || !bytes.Equal(blocks[1],data[:7]) {
+		t.Fatalf("%d blocks, %v",len(blocks),err)
+	}
+	// CRLF line endings.
+	a := armor("SIGNATURE",data)
+	if blocks,err = decodeArmor(bytes.Replace(a,[]byte("\n"),[]byte("\r\n"),-1)); err!=nil || !bytes.Equal(blocks[0],data) {
+		t.Errorf("CRLF: %v",err)
+	}
+	
+	// A wrong checksum, broken base64 and a missing end line are detected.
+	i := bytes.IndexByte(a,'=')
+	bad := append([]byte(nil),a...)
+	bad[i+1] ^= 1
+	if _,err = decodeArmor(bad); err!=ErrArmor { t.Errorf("bad checksum: %v",err) }
+	bad = bytes.Replace(a,[]byte("MDEy"),[]byte("M*Ey"),1)
+	if _,err = decodeArmor(bad); err!=ErrArmor { t.Errorf("bad base64: %v",err) }
+	if _,err = decodeArmor(a[:bytes.Index(a,[]byte("-----END"))]); err!=ErrArmor { t.Errorf("no end line: %v",err) }
+	
+	// Without a checksum line.
+	noSum := append(append([]byte(nil),a[:i]...),a[bytes.Index(a,[]byte("-----END")):]...)
+	if blocks,err = decodeArmor(noSum); err!=nil || !bytes.Equal(blocks[0],data) { t.Errorf("no checksum: %v",err) }
+}
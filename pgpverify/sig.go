@@ -0,0 +1,186 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package pgpverify
+
+import "crypto"
+import "crypto/dsa"
+import "crypto/ed25519"
+import "crypto/rsa"
+import "encoding/binary"
+import "errors"
+import "time"
+
+import _ "crypto/sha1"
+import _ "crypto/sha256"
+import _ "crypto/sha512"
+
+var(
+	ErrUnsupported  = errors.New("pgpverify: unsupported algorithm")
+	ErrBadSignature = errors.New("pgpverify: bad signature")
+)
+
+/*
+Hash algorithms (RFC 4880, 9.4). MD5 (1) is not supported at all; SHA-1 is only
+accepted, if the Keyring allows it.
+*/
+const hashSHA1 = 2
+var hashes = map[int]crypto.Hash{
+	hashSHA1: crypto.SHA1,
+	8:  crypto.SHA256,
+	9:  crypto.SHA384,
+	10: crypto.SHA512,
+	11: crypto.SHA224,
+}
+
+// Signature types (RFC 4880, 5.2.1).
+const(
+	SigBinary = 0x00
+	SigText   = 0x01
+)
+
+/*
+A signature packet.
+*/
+type Signature struct{
+	Version  int
+	Type     int
+	PubAlgo  int
+	HashAlgo int
+	Created  time.Time
+	
+	// The Key ID of the issuer. Zero, if unknown.
+	KeyId uint64
+	
+	// The data, that is hashed after the signed data.
+	suffix []byte
+	left16 []byte
+	mpis   [][]byte
+}
+
+func parseSignature(body []byte) (s *Signature,err error) {
+	if len(body)<1 { return nil,ErrPacket }
+	s = &Signature{Version:int(body[0])}
+	var rest []byte
+	switch s.Version {
+	case 2,3:
+		if len(body)<19 || body[1]!=5 { return nil,ErrPacket }
+		s.Type = int(body[2])
+		s.Created = time.Unix(int64(binary.BigEndian.Uint32(body[3:])),0)
+		s.KeyId = binary.BigEndian.Uint64(body[7:])
+		s.PubAlgo,s.HashAlgo = int(body[15]),int(body[16])
+		s.suffix = body[2:7]
+		s.left16 = body[17:19]
+		rest = body[19:]
+	case 4:
+		if len(body)<6 { return nil,ErrPacket }
+		s.Type,s.PubAlgo,s.HashAlgo = int(body[1]),int(body[2]),int(body[3])
+		hl := int(binary.BigEndian.Uint16(body[4:]))
+		if len(body)<6+hl+2 { return nil,ErrPacket }
+		hashed := body[6:6+hl]
+		ul := int(binary.BigEndian.Uint16(body[6+hl:]))
+		if len(body)<8+hl+ul+2 { return nil,ErrPacket }
+		unhashed := body[8+hl:8+hl+ul]
+		if err = s.subpackets(hashed); err!=nil { return }
+		if err = s.subpackets(unhashed); err!=nil { return }
+		
+		// The V4 trailer (RFC 4880, 5.2.4).
+		s.suffix = append(append([]byte(nil),body[:6+hl]...),4,0xFF,0,0,0,0)
+		binary.BigEndian.PutUint32(s.suffix[len(s.suffix)-4:],uint32(6+hl))
+		s.left16 = body[8+hl+ul:10+hl+ul]
+		rest = body[10+hl+ul:]
+	default:
+		return nil,ErrUnsupported
+	}
+	k := 1
+	switch s.PubAlgo {
+	case AlgoDSA,AlgoEdDSA: k = 2
+	}
+	s.mpis,_,err = readMPIs(rest,k)
+	return
+}
+
+// Parses signature subpackets (RFC 4880, 5.2.3.1).
+func (s *Signature) subpackets(b []byte) error {
+	for len(b)>0 {
+		var n int
+		switch {
+		case b[0]<192: n,b = int(b[0]),b[1:]
+		case b[0]<255:
+			if len(b)<2 { return ErrPacket }
+			n,b = (int(b[0])-192)<<8+int(b[1])+192,b[2:]
+		default:
+			if len(b)<5 { return ErrPacket }
+			n,b = int(binary.BigEndian.Uint32(b[1:])),b[5:]
+		}
+		if n<1 || n>len(b) { return ErrPacket }
+		sp := b[:n]
+		b = b[n:]
+		switch sp[0]&0x7F {
+		case 2: // Signature creation time
+			if len(sp)==5 { s.Created = time.Unix(int64(binary.BigEndian.Uint32(sp[1:])),0) }
+		case 16: // Issuer
+			if len(sp)==9 && s.KeyId==0 { s.KeyId = binary.BigEndian.Uint64(sp[1:]) }
+		case 33: // Issuer fingerprint
+			if len(sp)==22 && sp[1]==4 && s.KeyId==0 { s.KeyId = binary.BigEndian.Uint64(sp[14:]) }
+		}
+	}
+	return nil
+}
+
+func leftPad(b []byte, n int) []byte {
+	if len(b)>=n { return b }
+	p := make([]byte,n)
+	copy(p[n-len(b):],b)
+	return p
+}
+
+// Verifies the signature over data with the given key.
+func (s *Signature) verify(k *PublicKey, data []byte) error {
+	ch,ok := hashes[s.HashAlgo]
+	if !ok || !ch.Available() { return ErrUnsupported }
+	h := ch.New()
+	h.Write(data)
+	h.Write(s.suffix)
+	digest := h.Sum(nil)
+	if digest[0]!=s.left16[0] || digest[1]!=s.left16[1] { return ErrBadSignature }
+	
+	switch pub := k.key.(type) {
+	case *rsa.PublicKey:
+		if s.PubAlgo!=AlgoRSA && s.PubAlgo!=AlgoRSASignOnly { return ErrBadSignature }
+		if rsa.VerifyPKCS1v15(pub,ch,digest,leftPad(s.mpis[0],(pub.N.BitLen()+7)/8))!=nil { return ErrBadSignature }
+	case *dsa.PublicKey:
+		if s.PubAlgo!=AlgoDSA { return ErrBadSignature }
+		if n := (pub.Q.BitLen()+7)/8; len(digest)>n { digest = digest[:n] }
+		if !dsa.Verify(pub,digest,bigInt(s.mpis[0]),bigInt(s.mpis[1])) { return ErrBadSignature }
+	case ed25519.PublicKey:
+		if s.PubAlgo!=AlgoEdDSA || len(s.mpis[0])>32 || len(s.mpis[1])>32 { return ErrBadSignature }
+		sig := append(leftPad(s.mpis[0],32),leftPad(s.mpis[1],32)...)
+		if !ed25519.Verify(pub,digest,sig) { return ErrBadSignature }
+	default:
+		return ErrUnsupported
+	}
+	return nil
+}
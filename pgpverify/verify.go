@@ -0,0 +1,165 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Verification of PGP signed control messages, as done by pgpverify.
+
+The signature is carried in the X-PGP-Sig field:
+
+	X-PGP-Sig: <version> <signed-headers>
+		<radix-64 signature>
+		...
+		=<checksum>
+
+The signed text is reconstructed as a cleartext signed message: a line
+"X-Signed-Headers: <signed-headers>", followed by the signed header fields in
+the given order, an empty line and the body.
+
+Only the parts of OpenPGP needed to verify such signatures are implemented:
+RSA, DSA and Ed25519 keys, V3 and V4 signatures.
+*/
+package pgpverify
+
+import "github.com/byte-mug/fastnntp/posting"
+import "bytes"
+import "errors"
+import "strings"
+
+var(
+	ErrNoSignature = errors.New("pgpverify: no X-PGP-Sig field")
+	ErrMalformed   = errors.New("pgpverify: malformed X-PGP-Sig field")
+	ErrUnknownKey  = errors.New("pgpverify: unknown key")
+)
+
+// Converts a field value or the wire form body to LF line endings.
+func toLF(b []byte) []byte {
+	return bytes.Replace(b,[]byte("\r\n"),[]byte("\n"),-1)
+}
+
+/*
+Canonicalizes text for a text signature, as done for cleartext signed
+messages (RFC 4880, 7.1): white space at the end of lines is removed, and lines
+are terminated by CRLF. The line break at the end of the text is not part of it.
+*/
+func canonicalText(text []byte) []byte {
+	text = bytes.TrimSuffix(text,[]byte("\n"))
+	lines := bytes.Split(text,[]byte("\n"))
+	out := make([]byte,0,len(text)+len(lines))
+	for i,l := range lines {
+		if i>0 { out = append(out,'\r','\n') }
+		out = append(out,bytes.TrimRight(l," \t\r")...)
+	}
+	return out
+}
+
+// Removes the dot-stuffing from a body in wire form and converts it to LF line endings.
+func unstuff(body []byte) []byte {
+	body = toLF(body)
+	var out []byte
+	for len(body)>0 {
+		i := bytes.IndexByte(body,'\n')
+		line := body
+		if i>=0 { line,body = body[:i+1],body[i+1:] } else { body = nil }
+		if len(line)>1 && line[0]=='.' && line[1]=='.' { line = line[1:] }
+		out = append(out,line...)
+	}
+	return out
+}
+
+/*
+Returns the text, that is covered by the X-PGP-Sig field of an article, in
+canonical form, and the signature packet. The body must be in wire form.
+*/
+func SignedText(h *posting.Header, body []byte) (text []byte,sig []byte,err error) {
+	text,sig,err = signedText(h,body)
+	if err!=nil { return }
+	return canonicalText(text),sig,nil
+}
+
+// Like SignedText, but returns the text with LF line endings, as it is passed to PGP.
+func signedText(h *posting.Header, body []byte) (text []byte,sig []byte,err error) {
+	fs := strings.Fields(string(h.Get("X-PGP-Sig")))
+	if len(fs)==0 { return nil,nil,ErrNoSignature }
+	if len(fs)<3 { return nil,nil,ErrMalformed }
+	signed := fs[1]
+	lines := make([][]byte,len(fs)-2)
+	for i,l := range fs[2:] { lines[i] = []byte(l) }
+	if sig,err = decodeRadix64(lines); err!=nil { return nil,nil,ErrMalformed }
+	
+	var b bytes.Buffer
+	b.WriteString("X-Signed-Headers: ")
+	b.WriteString(signed)
+	b.WriteByte('\n')
+	for _,name := range strings.Split(signed,",") {
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.Write(toLF(h.GetRaw(name)))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.Write(unstuff(body))
+	return b.Bytes(),sig,nil
+}
+
+/*
+Verifies the X-PGP-Sig field of an article against the keyring. The body must
+be in wire form. On success, the primary key of the signer is returned.
+Signatures over MD5 digests are refused, and those over SHA-1 digests, unless
+the Keyring allows them.
+*/
+func (kr *Keyring) Verify(h *posting.Header, body []byte) (*PublicKey,error) {
+	text,raw,err := signedText(h,body)
+	if err!=nil { return nil,err }
+	var s *Signature
+	for len(raw)>0 && s==nil {
+		tag,pb,rest,err := readPacket(raw)
+		if err!=nil { return nil,ErrMalformed }
+		raw = rest
+		if tag!=tagSignature { continue }
+		if s,err = parseSignature(pb); err!=nil { return nil,err }
+	}
+	if s==nil { return nil,ErrMalformed }
+	if s.Type!=SigText && s.Type!=SigBinary { return nil,ErrMalformed }
+	if s.HashAlgo==hashSHA1 && !kr.AllowSHA1 { return nil,ErrUnsupported }
+	
+	/*
+	The canonical form is that of cleartext signatures. Detached text signatures
+	cover the final line break, and some signers do not strip trailing white space;
+	these forms are accepted as well.
+	*/
+	canon := canonicalText(text)
+	forms := [][]byte{
+		canon,
+		append(canon[:len(canon):len(canon)],'\r','\n'),
+		bytes.Replace(text,[]byte("\n"),[]byte("\r\n"),-1),
+	}
+	err = ErrUnknownKey
+	for _,k := range kr.Lookup(s.KeyId) {
+		for _,f := range forms {
+			if err = s.verify(k,f); err==nil { return k.Owner(),nil }
+		}
+	}
+	return nil,err
+}
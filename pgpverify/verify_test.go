@@ -0,0 +1,276 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package pgpverify
+
+import "github.com/byte-mug/fastnntp/posting"
+import "crypto"
+import "crypto/ed25519"
+import "crypto/rand"
+import "crypto/rsa"
+import "encoding/base64"
+import "encoding/binary"
+import "math/big"
+import "strings"
+import "testing"
+
+import _ "crypto/md5"
+
+// Encodes a multiprecision integer.
+func mpi(b []byte) []byte {
+	b = new(big.Int).SetBytes(b).Bytes()
+	n := new(big.Int).SetBytes(b).BitLen()
+	return append([]byte{byte(n>>8),byte(n)},b...)
+}
+
+// A locally generated key, that signs in the way PGP does.
+type testKey struct{
+	body []byte // the public key packet body
+	priv crypto.Signer
+	algo int
+	id   uint64
+}
+
+func newKey(t *testing.T, algo int) *testKey {
+	k := &testKey{algo:algo}
+	body := []byte{4,0x5E,0,0,0,byte(algo)}
+	switch algo {
+	case AlgoEdDSA:
+		pub,priv,err := ed25519.GenerateKey(rand.Reader)
+		if err!=nil { t.Fatal(err) }
+		body = append(append(body,byte(len(oidEd25519))),oidEd25519...)
+		body = append(body,mpi(append([]byte{0x40},pub...))...)
+		k.priv = priv
+	case AlgoRSA:
+		priv,err := rsa.GenerateKey(rand.Reader,2048)
+		if err!=nil { t.Fatal(err) }
+		body = append(body,mpi(priv.N.Bytes())...)
+		body = append(body,mpi(big.NewInt(int64(priv.E)).Bytes())...)
+		k.priv = priv
+	}
+	k.body = body
+	pk,err := parsePublicKey(body)
+	if err!=nil || pk==nil { t.Fatalf("own key not parsed: %v",err) }
+	k.id = pk.KeyId
+	return k
+}
+
+// Creates a V4 signature packet over data.
+func (k *testKey) sign(t *testing.T, hashAlgo int, data []byte) []byte {
+	hashed := []byte{5,2,0x5E,0,0,1}
+	unhashed := []byte{9,16}
+	unhashed = append(unhashed,make([]byte,8)...)
+	binary.BigEndian.PutUint64(unhashed[2:],k.id)
+	
+	body := []byte{4,SigText,byte(k.algo),byte(hashAlgo),0,byte(len(hashed))}
+	body = append(body,hashed...)
+	trailer := append(append([]byte(nil),body...),4,0xFF,0,0,0,byte(len(body)))
+	body = append(body,0,byte(len(unhashed)))
+	body = append(body,unhashed...)
+	
+	var ch crypto.Hash
+	switch hashAlgo {
+	case 1: ch = crypto.MD5
+	case hashSHA1: ch = crypto.SHA1
+	default: ch = hashes[hashAlgo]
+	}
+	h := ch.New()
+	h.Write(data)
+	h.Write(trailer)
+	digest := h.Sum(nil)
+	body = append(body,digest[:2]...)
+	
+	switch priv := k.priv.(type) {
+	case ed25519.PrivateKey:
+		sig := ed25519.Sign(priv,digest)
+		body = append(append(body,mpi(sig[:32])...),mpi(sig[32:])...)
+	case *rsa.PrivateKey:
+		sig,err := rsa.SignPKCS1v15(rand.Reader,priv,ch,digest)
+		if err!=nil { t.Fatal(err) }
+		body = append(body,mpi(sig)...)
+	}
+	return newPacket(tagSignature,body)
+}
+
+// A keyring with a primary key, its user ID and optionally a subkey.
+func keyring(t *testing.T, primary *testKey, uid string, sub *testKey) *Keyring {
+	data := newPacket(tagPublicKey,primary.body)
+	data = append(data,oldPacket(tagUserId,[]byte(uid))...)
+	if sub!=nil { data = append(data,oldPacket(tagPublicSub,sub.body)...) }
+	kr := NewKeyring()
+	if err := kr.Add(armor("PUBLIC KEY BLOCK",data)); err!=nil { t.Fatal(err) }
+	return kr
+}
+
+const(
+	testHead = "Subject: cmsg newgroup misc.test\r\n"+
+		"Control: newgroup misc.test\r\n"+
+		"Message-ID: <ng-1@example.org>\r\n"+
+		"Approved: news@example.org\r\n"
+	testBody = "For your newsgroups file:\r\n"+
+		"misc.test   Testing.   \r\n"+
+		"..dot\r\n"
+	testSigned = "Subject,Control,Message-ID"
+	
+	// The text, that pgpverify passes to PGP.
+	testText = "X-Signed-Headers: Subject,Control,Message-ID\n"+
+		"Subject: cmsg newgroup misc.test\n"+
+		"Control: newgroup misc.test\n"+
+		"Message-ID: <ng-1@example.org>\n"+
+		"\n"+
+		"For your newsgroups file:\n"+
+		"misc.test   Testing.   \n"+
+		".dot\n"
+)
+
+// Returns the header of the test article, signed with the packet.
+func signedHeader(head string, sig []byte) *posting.Header {
+	b64 := base64.StdEncoding.EncodeToString(sig)
+	c := crc24(sig)
+	sum := base64.StdEncoding.EncodeToString([]byte{byte(c>>16),byte(c>>8),byte(c)})
+	f := "X-PGP-Sig: 1 "+testSigned
+	for len(b64)>0 {
+		n := 64
+		if n>len(b64) { n = len(b64) }
+		f += "\r\n\t"+b64[:n]
+		b64 = b64[n:]
+	}
+	f += "\r\n\t="+sum+"\r\n"
+	return posting.ParseHeader([]byte(head+f))
+}
+
+func TestSignedText(t *testing.T) {
+	h := signedHeader(testHead,[]byte("sig"))
+	text,sig,err := signedText(h,[]byte(testBody))
+	if err!=nil || string(text)!=testText || string(sig)!="sig" { t.Fatalf("%q %q %v",text,sig,err) }
+	text,_,_ = SignedText(h,[]byte(testBody))
+	if want := strings.Replace(strings.Replace(strings.TrimSuffix(testText,"\n"),"   \n","\n",-1),"\n","\r\n",-1); string(text)!=want {
+		t.Errorf("canonical text %q, want %q",text,want)
+	}
+	if _,_,err = SignedText(posting.ParseHeader([]byte(testHead)),nil); err!=ErrNoSignature { t.Error(err) }
+	if _,_,err = SignedText(posting.ParseHeader([]byte(testHead+"X-PGP-Sig: 1 Subject\r\n")),nil); err!=ErrMalformed { t.Error(err) }
+}
+
+func canonical() []byte {
+	text,_,_ := SignedText(signedHeader(testHead,nil),[]byte(testBody))
+	return text
+}
+
+func TestVerify(t *testing.T) {
+	ed,rs := newKey(t,AlgoEdDSA),newKey(t,AlgoRSA)
+	for _,k := range []*testKey{ed,rs} {
+		kr := keyring(t,k,"News Admin <news@example.org>",nil)
+		for _,ha := range []int{8,9,10,11} {
+			sig := k.sign(t,ha,canonical())
+			pk,err := kr.Verify(signedHeader(testHead,sig),[]byte(testBody))
+			if err!=nil { t.Errorf("algorithm %d, hash %d: %v",k.algo,ha,err); continue }
+			if !pk.Is("news@example.org") || !pk.Is("News Admin") || pk.Is("other") { t.Errorf("user IDs %v",pk.UserIds) }
+		}
+		sig := k.sign(t,8,canonical())
+		
+		// Changes to the signed fields or the body break the signature.
+		h := signedHeader(strings.Replace(testHead,"misc.test","misc.evil",-1),sig)
+		if _,err := kr.Verify(h,[]byte(testBody)); err!=ErrBadSignature { t.Errorf("changed header: %v",err) }
+		if _,err := kr.Verify(signedHeader(testHead,sig),[]byte(testBody+"more\r\n")); err!=ErrBadSignature { t.Errorf("changed body: %v",err) }
+		
+		// Unsigned fields do not matter.
+		if _,err := kr.Verify(signedHeader(testHead+"Path: a!b\r\n",sig),[]byte(testBody)); err!=nil { t.Errorf("unsigned field: %v",err) }
+		
+		// Other keys are not trusted.
+		if _,err := NewKeyring().Verify(signedHeader(testHead,sig),[]byte(testBody)); err!=ErrUnknownKey { t.Errorf("empty keyring: %v",err) }
+	}
+	
+	// The detached signature form, with the final line break, is accepted.
+	kr := keyring(t,ed,"news@example.org",nil)
+	sig := ed.sign(t,8,append(canonical(),'\r','\n'))
+	if _,err := kr.Verify(signedHeader(testHead,sig),[]byte(testBody)); err!=nil { t.Errorf("detached form: %v",err) }
+}
+
+func TestVerifyWeakHashes(t *testing.T) {
+	k := newKey(t,AlgoEdDSA)
+	kr := keyring(t,k,"news@example.org",nil)
+	h := signedHeader(testHead,k.sign(t,1,canonical()))
+	if _,err := kr.Verify(h,[]byte(testBody)); err!=ErrUnsupported { t.Errorf("MD5: %v",err) }
+	kr.AllowSHA1 = true
+	if _,err := kr.Verify(h,[]byte(testBody)); err!=ErrUnsupported { t.Errorf("MD5 with SHA-1 allowed: %v",err) }
+	
+	h = signedHeader(testHead,k.sign(t,hashSHA1,canonical()))
+	kr.AllowSHA1 = false
+	if _,err := kr.Verify(h,[]byte(testBody)); err!=ErrUnsupported { t.Errorf("SHA-1: %v",err) }
+	kr.AllowSHA1 = true
+	if _,err := kr.Verify(h,[]byte(testBody)); err!=nil { t.Errorf("SHA-1 allowed: %v",err) }
+}
+
+func TestVerifySubkey(t *testing.T) {
+	primary,sub := newKey(t,AlgoEdDSA),newKey(t,AlgoEdDSA)
+	kr := keyring(t,primary,"news@example.org",sub)
+	pk,err := kr.Verify(signedHeader(testHead,sub.sign(t,8,canonical())),[]byte(testBody))
+	if err!=nil { t.Fatal(err) }
+	if pk.KeyId!=primary.id { t.Errorf("signer %x, want the primary key %x",pk.KeyId,primary.id) }
+}
+
+/*
+Reports, whether two signature packets have the same meaning: the hashed data,
+the issuer and the signature values are equal. Unhashed flags and the bit counts
+of MPIs may differ.
+*/
+func sameSignature(a, b []byte) bool {
+	_,pa,_,err := readPacket(a)
+	if err!=nil { return false }
+	_,pb,_,err := readPacket(b)
+	if err!=nil { return false }
+	sa,err := parseSignature(pa)
+	if err!=nil { return false }
+	sb,err := parseSignature(pb)
+	if err!=nil { return false }
+	if string(sa.suffix)!=string(sb.suffix) || string(sa.left16)!=string(sb.left16) || sa.KeyId!=sb.KeyId { return false }
+	if len(sa.mpis)!=len(sb.mpis) { return false }
+	for i := range sa.mpis {
+		if bigInt(sa.mpis[i]).Cmp(bigInt(sb.mpis[i]))!=0 { return false }
+	}
+	return true
+}
+
+// Damaged signatures and keyrings are refused, without panicking.
+func TestCorruption(t *testing.T) {
+	k := newKey(t,AlgoEdDSA)
+	kr := keyring(t,k,"news@example.org",nil)
+	sig := k.sign(t,8,canonical())
+	for i := range sig {
+		for _,x := range []byte{0x01,0x80,0xFF} {
+			bad := append([]byte(nil),sig...)
+			bad[i] ^= x
+			_,err := kr.Verify(signedHeader(testHead,bad),[]byte(testBody))
+			if err==nil && !sameSignature(sig,bad) { t.Errorf("signature accepted with byte %d changed",i) }
+		}
+		if _,err := kr.Verify(signedHeader(testHead,sig[:i]),[]byte(testBody)); err==nil { t.Errorf("signature accepted, truncated to %d bytes",i) }
+	}
+	
+	data := append(newPacket(tagPublicKey,k.body),oldPacket(tagUserId,[]byte("news@example.org"))...)
+	for i := range data {
+		bad := append([]byte(nil),data...)
+		bad[i] ^= 0xFF
+		NewKeyring().Add(bad)
+		NewKeyring().Add(data[:i])
+	}
+}
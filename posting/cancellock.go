@@ -0,0 +1,162 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "bytes"
+import "crypto/hmac"
+import "crypto/sha1"
+import "crypto/sha256"
+import "crypto/sha512"
+import "encoding/base64"
+import "hash"
+
+// The hash algorithms for Cancel-Lock and Cancel-Key (RFC 8315, 3.2).
+var cancelHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+/*
+Generates Cancel-Lock and Cancel-Key values (RFC 8315).
+
+The key for an article is derived from a server secret, its Message-ID and the
+posting user, as recommended by RFC 8315, 4:
+
+	c-key = base64(HMAC(secret, message-id + user))
+*/
+type CancelLocker struct{
+	Secret []byte
+	
+	// The hash algorithm. Defaults to "sha256"; "sha1" is supported for
+	// compatibility.
+	Algorithm string
+}
+
+func (c *CancelLocker) alg() string {
+	if _,ok := cancelHashes[c.Algorithm]; ok { return c.Algorithm }
+	return "sha256"
+}
+
+// Returns the c-key-string for the article.
+func (c *CancelLocker) Key(id, user []byte) []byte {
+	m := hmac.New(cancelHashes[c.alg()],c.Secret)
+	m.Write(id)
+	m.Write(user)
+	return b64(m.Sum(nil))
+}
+
+// Returns the Cancel-Key element ("scheme:c-key-string") for the article.
+func (c *CancelLocker) KeyElement(id, user []byte) []byte {
+	return append([]byte(c.alg()+":"),c.Key(id,user)...)
+}
+
+// Returns the Cancel-Lock element ("scheme:c-lock-string") for the article.
+func (c *CancelLocker) LockElement(id, user []byte) []byte {
+	l,_ := LockFor(c.alg(),c.Key(id,user))
+	return append([]byte(c.alg()+":"),l...)
+}
+
+func b64(b []byte) []byte {
+	out := make([]byte,base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(out,b)
+	return out
+}
+
+/*
+Computes the c-lock-string for a c-key-string: the base64 encoded hash of
+the c-key-string. Returns false, if the algorithm is unknown.
+*/
+func LockFor(alg string, key []byte) ([]byte,bool) {
+	nh,ok := cancelHashes[alg]
+	if !ok { return nil,false }
+	h := nh()
+	h.Write(key)
+	return b64(h.Sum(nil)),true
+}
+
+// Splits a Cancel-Lock or Cancel-Key field into its elements.
+func cancelElements(v []byte) (algs, values [][]byte) {
+	for _,el := range bytes.Fields(v) {
+		i := bytes.IndexByte(el,':')
+		if i<1 { continue }
+		algs = append(algs,bytes.ToLower(el[:i]))
+		values = append(values,el[i+1:])
+	}
+	return
+}
+
+/*
+Checks the Cancel-Key field of a cancel or superseding article against the
+Cancel-Lock field of the target article (RFC 8315, 3.5).
+
+Locked reports, whether the target carries a Cancel-Lock field. If so, ok
+reports, whether one of the keys matches one of the locks. If the target is not
+locked, the decision is up to other means.
+*/
+func CheckCancelKey(h, target *Header) (locked, ok bool) {
+	var lalgs,locks [][]byte
+	for i := range target.Fields {
+		if !target.Fields[i].Is("Cancel-Lock") { continue }
+		a,l := cancelElements(target.Fields[i].Unfolded())
+		lalgs,locks = append(lalgs,a...),append(locks,l...)
+	}
+	if len(locks)==0 { return false,false }
+	for i := range h.Fields {
+		if !h.Fields[i].Is("Cancel-Key") { continue }
+		kalgs,keys := cancelElements(h.Fields[i].Unfolded())
+		for j,key := range keys {
+			want,known := LockFor(string(kalgs[j]),key)
+			if !known { continue }
+			for k,l := range locks {
+				if bytes.Equal(lalgs[k],kalgs[j]) && hmac.Equal(l,want) { return true,true }
+			}
+		}
+	}
+	return true,false
+}
+
+// Appends an element to a field, that holds a space separated list, or adds the field.
+func appendElement(h *Header, name string, el []byte) {
+	if i := h.Index(name); i>=0 {
+		f := &h.Fields[i]
+		f.Value = append(append(f.Value,' '),el...)
+		return
+	}
+	h.Add(name,el)
+}
+
+/*
+Returns the Message-ID of the article, that is cancelled or superseded by
+the header, or nil.
+*/
+func CancelTarget(h *Header) []byte {
+	if c := bytes.Fields(h.Get("Control")); len(c)>1 && eqFold(c[0],"cancel") { return c[1] }
+	if s := bytes.TrimSpace(h.Get("Supersedes")); len(s)>0 { return s }
+	return nil
+}
@@ -0,0 +1,216 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package posting
+
+import "bytes"
+import "hash/fnv"
+import "math"
+import "sort"
+import "sync"
+import "time"
+
+const empShards = 16
+
+/*
+A Filter against excessive multi-posting (EMP): It rejects articles, whose
+body has been seen more than Threshold times recently, regardless of the
+Message-ID and the newsgroups.
+
+Bodies are normalized before they are hashed: Quoted lines (starting with '>')
+are ignored, and so is all white space. Optionally, the body is broken into
+shingles (overlapping runs of words), so that bodies, which differ only in a
+few words, are still detected.
+
+The counts decay over time, with the given HalfLife. They are kept in a table
+of fixed size; if it is full, the entries with the lowest counts are replaced.
+Thus, the memory usage is bounded, no matter how many articles arrive.
+
+The filter is safe for concurrent use.
+*/
+type EMPFilter struct{
+	// Bodies seen more than Threshold times are rejected. Defaults to 10.
+	Threshold int
+	
+	// The time, after which a count has decayed to one half. Defaults to 1 hour.
+	HalfLife time.Duration
+	
+	// If positive, the body is broken into shingles of this many words.
+	// Otherwise, the normalized body is hashed as a whole.
+	Shingle int
+	
+	// The number of shingle hashes kept per body (the smallest ones). A body
+	// is rejected, if at least half of them exceed the Threshold. Defaults to 4.
+	Sketch int
+	
+	// Bodies with less normalized bytes are not counted. Defaults to 64.
+	MinLength int
+	
+	// The number of entries in the table. Defaults to 65536.
+	Size int
+	
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+	
+	once   sync.Once
+	shards [empShards]empShard
+}
+
+type empShard struct{
+	mu    sync.Mutex
+	slots []empSlot
+}
+type empSlot struct{
+	hash  uint64
+	count float64
+	stamp int64
+}
+
+// The number of consecutive slots searched for an entry.
+const empBucket = 8
+
+func (f *EMPFilter) init() {
+	n := f.Size
+	if n<=0 { n = 65536 }
+	n /= empShards
+	if n<empBucket { n = empBucket }
+	for i := range f.shards { f.shards[i].slots = make([]empSlot,n) }
+}
+
+func (f *EMPFilter) now() time.Time {
+	if f.Now!=nil { return f.Now() }
+	return time.Now()
+}
+
+/*
+Counts an occurrence of the hash and returns the decayed count, including this
+occurrence.
+*/
+func (f *EMPFilter) count(h uint64,now int64) float64 {
+	if h==0 { h = 1 }
+	hl := f.HalfLife
+	if hl<=0 { hl = time.Hour }
+	sh := &f.shards[h%empShards]
+	sh.mu.Lock(); defer sh.mu.Unlock()
+	n := uint64(len(sh.slots))
+	base := (h/empShards)%n
+	victim := -1
+	low := math.Inf(1)
+	for i := uint64(0); i<empBucket; i++ {
+		j := int((base+i)%n)
+		s := &sh.slots[j]
+		if s.hash==0 {
+			if victim<0 || low>0 { victim,low = j,0 }
+			continue
+		}
+		c := s.count*math.Exp2(-float64(now-s.stamp)/float64(hl))
+		if s.hash==h {
+			s.count,s.stamp = c+1,now
+			return s.count
+		}
+		if c<low { victim,low = j,c }
+	}
+	sh.slots[victim] = empSlot{h,1,now}
+	return 1
+}
+
+/*
+Splits the body into the words of the lines, that are not quoted. The body is
+expected in wire form (dot-stuffed). Also returns the total length of the words.
+*/
+func empWords(body []byte) (words [][]byte,n int) {
+	for len(body)>0 {
+		line := body
+		if i := bytes.IndexByte(body,'\n'); i>=0 {
+			line,body = body[:i],body[i+1:]
+		} else {
+			body = nil
+		}
+		if len(line)>0 && line[0]=='.' { line = line[1:] }
+		line = bytes.TrimLeft(line," \t")
+		if len(line)>0 && line[0]=='>' { continue }
+		for _,w := range bytes.Fields(line) {
+			words = append(words,w)
+			n += len(w)
+		}
+	}
+	return
+}
+
+func empHash(words [][]byte) uint64 {
+	h := fnv.New64a()
+	for _,w := range words {
+		h.Write(w)
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+/*
+Returns the fingerprints of a body (in wire form), or nil, if the body is
+shorter than MinLength.
+*/
+func (f *EMPFilter) Fingerprints(body []byte) []uint64 {
+	words,n := empWords(body)
+	min := f.MinLength
+	if min<=0 { min = 64 }
+	if n<min { return nil }
+	if f.Shingle<=0 || len(words)<=f.Shingle { return []uint64{empHash(words)} }
+	k := f.Sketch
+	if k<=0 { k = 4 }
+	sketch := make([]uint64,0,k+1)
+	for i := 0; i+f.Shingle<=len(words); i++ {
+		h := empHash(words[i:i+f.Shingle])
+		j := sort.Search(len(sketch),func(j int) bool { return sketch[j]>=h })
+		if j<len(sketch) && sketch[j]==h { continue }
+		if j>=k { continue }
+		sketch = append(sketch,0)
+		copy(sketch[j+1:],sketch[j:])
+		sketch[j] = h
+		if len(sketch)>k { sketch = sketch[:k] }
+	}
+	return sketch
+}
+
+/*
+Counts the body and returns true, if it has been seen more than Threshold times.
+*/
+func (f *EMPFilter) Seen(body []byte) bool {
+	f.once.Do(f.init)
+	fps := f.Fingerprints(body)
+	if len(fps)==0 { return false }
+	t := f.Threshold
+	if t<=0 { t = 10 }
+	now := f.now().UnixNano()
+	over := 0
+	for _,h := range fps {
+		if f.count(h,now)>float64(t) { over++ }
+	}
+	return over*2>=len(fps)
+}
+
+func (f *EMPFilter) FilterArticle(a *Article) (v Verdict,reason string) {
+	if f.Seen(a.Body) { return Reject,"EMP: duplicate body" }
+	return Accept,""
+}
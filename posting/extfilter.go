@@ -0,0 +1,324 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "bufio"
+import "errors"
+import "io"
+import "os"
+import "os/exec"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+var ErrFilterRestart = errors.New("filter process was restarted too recently")
+var ErrFilterProtocol = errors.New("filter process sent an invalid response")
+
+/*
+A Filter (and IdFilter), that runs a long-lived external program, which is
+started on the first request and restarted whenever it crashes, misbehaves or
+exceeds the Timeout. The program reads requests from its standard input and
+answers each of them on its standard output, one at a time. To serve requests
+in parallel, several instances of the program can be run (see Procs).
+
+A request consists of LF-terminated lines. The first line is "article post"
+(for POSTed articles), "article relay" (for IHAVE and TAKETHIS) or "check"
+(the pre-transfer stage of CHECK and IHAVE). It is followed by the lines
+"Id: <message-id>", "Peer: <address>" and "User: <name>", each of them only if
+known. For articles, a line "Header: <n>" follows, then n bytes: the header in
+wire form. If the body is sent, a line "Body: <n>" follows, then n bytes: the
+body (or a prefix of it) in wire form. Every request ends with a line ".".
+
+The response consists of zero or more header edits, followed by a verdict line:
+
+	add <Name>: <value>   appends a header field
+	set <Name>: <value>   replaces the header field
+	del <Name>            removes the header field
+	accept
+	reject <reason>
+	defer <reason>
+
+Edits are ignored for "check" requests, and for the fields Message-ID, Path and
+Injection-*, which identify and trace the article. A minimal filter in Python:
+
+	import sys
+	r = sys.stdin.buffer
+	while True:
+		kind = r.readline()
+		if not kind: break
+		head = b""
+		for line in iter(r.readline, b".\n"):
+			k,_,v = line.partition(b": ")
+			if k in (b"Header",b"Body"): data = r.read(int(v))
+			if k==b"Header": head = data
+		sys.stdout.write("reject Spam\n" if b"viagra" in head.lower() else "accept\n")
+		sys.stdout.flush()
+
+If the program can not be reached or answers invalidly or too late, the
+verdict is Defer, or Accept if FailOpen is set.
+*/
+type ExternalFilter struct{
+	// The program and its arguments.
+	Path string
+	Args []string
+	
+	// The environment and working directory of the program. See os/exec.Cmd.
+	Env  []string
+	Dir  string
+	
+	// Receives the standard error output of the program. If nil, it is discarded.
+	Stderr io.Writer
+	
+	// Sends the body of the articles as well. If MaxBody is positive, only
+	// the first MaxBody bytes are sent.
+	SendBody bool
+	MaxBody  int
+	
+	// Passes the pre-transfer stage (FilterId) to the program as well.
+	// Otherwise, FilterId accepts every Message-ID.
+	CheckIds bool
+	
+	// The time, the program has for a request. Defaults to 5 seconds.
+	Timeout time.Duration
+	
+	// The minimum interval between two starts of the program, to avoid
+	// respawning a crashing program over and over. Defaults to 1 second.
+	RestartDelay time.Duration
+	
+	// If true, articles are accepted if the program fails.
+	FailOpen bool
+	
+	// The number of instances of the program, each serving one request at a
+	// time. Defaults to 1. It must be set before the first request.
+	Procs int
+	
+	once  sync.Once
+	procs []*filterProc
+	idle  chan *filterProc
+}
+
+// An instance of the program.
+type filterProc struct{
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   *os.File
+	stdout  *os.File
+	rd      *bufio.Reader
+	started time.Time
+}
+
+const maxFilterEdits = 64
+
+func (f *ExternalFilter) init() {
+	n := f.Procs
+	if n<1 { n = 1 }
+	f.idle = make(chan *filterProc,n)
+	for i := 0; i<n; i++ {
+		p := new(filterProc)
+		f.procs = append(f.procs,p)
+		f.idle <- p
+	}
+}
+
+func (f *ExternalFilter) start(p *filterProc) error {
+	if p.cmd!=nil { return nil }
+	d := f.RestartDelay
+	if d==0 { d = time.Second }
+	now := time.Now()
+	if !p.started.IsZero() && now.Sub(p.started)<d { return ErrFilterRestart }
+	p.started = now
+	
+	inR,inW,err := os.Pipe()
+	if err!=nil { return err }
+	outR,outW,err := os.Pipe()
+	if err!=nil { inR.Close(); inW.Close(); return err }
+	cmd := exec.Command(f.Path,f.Args...)
+	cmd.Env = f.Env
+	cmd.Dir = f.Dir
+	cmd.Stdin = inR
+	cmd.Stdout = outW
+	cmd.Stderr = f.Stderr
+	err = cmd.Start()
+	inR.Close()
+	outW.Close()
+	if err!=nil { inW.Close(); outR.Close(); return err }
+	p.cmd,p.stdin,p.stdout = cmd,inW,outR
+	p.rd = bufio.NewReader(outR)
+	return nil
+}
+
+// Kills the program. It is started again with the next request.
+func (p *filterProc) stop() {
+	if p.cmd==nil { return }
+	p.stdin.Close()
+	p.stdout.Close()
+	p.cmd.Process.Kill()
+	go p.cmd.Wait()
+	p.cmd,p.stdin,p.stdout,p.rd = nil,nil,nil,nil
+}
+
+// Terminates the instances of the program, that are running.
+func (f *ExternalFilter) Close() error {
+	f.once.Do(f.init)
+	for _,p := range f.procs {
+		p.mu.Lock()
+		p.stop()
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+/*
+Sends a request to an idle instance and reads the response lines, up to and
+including the verdict line. On any error, the instance is stopped.
+*/
+func (f *ExternalFilter) exchange(req []byte) (lines []string,err error) {
+	f.once.Do(f.init)
+	p := <-f.idle
+	defer func() { f.idle <- p }()
+	p.mu.Lock(); defer p.mu.Unlock()
+	if err = f.start(p); err!=nil { return }
+	t := f.Timeout
+	if t==0 { t = 5*time.Second }
+	dl := time.Now().Add(t)
+	p.stdin.SetWriteDeadline(dl)
+	p.stdout.SetReadDeadline(dl)
+	if _,err = p.stdin.Write(req); err!=nil { p.stop(); return }
+	for {
+		var line string
+		line,err = p.rd.ReadString('\n')
+		if err!=nil { p.stop(); return nil,err }
+		line = strings.TrimRight(line,"\r\n")
+		lines = append(lines,line)
+		switch filterWord(line) {
+		case "accept","reject","defer": return
+		case "add","set","del":
+			if len(lines)<=maxFilterEdits { continue }
+		}
+		p.stop()
+		return nil,ErrFilterProtocol
+	}
+}
+
+func filterWord(line string) string {
+	if i := strings.IndexByte(line,' '); i>=0 { line = line[:i] }
+	return strings.ToLower(line)
+}
+
+func (f *ExternalFilter) failed() (Verdict,string) {
+	if f.FailOpen { return Accept,"" }
+	return Defer,"Filter unavailable"
+}
+
+func appendFilterMeta(buf []byte,id []byte,s *fastnntp.Session) []byte {
+	if len(id)>0 { buf = append(append(append(buf,"Id: "...),id...),'\n') }
+	if s==nil { return buf }
+	if s.RemoteAddr!=nil { buf = append(append(append(buf,"Peer: "...),s.RemoteAddr.String()...),'\n') }
+	if len(s.User)>0 { buf = append(append(append(buf,"User: "...),s.User...),'\n') }
+	return buf
+}
+func appendFilterData(buf []byte,name string,data []byte) []byte {
+	buf = append(append(buf,name...),": "...)
+	buf = strconv.AppendInt(buf,int64(len(data)),10)
+	return append(append(buf,'\n'),data...)
+}
+
+// Parses the verdict line.
+func parseVerdict(line string) (v Verdict,reason string) {
+	if i := strings.IndexByte(line,' '); i>=0 { reason = strings.TrimSpace(line[i+1:]) }
+	switch filterWord(line) {
+	case "reject":
+		v = Reject
+		if reason=="" { reason = "Rejected by filter" }
+	case "defer":
+		v = Defer
+		if reason=="" { reason = "Deferred by filter" }
+	default:
+		v,reason = Accept,""
+	}
+	return
+}
+
+// Returns true, if the filter may not edit the field.
+func filterReadOnly(name string) bool {
+	name = strings.ToLower(name)
+	return name=="message-id" || name=="path" || strings.HasPrefix(name,"injection-")
+}
+
+// Applies an "add", "set" or "del" line to the header.
+func applyFilterEdit(h *Header,line string) {
+	i := strings.IndexByte(line,' ')
+	if i<0 { return }
+	op,arg := filterWord(line),strings.TrimSpace(line[i+1:])
+	if op=="del" {
+		if !filterReadOnly(arg) { h.Del(arg) }
+		return
+	}
+	j := strings.IndexByte(arg,':')
+	if j<1 || strings.ContainsAny(arg[:j]," \t") { return }
+	name,value := arg[:j],strings.TrimSpace(arg[j+1:])
+	if filterReadOnly(name) { return }
+	if op=="add" {
+		h.Add(name,[]byte(value))
+	} else {
+		h.Set(name,[]byte(value))
+	}
+}
+
+func (f *ExternalFilter) FilterArticle(a *Article) (v Verdict,reason string) {
+	buf := make([]byte,0,512+len(a.Body))
+	if a.Posted() {
+		buf = append(buf,"article post\n"...)
+	} else {
+		buf = append(buf,"article relay\n"...)
+	}
+	buf = appendFilterMeta(buf,a.MessageId(),a.Session)
+	buf = appendFilterData(buf,"Header",a.Header.Bytes())
+	if f.SendBody {
+		body := a.Body
+		if f.MaxBody>0 { body = a.BodyPrefix(f.MaxBody) }
+		buf = appendFilterData(buf,"Body",body)
+	}
+	buf = append(buf,".\n"...)
+	lines,err := f.exchange(buf)
+	if err!=nil { return f.failed() }
+	for _,line := range lines[:len(lines)-1] { applyFilterEdit(a.Header,line) }
+	return parseVerdict(lines[len(lines)-1])
+}
+
+func (f *ExternalFilter) FilterId(id []byte, s *fastnntp.Session) Verdict {
+	if !f.CheckIds { return Accept }
+	buf := appendFilterMeta([]byte("check\n"),id,s)
+	buf = append(buf,".\n"...)
+	lines,err := f.exchange(buf)
+	if err!=nil {
+		v,_ := f.failed()
+		return v
+	}
+	v,_ := parseVerdict(lines[len(lines)-1])
+	return v
+}
@@ -0,0 +1,205 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "bufio"
+import "fmt"
+import "io"
+import "net"
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+/*
+The test binary doubles as the filter program: with FILTER_HELPER set in the
+environment, it runs the helper of that name instead of the tests.
+*/
+func TestMain(m *testing.M) {
+	if mode := os.Getenv("FILTER_HELPER"); mode!="" {
+		filterHelper(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Reads one request. Returns the kind, the meta lines and the data blocks.
+func readFilterRequest(r *bufio.Reader) (kind string, meta map[string]string, data map[string]string, ok bool) {
+	kind,err := r.ReadString('\n')
+	if err!=nil { return }
+	meta,data = make(map[string]string),make(map[string]string)
+	for {
+		line,err := r.ReadString('\n')
+		if err!=nil { return }
+		line = strings.TrimSuffix(line,"\n")
+		if line=="." { break }
+		i := strings.Index(line,": ")
+		if i<0 { return }
+		k,v := line[:i],line[i+2:]
+		if k=="Header" || k=="Body" {
+			n,_ := strconv.Atoi(v)
+			b := make([]byte,n)
+			if _,err = io.ReadFull(r,b); err!=nil { return }
+			data[k] = string(b)
+			continue
+		}
+		meta[k] = v
+	}
+	return strings.TrimSuffix(kind,"\n"),meta,data,true
+}
+
+func filterHelper(mode string) {
+	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+	for {
+		kind,meta,data,ok := readFilterRequest(r)
+		if !ok { return }
+		switch mode {
+		case "crash": os.Exit(1)
+		case "slow": time.Sleep(time.Minute)
+		case "garbage": fmt.Fprintf(w,"hello\n")
+		case "pid":
+			time.Sleep(300*time.Millisecond)
+			fmt.Fprintf(w,"add X-Pid: %d\naccept\n",os.Getpid())
+		case "edit":
+			if kind=="check" {
+				if strings.Contains(meta["Id"],"bad") { fmt.Fprintf(w,"reject\n") } else { fmt.Fprintf(w,"accept\n") }
+				break
+			}
+			fmt.Fprintf(w,"add X-Kind: %s\n",kind)
+			fmt.Fprintf(w,"add X-Meta: %s|%s|%s\n",meta["Id"],meta["Peer"],meta["User"])
+			if b,ok := data["Body"]; ok { fmt.Fprintf(w,"add X-Body: %d\n",len(b)) }
+			fmt.Fprintf(w,"set Subject: filtered\ndel Organization\n")
+			fmt.Fprintf(w,"set Message-ID: <evil@x>\ndel Path\nadd Injection-Info: evil\nset injection-date: evil\n")
+			switch {
+			case strings.Contains(data["Header"],"spam"): fmt.Fprintf(w,"reject Spam detected\n")
+			case strings.Contains(data["Header"],"later"): fmt.Fprintf(w,"defer\n")
+			default: fmt.Fprintf(w,"accept\n")
+			}
+		}
+		w.Flush()
+	}
+}
+
+func helperFilter(mode string) *ExternalFilter {
+	return &ExternalFilter{
+		Path: os.Args[0],
+		Env: append(os.Environ(),"FILTER_HELPER="+mode),
+		Timeout: 2*time.Second,
+		RestartDelay: time.Millisecond,
+	}
+}
+
+func filterArticle(id, head string) *Article {
+	h := ParseHeader([]byte("Message-ID: "+id+"\r\nPath: a!b\r\nInjection-Date: now\r\nOrganization: x\r\n"+head))
+	return &Article{Id:[]byte(id),Header:h,Body:[]byte("0123456789\r\n")}
+}
+
+func TestExternalFilter(t *testing.T) {
+	f := helperFilter("edit")
+	f.SendBody,f.MaxBody,f.CheckIds = true,4,true
+	defer f.Close()
+	
+	a := filterArticle("<1@x>","Subject: test\r\n")
+	a.Session = &fastnntp.Session{RemoteAddr:&net.TCPAddr{IP:net.IPv4(192,0,2,1),Port:119},User:[]byte("joe")}
+	if v,reason := f.FilterArticle(a); v!=Accept || reason!="" { t.Fatalf("verdict %v %q",v,reason) }
+	h := a.Header
+	for name,want := range map[string]string{
+		"X-Kind":"article relay",
+		"X-Meta":"<1@x>|192.0.2.1:119|joe",
+		"X-Body":"4",
+		"Subject":"filtered",
+		"Organization":"",
+		// Read-only fields.
+		"Message-ID":"<1@x>",
+		"Path":"a!b",
+		"Injection-Date":"now",
+		"Injection-Info":"",
+	} {
+		if got := string(h.Get(name)); got!=want { t.Errorf("%s: %q, want %q",name,got,want) }
+	}
+	
+	a = filterArticle("<2@x>","Subject: spam\r\n")
+	a.Id = nil
+	if v,reason := f.FilterArticle(a); v!=Reject || reason!="Spam detected" { t.Errorf("verdict %v %q",v,reason) }
+	if string(a.Header.Get("X-Kind"))!="article post" { t.Errorf("kind %q",a.Header.Get("X-Kind")) }
+	if v,reason := f.FilterArticle(filterArticle("<3@x>","Subject: later\r\n")); v!=Defer || reason=="" { t.Errorf("verdict %v %q",v,reason) }
+	
+	if f.FilterId([]byte("<good@x>"),nil)!=Accept || f.FilterId([]byte("<bad@x>"),nil)!=Reject { t.Error("FilterId") }
+	f.CheckIds = false
+	if f.FilterId([]byte("<bad@x>"),nil)!=Accept { t.Error("FilterId without CheckIds") }
+}
+
+func TestExternalFilterFailures(t *testing.T) {
+	for _,mode := range []string{"crash","slow","garbage"} {
+		f := helperFilter(mode)
+		f.Timeout = 200*time.Millisecond
+		for i := 0; i<2; i++ {
+			if v,_ := f.FilterArticle(filterArticle("<1@x>","Subject: test\r\n")); v!=Defer { t.Errorf("%s: verdict %v",mode,v) }
+		}
+		f.FailOpen = true
+		if v,_ := f.FilterArticle(filterArticle("<1@x>","Subject: test\r\n")); v!=Accept { t.Errorf("%s, FailOpen: verdict %v",mode,v) }
+		f.Close()
+	}
+	
+	// A program, that can not be started.
+	f := &ExternalFilter{Path:"/nonexistent/filter"}
+	if v,_ := f.FilterArticle(filterArticle("<1@x>","")); v!=Defer { t.Errorf("missing program: verdict %v",v) }
+	
+	// A crashing program is not restarted within the RestartDelay.
+	f = helperFilter("crash")
+	f.RestartDelay = time.Hour
+	f.FilterArticle(filterArticle("<1@x>",""))
+	if _,err := f.exchange([]byte("check\n.\n")); err!=ErrFilterRestart { t.Errorf("restart: %v",err) }
+	f.Close()
+}
+
+func TestExternalFilterPool(t *testing.T) {
+	f := helperFilter("pid")
+	f.Procs = 4
+	defer f.Close()
+	var lock sync.Mutex
+	pids := make(map[string]bool)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i<8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := filterArticle("<1@x>","")
+			if v,_ := f.FilterArticle(a); v!=Accept { t.Errorf("verdict %v",v) }
+			lock.Lock()
+			pids[string(a.Header.Get("X-Pid"))] = true
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(pids)!=4 { t.Errorf("%d processes used, want 4",len(pids)) }
+	
+	// Eight requests of 300ms each take 2.4s in sequence, and 600ms on four processes.
+	if d := time.Since(start); d>1500*time.Millisecond { t.Errorf("requests were not served in parallel: %v",d) }
+}
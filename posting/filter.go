@@ -0,0 +1,112 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+
+// The result of a filter.
+type Verdict int
+
+const(
+	// The article is passed on to the next filter.
+	Accept Verdict = iota
+	
+	// The article is refused for good (437 for IHAVE, 439 for TAKETHIS,
+	// 435 or 438 for the pre-transfer stage).
+	Reject
+	
+	// The article is refused for now; the peer may try again later (436 for
+	// IHAVE, 431 for TAKETHIS and CHECK).
+	Defer
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Accept: return "accept"
+	case Reject: return "reject"
+	case Defer: return "defer"
+	}
+	return "unknown"
+}
+
+/*
+A filter for incoming articles. It is called for articles received by POST,
+IHAVE and TAKETHIS, after they have been parsed (and, for POST, injected), and
+before they are stored. The Article provides the Message-ID, the header, the
+body and the session.
+
+A filter may rewrite the header. The reason is sent to the client, where the
+response permits it.
+*/
+type Filter interface{
+	FilterArticle(a *Article) (v Verdict, reason string)
+}
+
+/*
+A filter for the pre-transfer stage (CHECK and IHAVE), that sees only the
+Message-ID and the session.
+*/
+type IdFilter interface{
+	FilterId(id []byte, s *fastnntp.Session) Verdict
+}
+
+// A Go function as Filter.
+type FilterFunc func(a *Article) (v Verdict, reason string)
+
+func (f FilterFunc) FilterArticle(a *Article) (v Verdict, reason string) { return f(a) }
+
+// A Go function as IdFilter.
+type IdFilterFunc func(id []byte, s *fastnntp.Session) Verdict
+
+func (f IdFilterFunc) FilterId(id []byte, s *fastnntp.Session) Verdict { return f(id,s) }
+
+/*
+A sequence of filters. The first verdict, that is not Accept, is final.
+*/
+type FilterChain []Filter
+
+func (c FilterChain) FilterArticle(a *Article) (v Verdict, reason string) {
+	for _,f := range c {
+		if v,reason = f.FilterArticle(a); v!=Accept { return }
+	}
+	return Accept,""
+}
+
+// A sequence of IdFilters. The first verdict, that is not Accept, is final.
+type IdFilterChain []IdFilter
+
+func (c IdFilterChain) FilterId(id []byte, s *fastnntp.Session) Verdict {
+	for _,f := range c {
+		if v := f.FilterId(id,s); v!=Accept { return v }
+	}
+	return Accept
+}
+
+// Returns the first n bytes of the body (or less, if it is shorter).
+func (a *Article) BodyPrefix(n int) []byte {
+	if len(a.Body)<n { return a.Body }
+	return a.Body[:n]
+}
@@ -0,0 +1,220 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "bytes"
+import "io"
+
+var crlfB = []byte("\r\n")
+
+/*
+A single header field.
+
+The Value is the raw field body as found in the article: Everything after the
+colon and the white space following it, up to (not including) the final CRLF.
+Folding is preserved, so a folded field contains "\r\n" followed by white space.
+*/
+type HeaderField struct{
+	Name  []byte
+	Value []byte
+	
+	// Set, if the line could not be parsed as a header field. In this case,
+	// the Name holds the entire line, and the field is ignored by lookups.
+	Malformed bool
+}
+
+// Returns true, if the field has the given name (case insensitive).
+func (f *HeaderField) Is(name string) bool {
+	return !f.Malformed && eqFold(f.Name,name)
+}
+
+// Returns the unfolded field body, with the line breaks replaced by single spaces.
+func (f *HeaderField) Unfolded() []byte {
+	return singleLineB(f.Value)
+}
+
+func (f *HeaderField) appendTo(buf []byte) []byte {
+	buf = append(buf,f.Name...)
+	if f.Malformed { return append(buf,crlfB...) }
+	buf = append(buf,':')
+	if len(f.Value)>0 && f.Value[0]!='\r' { buf = append(buf,' ') }
+	buf = append(buf,f.Value...)
+	return append(buf,crlfB...)
+}
+
+/*
+An ordered collection of header fields.
+
+All lookups are case insensitive. A field name may occur multiple times.
+The order of the fields is retained when the header is serialized again.
+*/
+type Header struct{
+	Fields []HeaderField
+}
+
+func eqFold(a []byte,b string) bool {
+	if len(a)!=len(b) { return false }
+	for i,c := range a {
+		if toLower(c)!=toLower(b[i]) { return false }
+	}
+	return true
+}
+
+/*
+Parses a header, as returned by ConsumePostedArticle. Both CRLF and LF line
+endings are accepted. Empty lines are skipped.
+*/
+func ParseHeader(head []byte) *Header {
+	h := new(Header)
+	for _,el := range bytes.SplitAfter(head,lineFeed) {
+		el = trimCRLF(el)
+		if len(el)==0 { continue }
+		switch el[0] {
+		case ' ','\t':
+			if n := len(h.Fields); n>0 && !h.Fields[n-1].Malformed {
+				f := &h.Fields[n-1]
+				f.Value = append(append(f.Value,crlfB...),el...)
+				continue
+			}
+		}
+		h.Fields = append(h.Fields,parseField(el))
+	}
+	return h
+}
+func parseField(line []byte) HeaderField {
+	i := bytes.IndexByte(line,':')
+	if i<1 || bytes.IndexAny(line[:i]," \t")>=0 {
+		return HeaderField{Name:cloneB(line),Malformed:true}
+	}
+	v := line[i+1:]
+	for len(v)>0 && (v[0]==' ' || v[0]=='\t') { v = v[1:] }
+	return HeaderField{Name:cloneB(line[:i]),Value:cloneB(v)}
+}
+
+// Returns the index of the first field with the given name, or -1.
+func (h *Header) Index(name string) int {
+	for i := range h.Fields {
+		if h.Fields[i].Is(name) { return i }
+	}
+	return -1
+}
+
+// Returns true, if the header contains at least one field with the given name.
+func (h *Header) Has(name string) bool { return h.Index(name)>=0 }
+
+// Returns the number of fields with the given name.
+func (h *Header) Count(name string) (n int) {
+	for i := range h.Fields {
+		if h.Fields[i].Is(name) { n++ }
+	}
+	return
+}
+
+// Returns the raw (folded) value of the first field with the given name, or nil.
+func (h *Header) GetRaw(name string) []byte {
+	i := h.Index(name)
+	if i<0 { return nil }
+	return h.Fields[i].Value
+}
+
+// Returns the unfolded value of the first field with the given name, or nil.
+func (h *Header) Get(name string) []byte {
+	i := h.Index(name)
+	if i<0 { return nil }
+	return h.Fields[i].Unfolded()
+}
+
+// Returns the unfolded values of all fields with the given name, in order.
+func (h *Header) Values(name string) (vals [][]byte) {
+	for i := range h.Fields {
+		if h.Fields[i].Is(name) { vals = append(vals,h.Fields[i].Unfolded()) }
+	}
+	return
+}
+
+// Appends a field at the end of the header.
+func (h *Header) Add(name string,value []byte) {
+	h.Fields = append(h.Fields,HeaderField{Name:[]byte(name),Value:value})
+}
+
+// Inserts a field at the beginning of the header.
+func (h *Header) Prepend(name string,value []byte) {
+	h.Fields = append(h.Fields,HeaderField{})
+	copy(h.Fields[1:],h.Fields)
+	h.Fields[0] = HeaderField{Name:[]byte(name),Value:value}
+}
+
+/*
+Replaces the value of the first field with the given name and removes all other
+fields with this name. If there is no such field, it is appended.
+*/
+func (h *Header) Set(name string,value []byte) {
+	i := h.Index(name)
+	if i<0 { h.Add(name,value); return }
+	h.Fields[i].Value = value
+	h.delFrom(name,i+1)
+}
+
+// Removes all fields with the given name. Returns the number of removed fields.
+func (h *Header) Del(name string) int { return h.delFrom(name,0) }
+
+func (h *Header) delFrom(name string,start int) int {
+	j := start
+	for i := start; i<len(h.Fields); i++ {
+		if h.Fields[i].Is(name) { continue }
+		h.Fields[j] = h.Fields[i]
+		j++
+	}
+	n := len(h.Fields)-j
+	for i := j; i<len(h.Fields); i++ { h.Fields[i] = HeaderField{} }
+	h.Fields = h.Fields[:j]
+	return n
+}
+
+// Appends the header in wire form (CRLF line endings, no empty line at the end) to buf.
+func (h *Header) AppendTo(buf []byte) []byte {
+	for i := range h.Fields {
+		buf = h.Fields[i].appendTo(buf)
+	}
+	return buf
+}
+
+// Returns the header in wire form.
+func (h *Header) Bytes() []byte { return h.AppendTo(nil) }
+
+// Writes the header in wire form to w.
+func (h *Header) WriteTo(w io.Writer) (int64,error) {
+	buf := make([]byte,0,256)
+	var n int64
+	for i := range h.Fields {
+		buf = h.Fields[i].appendTo(buf[:0])
+		m,e := w.Write(buf)
+		n += int64(m)
+		if e!=nil { return n,e }
+	}
+	return n,nil
+}
+
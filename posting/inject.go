@@ -0,0 +1,209 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "net"
+import "os"
+import "sync"
+import "time"
+
+const dateFormat = "Mon, 02 Jan 2006 15:04:05 -0700"
+
+/*
+Fields, that are removed from articles submitted by POST, because they
+may only be added by the injecting agent (RFC 5537, 3.5).
+*/
+var injectionFields = []string{
+	"Injection-Date","Injection-Info","Xref",
+	"NNTP-Posting-Host","NNTP-Posting-Date","X-Trace","X-Complaints-To",
+}
+
+/*
+The injection step for articles submitted by POST (RFC 5537, 3.5).
+
+The zero value is usable.
+*/
+type Injector struct{
+	// If set, the posting-host parameter of the Injection-Info field is
+	// replaced by a keyed hash of the client address.
+	HashPostingHost bool
+	
+	// The key for HashPostingHost.
+	HashSecret []byte
+	
+	// If set, the client address is appended to the ".POSTED" path marker.
+	// Ignored, if HashPostingHost is set.
+	PostedSource bool
+	
+	// If not empty, it is added as mail-complaints-to parameter.
+	ComplaintsTo string
+	
+	// If not nil, a Cancel-Lock element is added to every article of an
+	// authenticated user. If the article cancels or supersedes another one, a
+	// matching Cancel-Key element is added. Anonymous posters share no identity,
+	// that the key could be bound to, so their articles get neither.
+	CancelLock *CancelLocker
+	
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (inj *Injector) now() time.Time {
+	if inj.Now!=nil { return inj.Now() }
+	return time.Now()
+}
+
+func hostOf(a net.Addr) string {
+	switch v := a.(type) {
+	case *net.TCPAddr: return v.IP.String()
+	case *net.UDPAddr: return v.IP.String()
+	}
+	h,_,err := net.SplitHostPort(a.String())
+	if err!=nil { return a.String() }
+	return h
+}
+
+var hostStamperOnce sync.Once
+var hostStamperVal Stamper
+
+// Returns a CounterStamper named after the host.
+func hostStamper() Stamper {
+	hostStamperOnce.Do(func() {
+		host,_ := os.Hostname()
+		if host=="" { host = "localhost" }
+		hostStamperVal = NewCounterStamper(host)
+	})
+	return hostStamperVal
+}
+
+// Returns the posting-host of the session, or "", if unknown.
+func (inj *Injector) postingHost(s *fastnntp.Session) string {
+	if s==nil || s.RemoteAddr==nil { return "" }
+	h := hostOf(s.RemoteAddr)
+	if !inj.HashPostingHost { return h }
+	m := hmac.New(sha256.New,inj.HashSecret)
+	m.Write([]byte(h))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+func appendParam(buf []byte,name,value string) []byte {
+	buf = append(buf,";\r\n\t"...)
+	buf = append(buf,name...)
+	buf = append(buf,`="`...)
+	for i := 0; i<len(value); i++ {
+		switch value[i] {
+		case '"','\\': buf = append(buf,'\\')
+		}
+		buf = append(buf,value[i])
+	}
+	return append(buf,'"')
+}
+
+/*
+Performs the injection on the header of a POSTed article:
+
+Fields, that only the injecting agent may add (Injection-Date, Injection-Info,
+Xref and the like), are removed. Date and Message-ID are added, if missing,
+Injection-Date and Injection-Info are added, and the path identity followed by
+the ".POSTED" marker is prepended to the Path. If configured, Cancel-Lock and
+Cancel-Key elements are added.
+
+The Stamper provides the path identity and the Message-ID. If it is a
+ContentStamper, the Message-ID is derived from the article. If it is nil, a
+CounterStamper named after the host is used.
+*/
+func (inj *Injector) Inject(a *Article, st Stamper) {
+	if st==nil { st = hostStamper() }
+	inj.identify(a,st)
+	inj.trace(a,st)
+}
+
+/*
+The first part of the injection: The fields, that only the injecting agent may
+add, are removed, and Date and Message-ID are added. Articles for moderators are
+forwarded after this part (RFC 5537, 3.5, step 8).
+*/
+func (inj *Injector) identify(a *Article, st Stamper) {
+	h := a.Header
+	for _,f := range injectionFields { h.Del(f) }
+	CanonicalizeHeader(h)
+	
+	now := inj.now().UTC()
+	date := now.AppendFormat(nil,dateFormat)
+	if !h.Has("Date") { h.Add("Date",date) }
+	if !h.Has("Message-ID") {
+		var id []byte
+		if cs,ok := st.(ContentStamper); ok {
+			id = cs.GetIdFor(nil,h,a.Body)
+		} else {
+			id = st.GetId(nil)
+		}
+		if len(id)>0 { h.Add("Message-ID",id) }
+	}
+}
+
+// The second part of the injection: Cancel-Lock, Path and the Injection fields.
+func (inj *Injector) trace(a *Article, st Stamper) {
+	h,s := a.Header,a.Session
+	if inj.CancelLock!=nil && s!=nil && len(s.User)>0 {
+		user := s.User
+		if id := h.Get("Message-ID"); len(id)>0 {
+			appendElement(h,"Cancel-Lock",inj.CancelLock.LockElement(id,user))
+		}
+		if t := CancelTarget(h); len(t)>0 {
+			appendElement(h,"Cancel-Key",inj.CancelLock.KeyElement(t,user))
+		}
+	}
+	
+	host := inj.postingHost(s)
+	
+	seg := st.PathSeg(nil)
+	if len(seg)>0 {
+		seg = append(seg,".POSTED"...)
+		if inj.PostedSource && !inj.HashPostingHost && host!="" {
+			seg = append(append(seg,'.'),host...)
+		}
+		seg = append(seg,'!')
+		if !h.Has("Path") { h.Add("Path",[]byte("not-for-mail")) }
+		prependPath(h,seg)
+	}
+	
+	h.Add("Injection-Date",inj.now().UTC().AppendFormat(nil,dateFormat))
+	
+	// Injection-Info: path-identity *( ";" parameter )
+	info := st.PathSeg(nil)
+	if len(info)==0 { return }
+	info = info[:len(info)-1]
+	if host!="" { info = appendParam(info,"posting-host",host) }
+	if s!=nil && len(s.User)>0 { info = appendParam(info,"posting-account",string(s.User)) }
+	if inj.ComplaintsTo!="" { info = appendParam(info,"mail-complaints-to",inj.ComplaintsTo) }
+	h.Add("Injection-Info",info)
+}
+
@@ -0,0 +1,216 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "bytes"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "time"
+
+var ErrNoModerator = errors.New("posting: no moderator known")
+var ErrBadGroupDir = errors.New("posting: group name not usable as a directory name")
+
+/*
+Reports the status of groups, as in the active file: 'y' (posting permitted),
+'n' (posting not permitted) or 'm' (moderated). Implemented by the article storage.
+*/
+type ActiveSource interface{
+	GroupStatus(group []byte) (status byte, ok bool)
+}
+
+/*
+Forwards an article to the moderator of a group.
+*/
+type Submitter interface{
+	Submit(group []byte, a *Article) error
+}
+
+// A Go function as Submitter.
+type SubmitFunc func(group []byte, a *Article) error
+
+func (f SubmitFunc) Submit(group []byte, a *Article) error { return f(group,a) }
+
+/*
+The moderation step of a Pipeline (RFC 5537, 3.5.1).
+
+A POSTed article for a moderated group, that has no Approved field, is not
+injected, but forwarded to the moderator of the first moderated group in its
+Newsgroups field. Within a Pipeline, Date and Message-ID have been added by
+then. Approved articles are injected, if the user may approve for
+all moderated groups of the article.
+*/
+type Moderation struct{
+	Groups ActiveSource
+	
+	// Receives the articles for moderators.
+	Submitter Submitter
+	
+	// Decides, whether the user of a session may approve articles for a moderated
+	// group. If nil, Approved fields of POSTed articles are not accepted.
+	MayApprove func(s *fastnntp.Session, group []byte) bool
+	
+	// If set, relayed articles for moderated groups without an Approved field
+	// are rejected.
+	CheckRelayed bool
+}
+
+// Returns the moderated groups of the article, in the order of its Newsgroups field.
+func (m *Moderation) moderated(h *Header) (groups [][]byte) {
+	for _,g := range SplitNewsgroups(h.Get("Newsgroups")) {
+		if st,ok := m.Groups.GroupStatus(g); ok && st=='m' { groups = append(groups,g) }
+	}
+	return
+}
+
+/*
+Applies the moderation rules. If done is set, the article has been handled
+(forwarded or rejected), and must not be stored.
+*/
+func (m *Moderation) Process(a *Article) (done, rejected, failed bool, reason string) {
+	mod := m.moderated(a.Header)
+	if len(mod)==0 { return }
+	approved := len(bytes.TrimSpace(a.Header.Get("Approved")))>0
+	if !a.Posted() {
+		if m.CheckRelayed && !approved { return true,true,false,"Unapproved for "+string(mod[0]) }
+		return
+	}
+	if approved {
+		for _,g := range mod {
+			if m.MayApprove==nil || !m.MayApprove(a.Session,g) {
+				return true,true,false,"Not permitted to approve for "+string(g)
+			}
+		}
+		return
+	}
+	if m.Submitter==nil { return true,false,true,"Cannot forward to moderator" }
+	if err := m.Submitter.Submit(mod[0],a); err!=nil { return true,false,true,"Cannot forward to moderator" }
+	return true,false,false,""
+}
+
+/*
+Returns the address of the moderator, following the convention of INN's
+moderators file: If the pattern contains "%s", it is replaced by the group
+name with dots replaced by dashes.
+*/
+func ModeratorAddress(pattern string, group []byte) string {
+	if !strings.Contains(pattern,"%s") { return pattern }
+	return strings.Replace(pattern,"%s",strings.Replace(string(group),".","-",-1),1)
+}
+
+// Writes a file atomically through a temporary file in dir.
+func writeQueued(dir, name string, data []byte) error {
+	f,err := ioutil.TempFile(dir,".tmp")
+	if err!=nil { return err }
+	_,err = f.Write(data)
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	if err==nil { err = os.Rename(f.Name(),filepath.Join(dir,name)) }
+	if err!=nil { os.Remove(f.Name()) }
+	return err
+}
+
+func queueName(a *Article) string {
+	return fmt.Sprintf("%d.%x",time.Now().UnixNano(),hashName(a.MessageId()))
+}
+
+func hashName(b []byte) (h uint32) {
+	h = 2166136261
+	for _,c := range b { h = (h^uint32(c))*16777619 }
+	return
+}
+
+/*
+A Submitter, that writes mail messages for the moderators into a queue
+directory, one file per message, to be delivered by a mailer. Each file
+starts with the envelope recipient on a line "To-Envelope: <address>",
+followed by the message.
+*/
+type MailQueue struct{
+	Dir string
+	
+	// Explicit moderator addresses by group.
+	Moderators map[string]string
+	
+	// The address pattern for other groups (see ModeratorAddress),
+	// like "%s@moderators.example.org".
+	Pattern string
+}
+
+func (q *MailQueue) address(group []byte) string {
+	if a,ok := q.Moderators[string(group)]; ok { return a }
+	if q.Pattern=="" { return "" }
+	return ModeratorAddress(q.Pattern,group)
+}
+
+func (q *MailQueue) Submit(group []byte, a *Article) error {
+	to := q.address(group)
+	if to=="" { return ErrNoModerator }
+	h := &Header{Fields:append([]HeaderField(nil),a.Header.Fields...)}
+	h.Del("To")
+	h.Prepend("To",[]byte(to))
+	buf := append([]byte("To-Envelope: "+to+"\r\n"),h.AppendTo(nil)...)
+	buf = append(buf,crlfB...)
+	buf = append(buf,unstuffBody(a.Body)...)
+	return writeQueued(q.Dir,queueName(a),buf)
+}
+
+// Removes the dot-stuffing from a body in wire form.
+func unstuffBody(body []byte) []byte {
+	out := make([]byte,0,len(body))
+	for len(body)>0 {
+		i := bytes.IndexByte(body,'\n')
+		line := body
+		if i>=0 { line,body = body[:i+1],body[i+1:] } else { body = nil }
+		if len(line)>1 && line[0]=='.' && line[1]=='.' { line = line[1:] }
+		out = append(out,line...)
+	}
+	return out
+}
+
+/*
+A Submitter, that stores the articles in a directory per group, in wire form,
+for moderation tools, that work on files. Slashes and backslashes in group
+names are replaced by '_'; names, that are empty, start with a dot or contain
+control characters, are refused with ErrBadGroupDir.
+*/
+type SpoolSubmitter struct{
+	Dir string
+}
+
+func (s *SpoolSubmitter) Submit(group []byte, a *Article) error {
+	if len(group)==0 || group[0]=='.' { return ErrBadGroupDir }
+	for _,c := range group {
+		if c<0x20 || c==0x7f { return ErrBadGroupDir }
+	}
+	dir := filepath.Join(s.Dir,strings.NewReplacer("/","_","\\","_").Replace(string(group)))
+	if err := os.MkdirAll(dir,0755); err!=nil { return err }
+	return writeQueued(dir,queueName(a),a.Bytes())
+}
@@ -0,0 +1,49 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func TestSpoolSubmitter(t *testing.T) {
+	dir,err := ioutil.TempDir("","moderation")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	s := &SpoolSubmitter{Dir:filepath.Join(dir,"queue")}
+	a := &Article{Header:ParseHeader([]byte("Message-ID: <1@x>\r\nSubject: test\r\n")),Body:[]byte("body\r\n")}
+	for _,g := range []string{"misc.test","a/../b","a\\b","misc..test"} {
+		if err := s.Submit([]byte(g),a); err!=nil { t.Errorf("%q: %v",g,err) }
+	}
+	for _,g := range []string{"","..",".hidden","../x","a\x00b","a\nb","a\x7f"} {
+		if err := s.Submit([]byte(g),a); err!=ErrBadGroupDir { t.Errorf("%q: %v, want ErrBadGroupDir",g,err) }
+	}
+	names,_ := filepath.Glob(filepath.Join(dir,"*"))
+	if len(names)!=1 { t.Errorf("files outside the queue: %q",names) }
+	names,_ = filepath.Glob(filepath.Join(dir,"queue","*","*"))
+	if len(names)!=4 { t.Errorf("queued: %q",names) }
+}
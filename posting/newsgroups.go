@@ -0,0 +1,155 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "bytes"
+import "fmt"
+import "sync"
+import "time"
+
+// What a NewsgroupsChecker does with groups, that do not exist.
+type UnknownGroups int
+
+const(
+	UnknownReject UnknownGroups = iota // Reject the article.
+	UnknownDrop                        // Remove them from the Newsgroups field.
+	UnknownKeep                        // Keep them, if at least one group exists.
+)
+
+/*
+Checks the Newsgroups and Followup-To fields of POSTed articles against the
+existing groups. Violations are reported with a reason, that is sent to the
+client with the 441 response.
+*/
+type NewsgroupsChecker struct{
+	Groups ActiveSource
+	
+	Unknown UnknownGroups
+	
+	// The maximum number of groups in Newsgroups. If 0, there is no limit.
+	MaxCrosspost int
+	
+	// The maximum number of groups in Followup-To. If 0, there is no limit.
+	MaxFollowupTo int
+}
+
+/*
+Checks the article. If UnknownDrop is configured, unknown groups are removed
+from the Newsgroups field. Returns a reason, if the article must be rejected,
+or "".
+*/
+func (c *NewsgroupsChecker) Check(a *Article) string {
+	ngs := SplitNewsgroups(a.Header.Get("Newsgroups"))
+	if len(ngs)==0 { return "No newsgroups given" }
+	if c.MaxCrosspost>0 && len(ngs)>c.MaxCrosspost {
+		return fmt.Sprintf("Too many newsgroups (%d, at most %d allowed)",len(ngs),c.MaxCrosspost)
+	}
+	if c.MaxFollowupTo>0 {
+		if fs := SplitNewsgroups(a.Header.Get("Followup-To")); len(fs)>c.MaxFollowupTo {
+			return fmt.Sprintf("Too many groups in Followup-To (%d, at most %d allowed)",len(fs),c.MaxFollowupTo)
+		}
+	}
+	var known [][]byte
+	exist := 0
+	for _,g := range ngs {
+		st,ok := c.Groups.GroupStatus(g)
+		switch {
+		case !ok:
+			if c.Unknown==UnknownReject { return "No such newsgroup: "+string(g) }
+			if c.Unknown==UnknownKeep { known = append(known,g) }
+			continue
+		case st=='n':
+			return "Posting not permitted to "+string(g)
+		case st=='x':
+			return "Newsgroup "+string(g)+" does not accept articles"
+		}
+		known = append(known,g)
+		exist++
+	}
+	if exist==0 { return "No valid newsgroups given" }
+	if len(known)<len(ngs) { a.Header.Set("Newsgroups",bytes.Join(known,[]byte(","))) }
+	return ""
+}
+
+/*
+An ActiveSource on top of the Caps of a fastnntp.Handler. The status is taken
+from the GroupListingCaps; if they are nil, groups found by the GroupCaps have
+status 'y'.
+
+The GroupListingCaps list all groups at once, so the list is kept for MaxAge,
+instead of being listed again for every group of every article.
+*/
+type CapsActiveSource struct{
+	fastnntp.GroupCaps
+	fastnntp.GroupListingCaps
+	
+	// How long the list of groups is kept. Groups, that are created meanwhile,
+	// are unknown until it is listed again. Defaults to 10 seconds.
+	MaxAge time.Duration
+	
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+	
+	mu     sync.Mutex
+	status map[string]byte
+	listed time.Time
+}
+
+const defaultActiveMaxAge = 10*time.Second
+
+// Collects the status of all groups.
+type activeCapture map[string]byte
+
+func (m activeCapture) GetListActiveMode() fastnntp.ListActiveMode { return fastnntp.LAM_Active }
+func (m activeCapture) WriteActive(group []byte, high, low int64, status byte) error {
+	m[string(group)] = status
+	return nil
+}
+func (m activeCapture) WriteNewsgroups(group []byte, description []byte) error { return nil }
+func (m activeCapture) WriteFullInfo(group []byte, high, low int64, status byte, description []byte) error {
+	return m.WriteActive(group,high,low,status)
+}
+
+func (c *CapsActiveSource) GroupStatus(group []byte) (status byte, ok bool) {
+	if c.GroupListingCaps!=nil {
+		now := time.Now()
+		if c.Now!=nil { now = c.Now() }
+		maxAge := c.MaxAge
+		if maxAge<=0 { maxAge = defaultActiveMaxAge }
+		c.mu.Lock(); defer c.mu.Unlock()
+		if c.status==nil || now.Sub(c.listed)>=maxAge || now.Before(c.listed) {
+			m := make(activeCapture)
+			c.GroupListingCaps.ListGroups(nil,m)
+			c.status,c.listed = m,now
+		}
+		status,ok = c.status[string(group)]
+		return
+	}
+	if c.GroupCaps==nil { return 0,false }
+	if !c.GroupCaps.GetGroup(&fastnntp.Group{Group:group}) { return 0,false }
+	return 'y',true
+}
@@ -0,0 +1,61 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "testing"
+import "time"
+
+// Lists a fixed set of groups and counts the listings.
+type testListing struct{
+	groups map[string]byte
+	calls  int
+}
+
+func (l *testListing) ListGroups(wm *fastnntp.WildMat, ila fastnntp.IListActive) bool {
+	l.calls++
+	for g,st := range l.groups { ila.WriteActive([]byte(g),1,1,st) }
+	return true
+}
+
+func TestCapsActiveSource(t *testing.T) {
+	clock := time.Unix(1600000000,0)
+	l := &testListing{groups:map[string]byte{"misc.test":'y',"misc.ro":'n',"misc.mod":'m'}}
+	src := &CapsActiveSource{GroupListingCaps:l,Now:func() time.Time { return clock }}
+	c := &NewsgroupsChecker{Groups:src,Unknown:UnknownDrop}
+	a := &Article{Header:ParseHeader([]byte("Newsgroups: misc.test,misc.mod,misc.none,misc.test\r\n"))}
+	if r := c.Check(a); r!="" { t.Fatal(r) }
+	if ng := string(a.Header.Get("Newsgroups")); ng!="misc.test,misc.mod,misc.test" { t.Errorf("Newsgroups: %s",ng) }
+	if l.calls!=1 { t.Errorf("%d listings for one article, want 1",l.calls) }
+	
+	// The list is kept for MaxAge.
+	l.groups["misc.none"] = 'y'
+	if _,ok := src.GroupStatus([]byte("misc.none")); ok { t.Error("new group known before MaxAge") }
+	clock = clock.Add(defaultActiveMaxAge)
+	if st,ok := src.GroupStatus([]byte("misc.none")); !ok || st!='y' { t.Error("new group unknown after MaxAge") }
+	if st,_ := src.GroupStatus([]byte("misc.ro")); st!='n' { t.Errorf("status %c",st) }
+	if l.calls!=2 { t.Errorf("%d listings, want 2",l.calls) }
+}
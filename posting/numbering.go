@@ -0,0 +1,180 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "bytes"
+import "errors"
+import "strconv"
+import "sync"
+
+var(
+	ErrNoXref  = errors.New("posting: no usable Xref field")
+	ErrNoGroup = errors.New("posting: no known group")
+)
+
+/*
+Reports the high water marks of groups. Implemented by the article storage.
+*/
+type NumberSource interface{
+	GroupHigh(group []byte) (high int64, ok bool)
+}
+
+/*
+The article numbers of an article in its groups.
+*/
+type Numbering struct{
+	Groups  []string
+	Numbers []int64
+}
+
+// Returns the number of the article in the group, or 0.
+func (n *Numbering) Number(group string) int64 {
+	for i,g := range n.Groups {
+		if g==group { return n.Numbers[i] }
+	}
+	return 0
+}
+
+// Renders the body of an Xref field: "host group:num ...".
+func (n *Numbering) Xref(host string) []byte {
+	b := []byte(host)
+	for i,g := range n.Groups {
+		b = append(append(b,' '),g...)
+		b = strconv.AppendInt(append(b,':'),n.Numbers[i],10)
+	}
+	return b
+}
+
+/*
+Parses the body of an Xref field.
+*/
+func ParseXref(v []byte) (host string, n *Numbering) {
+	fs := bytes.Fields(v)
+	if len(fs)==0 { return "",nil }
+	n = new(Numbering)
+	for _,f := range fs[1:] {
+		i := bytes.LastIndexByte(f,':')
+		if i<1 { continue }
+		num,err := strconv.ParseInt(string(f[i+1:]),10,64)
+		if err!=nil || num<1 { continue }
+		n.Groups = append(n.Groups,string(f[:i]))
+		n.Numbers = append(n.Numbers,num)
+	}
+	return string(fs[0]),n
+}
+
+/*
+Assigns article numbers. The numbers of all groups of an article are assigned
+atomically, so that concurrent crossposts get consistent numbers.
+
+The high water marks are taken from the Source, when a group is used for the
+first time. After that, the Numberer must be the only one to assign numbers in
+the group.
+*/
+type Numberer struct{
+	// The host name in the Xref field.
+	Host string
+	
+	Source NumberSource
+	
+	// Slave mode: the numbers of relayed articles are taken from their Xref field,
+	// as assigned by the master server.
+	Slave bool
+	
+	lock sync.Mutex
+	high map[string]int64
+}
+
+func NewNumberer(host string, src NumberSource) *Numberer {
+	return &Numberer{Host:host,Source:src}
+}
+
+// Must be called with lock held.
+func (n *Numberer) highOf(group []byte) (int64,bool) {
+	if n.high==nil { n.high = make(map[string]int64) }
+	if h,ok := n.high[string(group)]; ok { return h,true }
+	h,ok := n.Source.GroupHigh(group)
+	if ok { n.high[string(group)] = h }
+	return h,ok
+}
+
+/*
+Assigns the next number in every known group of the list. Duplicates and
+unknown groups are skipped.
+*/
+func (n *Numberer) Assign(groups [][]byte) *Numbering {
+	nb := new(Numbering)
+	n.lock.Lock(); defer n.lock.Unlock()
+	outer:
+	for _,g := range groups {
+		for _,o := range nb.Groups {
+			if o==string(g) { continue outer }
+		}
+		h,ok := n.highOf(g)
+		if !ok { continue }
+		h++
+		n.high[string(g)] = h
+		nb.Groups = append(nb.Groups,string(g))
+		nb.Numbers = append(nb.Numbers,h)
+	}
+	return nb
+}
+
+/*
+Takes over numbers assigned elsewhere. The high water marks are raised, where
+necessary. Unknown groups are dropped from the result.
+*/
+func (n *Numberer) Adopt(nb *Numbering) *Numbering {
+	r := new(Numbering)
+	n.lock.Lock(); defer n.lock.Unlock()
+	for i,g := range nb.Groups {
+		h,ok := n.highOf([]byte(g))
+		if !ok { continue }
+		if nb.Numbers[i]>h { n.high[g] = nb.Numbers[i] }
+		r.Groups = append(r.Groups,g)
+		r.Numbers = append(r.Numbers,nb.Numbers[i])
+	}
+	return r
+}
+
+/*
+Numbers an article and replaces its Xref field. In slave mode, the numbers of
+relayed articles are taken from their Xref field.
+*/
+func (n *Numberer) Number(a *Article) (*Numbering,error) {
+	var nb *Numbering
+	if n.Slave && !a.Posted() {
+		_,x := ParseXref(a.Header.Get("Xref"))
+		if x==nil || len(x.Groups)==0 { return nil,ErrNoXref }
+		nb = n.Adopt(x)
+	} else {
+		nb = n.Assign(SplitNewsgroups(a.Header.Get("Newsgroups")))
+	}
+	if len(nb.Groups)==0 { return nil,ErrNoGroup }
+	a.Header.Del("Xref")
+	a.Header.Add("Xref",nb.Xref(n.Host))
+	return nb,nil
+}
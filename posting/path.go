@@ -0,0 +1,213 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "sync"
+
+/*
+An element of the Path field (RFC 5536, 3.1.5).
+
+Diagnostic elements are the path-diagnostics of RFC 5537: An empty one stands
+for the "!!" marker (the source has been verified), others start with a dot
+(".POSTED", ".SEEN.<source>", ".MISMATCH.<source>"). The non-standard "!?"
+marker, written by some implementations, is treated as a diagnostic as well.
+*/
+type PathElement struct{
+	Text       []byte
+	Diagnostic bool
+}
+
+func isPathDiag(seg []byte) bool {
+	if len(seg)==0 { return true }
+	switch seg[0] {
+	case '.','?': return true
+	}
+	return false
+}
+
+/*
+Splits the (unfolded) value of a Path field into its elements, left to right.
+The tail-entry is the last element.
+*/
+func ParsePath(path []byte) (elems []PathElement) {
+	path = trimWSBack(trimWS(path))
+	start := 0
+	for i := 0; i<=len(path); i++ {
+		if i<len(path) && path[i]!='!' { continue }
+		seg := trimWSBack(trimWS(path[start:i]))
+		elems = append(elems,PathElement{seg,isPathDiag(seg)})
+		start = i+1
+	}
+	return
+}
+
+/*
+Returns the path identities of a Path field, left to right, without
+diagnostics and without the tail-entry.
+*/
+func PathIdentities(path []byte) (ids [][]byte) {
+	elems := ParsePath(path)
+	if len(elems)>0 { elems = elems[:len(elems)-1] }
+	for _,e := range elems {
+		if !e.Diagnostic { ids = append(ids,e.Text) }
+	}
+	return
+}
+
+func eqFoldB(a,b []byte) bool {
+	if len(a)!=len(b) { return false }
+	for i,c := range a {
+		if toLower(c)!=toLower(b[i]) { return false }
+	}
+	return true
+}
+
+// The path identity of a server, along with its aliases.
+type PathIdentity struct{
+	Name    string
+	Aliases []string
+}
+
+// Returns true, if the given identity is ours.
+func (p *PathIdentity) Is(id []byte) bool {
+	if eqFold(id,p.Name) { return true }
+	for _,a := range p.Aliases {
+		if eqFold(id,a) { return true }
+	}
+	return false
+}
+
+// Returns true, if the (unfolded) Path contains our identity or an alias.
+func (p *PathIdentity) Contains(path []byte) bool {
+	for _,id := range PathIdentities(path) {
+		if p.Is(id) { return true }
+	}
+	return false
+}
+
+/*
+Appends the segment, that is prepended to the Path of an article when relaying it
+(RFC 5537, 3.2.1).
+
+If expected is the path identity, the peer is expected to use, the segment
+includes the "!!" marker if the leftmost identity of the Path matches it, and
+".MISMATCH.<source>" otherwise. If the expected identity is unknown but the source
+is, ".SEEN.<source>" is recorded. The source is the peer's address.
+*/
+func (p *PathIdentity) AppendSegment(buf, path []byte, expected, source string) []byte {
+	buf = append(append(buf,p.Name...),'!')
+	ids := PathIdentities(path)
+	switch {
+	case expected!="":
+		if len(ids)>0 && eqFold(ids[0],expected) { return append(buf,'!') }
+		if source=="" { source = expected }
+		buf = append(buf,".MISMATCH."...)
+	case source!="":
+		buf = append(buf,".SEEN."...)
+	default:
+		return buf
+	}
+	buf = append(buf,source...)
+	return append(buf,'!')
+}
+
+/*
+Path handling for relayed articles (IHAVE and TAKETHIS).
+*/
+type PathPolicy struct{
+	// Our path identity and its aliases.
+	PathIdentity
+	
+	// Returns the path identity, the peer of the session is expected to use,
+	// or "" if unknown. May be nil.
+	PeerIdentity func(s *fastnntp.Session) string
+	
+	// If set, the source of an article is recorded with path-diagnostics.
+	Diagnostics bool
+	
+	// If set, articles, whose Path contains our identity or an alias, are rejected.
+	RejectLoops bool
+	
+	// The number of Message-IDs of looping articles to remember, in order to
+	// refuse them, when they are offered again with CHECK or IHAVE. Defaults to 1024.
+	Remember int
+	
+	lock  sync.Mutex
+	seen  map[string]struct{}
+	ring  []string
+	pos   int
+}
+
+func (p *PathPolicy) remember(id []byte) {
+	p.lock.Lock(); defer p.lock.Unlock()
+	if p.seen==nil {
+		n := p.Remember
+		if n<=0 { n = 1024 }
+		p.seen = make(map[string]struct{},n)
+		p.ring = make([]string,n)
+	}
+	if _,ok := p.seen[string(id)]; ok { return }
+	delete(p.seen,p.ring[p.pos])
+	p.ring[p.pos] = string(id)
+	p.seen[p.ring[p.pos]] = struct{}{}
+	p.pos = (p.pos+1)%len(p.ring)
+}
+
+// Returns true, if the Message-ID belongs to an article, that has been rejected as a loop.
+func (p *PathPolicy) Looped(id []byte) bool {
+	p.lock.Lock(); defer p.lock.Unlock()
+	_,ok := p.seen[string(id)]
+	return ok
+}
+
+/*
+Processes the Path of a relayed article. Returns false, if the article must be
+rejected, because it already passed this server. Otherwise, our segment is
+prepended to the Path.
+*/
+func (p *PathPolicy) Process(a *Article) bool {
+	i := a.Header.Index("Path")
+	var path []byte
+	if i>=0 { path = a.Header.Fields[i].Unfolded() }
+	if p.RejectLoops && p.Contains(path) {
+		p.remember(a.MessageId())
+		return false
+	}
+	expected,source := "",""
+	if p.Diagnostics && a.Session!=nil {
+		if p.PeerIdentity!=nil { expected = p.PeerIdentity(a.Session) }
+		if a.Session.RemoteAddr!=nil { source = hostOf(a.Session.RemoteAddr) }
+	}
+	seg := p.AppendSegment(nil,path,expected,source)
+	if i<0 {
+		a.Header.Add("Path",append(seg,"not-for-mail"...))
+	} else {
+		a.Header.Fields[i].Value = append(seg,a.Header.Fields[i].Value...)
+	}
+	return true
+}
+
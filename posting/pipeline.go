@@ -0,0 +1,262 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "bytes"
+import "io"
+import "sync"
+
+// An article passing through a Pipeline.
+type Article struct{
+	// The Message-ID given by IHAVE or TAKETHIS. Nil for POST.
+	Id      []byte
+	
+	// The client session. May be nil.
+	Session *fastnntp.Session
+	
+	Header  *Header
+	
+	// The body in wire form (dot-stuffed), without the terminating dot-line.
+	Body    []byte
+	
+	// The article numbers, if assigned by the Pipeline. The Store must use them.
+	Numbers *Numbering
+}
+
+// Returns true, if the article was submitted by POST.
+func (a *Article) Posted() bool { return len(a.Id)==0 }
+
+// Returns the Message-ID of the article.
+func (a *Article) MessageId() []byte {
+	if h := a.Header.Get("Message-ID"); len(h)>0 { return h }
+	return a.Id
+}
+
+// Returns the article in wire form (dot-stuffed), without the terminating dot-line.
+func (a *Article) Bytes() []byte {
+	buf := a.Header.AppendTo(make([]byte,0,256+len(a.Body)))
+	buf = append(buf,crlfB...)
+	return append(buf,a.Body...)
+}
+
+// Writes the article in wire form, without the terminating dot-line.
+func (a *Article) WriteTo(w io.Writer) (int64,error) {
+	n,e := a.Header.WriteTo(w)
+	if e!=nil { return n,e }
+	m,e := w.Write(crlfB)
+	n += int64(m)
+	if e!=nil { return n,e }
+	m,e = w.Write(a.Body)
+	return n+int64(m),e
+}
+
+/*
+The storage behind a Pipeline.
+*/
+type Store interface{
+	CheckPostId(id []byte) (wanted bool, possible bool)
+	CheckPost() (possible bool)
+	StoreArticle(a *Article) (rejected bool,failed bool)
+}
+
+/*
+A Pipeline implements fastnntp.PostingCaps. It parses incoming articles,
+performs the injection on POSTed articles, updates the Path of relayed
+ones, optionally validates them and finally hands them over to the Store.
+
+It also implements fastnntp.SessionPostingCaps, fastnntp.SessionCheckCaps and
+fastnntp.SessionCheckPostCaps.
+*/
+type Pipeline struct{
+	Store Store
+	
+	// Provides the path identity and the Message-IDs for POSTed articles. If
+	// nil, a CounterStamper is used, named after the Path policy or the host.
+	Stamper Stamper
+	
+	// The injection step for POSTed articles. If nil, a default is used.
+	Injector *Injector
+	
+	// If not nil, articles are validated before they are stored.
+	Validator *Validator
+	
+	// If not nil, it handles the Path of relayed articles, in place of the Stamper.
+	Path *PathPolicy
+	
+	// Applied to every article before it is stored. Nil, if not used.
+	Filter Filter
+	
+	// Applied to the Message-IDs offered by CHECK and IHAVE. Nil, if not used.
+	IdFilter IdFilter
+	
+	// If not nil, the newsgroups of POSTed articles are checked.
+	Newsgroups *NewsgroupsChecker
+	
+	// If not nil, article numbers are assigned, and the Xref field is added.
+	Numbers *Numberer
+	
+	// If not nil, POSTs are limited per user and per remote address.
+	Quota *Quota
+	
+	// If not nil, articles for moderated groups are handled by it. POSTed
+	// articles reach it with Date and Message-ID, before Path and Injection-Info.
+	Moderation *Moderation
+	
+	// If not nil, it acts on control messages and superseding articles, after
+	// they have been stored.
+	Control ControlProcessor
+	
+	once       sync.Once
+	defStamper Stamper
+}
+
+// Returns the Stamper, or the default one, if none is configured.
+func (p *Pipeline) stamper() Stamper {
+	if p.Stamper!=nil { return p.Stamper }
+	p.once.Do(func() {
+		if p.Path!=nil && p.Path.Name!="" {
+			p.defStamper = NewCounterStamper(p.Path.Name)
+		} else {
+			p.defStamper = hostStamper()
+		}
+	})
+	return p.defStamper
+}
+
+/*
+Acts on control messages (articles with a Control field) and on articles with
+a Supersedes field. See package control.
+*/
+type ControlProcessor interface{
+	ProcessControl(a *Article)
+}
+
+var defaultInjector Injector
+
+func (p *Pipeline) CheckPostId(id []byte) (wanted bool, possible bool) {
+	return p.CheckPostIdSession(id,nil)
+}
+func (p *Pipeline) CheckPostIdSession(id []byte, s *fastnntp.Session) (wanted bool, possible bool) {
+	if p.IdFilter!=nil {
+		switch p.IdFilter.FilterId(id,s) {
+		case Reject: return false,true
+		case Defer: return true,false
+		}
+	}
+	if p.Path!=nil && p.Path.Looped(id) { return false,true }
+	return p.Store.CheckPostId(id)
+}
+func (p *Pipeline) CheckPost() (possible bool) {
+	return p.Store.CheckPost()
+}
+func (p *Pipeline) CheckPostSession(s *fastnntp.Session) (possible bool, reason string) {
+	if p.Quota!=nil {
+		if reason = p.Quota.Allow(s); reason!="" { return false,reason }
+	}
+	return p.Store.CheckPost(),""
+}
+func (p *Pipeline) PerformPost(id []byte, r *fastnntp.DotReader) (rejected bool,failed bool) {
+	rejected,failed,_ = p.PerformPostSession(id,r,nil)
+	return
+}
+func (p *Pipeline) PerformPostSession(id []byte, r *fastnntp.DotReader, s *fastnntp.Session) (rejected bool,failed bool,reason string) {
+	head,body := ConsumePostedArticle(r)
+	return p.Process(&Article{Id:id,Session:s,Header:ParseHeader(head),Body:body})
+}
+
+/*
+Processes an already parsed article. This is the part of PerformPostSession
+after the article has been read.
+*/
+func (p *Pipeline) Process(a *Article) (rejected bool,failed bool,reason string) {
+	if p.Quota!=nil && a.Posted() {
+		var res *QuotaReservation
+		if res,reason = p.Quota.Reserve(a); reason!="" { return true,false,reason }
+		defer func() {
+			if !rejected && !failed {
+				res.Commit()
+			} else {
+				res.Cancel()
+			}
+		}()
+	}
+	if p.Newsgroups!=nil && a.Posted() {
+		if reason = p.Newsgroups.Check(a); reason!="" { return true,false,reason }
+	}
+	inj := p.Injector
+	if inj==nil { inj = &defaultInjector }
+	if a.Posted() {
+		// Submissions to moderators must carry Date and Message-ID.
+		inj.identify(a,p.stamper())
+	}
+	if p.Moderation!=nil {
+		var done bool
+		if done,rejected,failed,reason = p.Moderation.Process(a); done { return }
+	}
+	if a.Posted() {
+		inj.trace(a,p.stamper())
+	} else {
+		if !bytes.Equal(a.Header.Get("Message-ID"),a.Id) { return true,false,"Message-ID mismatch" }
+		CanonicalizeHeader(a.Header)
+		if p.Path==nil {
+			prependPath(a.Header,p.stamper().PathSeg(nil))
+		} else if !p.Path.Process(a) {
+			return true,false,"Article already passed this server"
+		}
+	}
+	if p.Validator!=nil {
+		if rs := p.Validator.Validate(a.Header,a.Body,true); len(rs)>0 {
+			return true,false,rs[0].Error()
+		}
+	}
+	if p.Filter!=nil {
+		switch v,r := p.Filter.FilterArticle(a); v {
+		case Reject: return true,false,r
+		case Defer: return false,true,r
+		}
+	}
+	if p.Numbers!=nil {
+		nb,err := p.Numbers.Number(a)
+		if err!=nil { return true,false,err.Error() }
+		a.Numbers = nb
+	}
+	rejected,failed = p.Store.StoreArticle(a)
+	if !rejected && !failed && p.Control!=nil && (a.Header.Has("Control") || a.Header.Has("Supersedes")) {
+		p.Control.ProcessControl(a)
+	}
+	return
+}
+
+func prependPath(h *Header,seg []byte) {
+	if len(seg)==0 { return }
+	if i := h.Index("Path"); i>=0 {
+		h.Fields[i].Value = append(seg,h.Fields[i].Value...)
+	} else {
+		h.Add("Path",seg[:len(seg)-1])
+	}
+}
+
@@ -143,84 +143,79 @@ var headerCase = map[string][]byte {
 	"from"      : []byte("From"),
 	"date"      : []byte("Date"),
 	"references": []byte("References"),
+	"path"      : []byte("Path"),
+	"xref"      : []byte("Xref"),
+	"injection-info": []byte("Injection-Info"),
+	"injection-date": []byte("Injection-Date"),
+	"supersedes": []byte("Supersedes"),
+	"control"   : []byte("Control"),
+	"approved"  : []byte("Approved"),
+	"followup-to": []byte("Followup-To"),
+	"organization": []byte("Organization"),
+	"expires"   : []byte("Expires"),
+	"distribution": []byte("Distribution"),
+}
+
+// Rewrites the names of well-known header fields into their canonical case.
+func CanonicalizeHeader(h *Header) {
+	name := make([]byte,0,25)
+	for i := range h.Fields {
+		f := &h.Fields[i]
+		if f.Malformed { continue }
+		name = append(name[:0],f.Name...)
+		aToLower(name)
+		if c,ok := headerCase[string(name)]; ok { f.Name = c }
+	}
 }
 
-
 func ParseAndProcessHeader(id []byte, s Stamper, head []byte) (hi *HeadInfo) {
 	return ParseAndProcessHeaderWithBuffer(id,s,head,new(bytes.Buffer))
 }
 
 func ParseAndProcessHeaderWithBuffer(id []byte, s Stamper, head []byte, dest_buffer *bytes.Buffer) (hi *HeadInfo) {
+	h := ParseHeader(head)
+	hi = ProcessHeader(id,s,h)
+	if hi==nil { return }
+	h.WriteTo(dest_buffer)
+	hi.RAW = dest_buffer.Bytes()
+	return
+}
+
+/*
+Like ParseAndProcessHeader, but operates on an already parsed Header, which is
+modified in place. The RAW field of the result is left empty.
+*/
+func ProcessHeader(id []byte, s Stamper, h *Header) (hi *HeadInfo) {
 	hi = new(HeadInfo)
-	headw := dest_buffer
-	last := make([]byte,0,256)
 	name := make([]byte,0,25)
 	buffer := make([]byte,0,100)
 	has_path := false
 	has_id := false
-	spla := bytes.SplitAfter(head,lineFeed)
-	{
-		i := 0
-		for _,el := range spla {
-			el = trimCRLF(el)
-			if len(el)==0 { continue }
-			spla[i] = el
-			i++
-		}
-		spla = append(spla[:i],nil)
-	}
-	for _,el := range spla {
-		if len(el)>0 {
-			switch el[0] {
-			case ' ','\t':
-				last = append(last,"\r\n"...)
-				last = append(last,el...); continue
-			}
-		}
-		if len(last)>0 {
-			i := bytes.IndexByte(last,':')
-			j := i+2
-			unwrit := true
-			if i>0 && i<25 {
-				name = append(name[:0],last[:i]...)
-				aToLower(name)
-				val := last[j:]
-				copy(last,headerCase[string(name)])
-				switch standardHeaders[string(name)] {
-				case 1: has_id = true
-					if len(id)>0 && bytes.Equal(val,id) { return nil }
-					hi.MessageId  = singleLineB(last[j:])
-				case 2: hi.Newsgroups = singleLineB(last[j:])
-				case 3: hi.Subject    = singleLineB(last[j:])
-				case 4: hi.From       = singleLineB(last[j:])
-				case 5: hi.Date       = singleLineB(last[j:])
-				case 6: hi.References = singleLineB(last[j:])
-				case 7:{
-					has_path = true
-					pb := s.PathSeg(buffer)
-					if len(pb)>0 {
-						unwrit = false
-						headw.Write(last[:j])
-						headw.Write(pb)
-						headw.Write(last[j:])
-						headw.WriteString("\r\n")
-					}
-				  }
-				}
-			}
-			if unwrit {
-				headw.Write(last)
-				headw.WriteString("\r\n")
-			}
+	for i := range h.Fields {
+		f := &h.Fields[i]
+		if f.Malformed { continue }
+		name = append(name[:0],f.Name...)
+		aToLower(name)
+		if c,ok := headerCase[string(name)]; ok { f.Name = c }
+		switch standardHeaders[string(name)] {
+		case 1: has_id = true
+			if len(id)>0 && bytes.Equal(f.Value,id) { return nil }
+			hi.MessageId  = f.Unfolded()
+		case 2: hi.Newsgroups = f.Unfolded()
+		case 3: hi.Subject    = f.Unfolded()
+		case 4: hi.From       = f.Unfolded()
+		case 5: hi.Date       = f.Unfolded()
+		case 6: hi.References = f.Unfolded()
+		case 7:
+			has_path = true
+			pb := s.PathSeg(buffer)
+			if len(pb)>0 { f.Value = append(cloneB(pb),f.Value...) }
 		}
-		last = append(last[:0],el...)
 	}
 	if !has_path {
 		pb := s.PathSeg(buffer)
 		if len(pb)>0 {
-			headw.WriteString("Path: ")
-			headw.Write(pb[:len(pb)-1])
-			headw.WriteString("\r\n")
+			h.Add("Path",cloneB(pb[:len(pb)-1]))
 		}
 	}
 	if !has_id {
@@ -230,12 +225,9 @@ func ParseAndProcessHeaderWithBuffer(id []byte, s Stamper, head []byte, dest_buf
 		}
 		if len(idm)>0 {
 			hi.MessageId  = cloneB(idm)
-			headw.WriteString("Message-ID: ")
-			headw.Write(idm)
-			headw.WriteString("\r\n")
+			h.Add("Message-ID",cloneB(idm))
 		}
 	}
-	hi.RAW = headw.Bytes()
 	return
 }
 
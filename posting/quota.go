@@ -0,0 +1,325 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "bufio"
+import "fmt"
+import "os"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+const(
+	quotaHour = 3600
+	quotaDay  = 24*quotaHour
+)
+
+// Limits for POSTs. A zero value means: no limit.
+type QuotaLimits struct{
+	PostsPerHour int
+	BytesPerDay  int64
+	
+	// The number of newsgroups posted to per day, summed over all articles:
+	// A crosspost to three groups counts three.
+	GroupsPerDay int
+}
+
+type quotaEvent struct{
+	t      int64 // Unix time, in seconds.
+	bytes  int64
+	groups int64
+}
+
+/*
+Per-user and per-IP limits for POSTs, over sliding windows of an hour and a
+day. A Quota is plugged into a Pipeline: the session is checked before the
+article is requested (440), and the article itself after it has been received
+(441). Both responses tell the user, when posting is possible again.
+
+The posts are recorded in a journal file, so that the limits survive restarts.
+A Quota created with OpenQuota("") or as a literal keeps them in memory only.
+*/
+type Quota struct{
+	// The limits for authenticated users.
+	User QuotaLimits
+	
+	// If not nil, it returns the limits of a user, in place of User.
+	UserLimits func(user []byte) QuotaLimits
+	
+	// The limits for each remote address.
+	IP   QuotaLimits
+	
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+	
+	mu      sync.Mutex
+	fn      string
+	f       *os.File
+	events  map[string][]quotaEvent
+	live    int   // The number of events in memory.
+	written int   // The number of lines in the journal.
+	pruned  int64 // The time of the last prune.
+}
+
+/*
+Opens a Quota, that records the posts in the given journal file. If fn is
+empty, the posts are only kept in memory.
+*/
+func OpenQuota(fn string) (*Quota,error) {
+	q := &Quota{fn:fn,events:make(map[string][]quotaEvent)}
+	if fn=="" { return q,nil }
+	f,err := os.Open(fn)
+	if err==nil {
+		err = q.read(f)
+		f.Close()
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err!=nil { return nil,err }
+	if err = q.compact(); err!=nil { return nil,err }
+	return q,nil
+}
+
+func (q *Quota) read(f *os.File) error {
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// "<time> <bytes> <groups> <key>"
+		fs := strings.SplitN(sc.Text()," ",4)
+		if len(fs)!=4 { continue }
+		var ev quotaEvent
+		var e1,e2,e3 error
+		ev.t,e1 = strconv.ParseInt(fs[0],10,64)
+		ev.bytes,e2 = strconv.ParseInt(fs[1],10,64)
+		ev.groups,e3 = strconv.ParseInt(fs[2],10,64)
+		if e1!=nil || e2!=nil || e3!=nil { continue }
+		q.events[fs[3]] = append(q.events[fs[3]],ev)
+		q.live++
+	}
+	for _,evs := range q.events {
+		sort.Slice(evs,func(i,j int) bool { return evs[i].t<evs[j].t })
+	}
+	return sc.Err()
+}
+
+func (q *Quota) now() int64 {
+	if q.Now!=nil { return q.Now().Unix() }
+	return time.Now().Unix()
+}
+
+// Removes all events older than a day.
+func (q *Quota) prune(now int64) {
+	for k,evs := range q.events {
+		i := sort.Search(len(evs),func(i int) bool { return evs[i].t>now-quotaDay })
+		if i==len(evs) {
+			delete(q.events,k)
+		} else if i>0 {
+			q.events[k] = append(evs[:0],evs[i:]...)
+		}
+		q.live -= i
+	}
+	q.pruned = now
+}
+
+// Rewrites the journal with the current events, and opens it for appending.
+func (q *Quota) compact() error {
+	if q.f!=nil { q.f.Close(); q.f = nil }
+	tmp := q.fn+".tmp"
+	f,err := os.Create(tmp)
+	if err!=nil { return err }
+	w := bufio.NewWriter(f)
+	for k,evs := range q.events {
+		for _,ev := range evs { fmt.Fprintf(w,"%d %d %d %s\n",ev.t,ev.bytes,ev.groups,k) }
+	}
+	err = w.Flush()
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	if err!=nil { os.Remove(tmp); return err }
+	if err = os.Rename(tmp,q.fn); err!=nil { return err }
+	q.f,err = os.OpenFile(q.fn,os.O_WRONLY|os.O_APPEND,0644)
+	q.written = q.live
+	return err
+}
+
+// Closes the journal.
+func (q *Quota) Close() error {
+	q.mu.Lock(); defer q.mu.Unlock()
+	if q.f==nil { return nil }
+	err := q.f.Close()
+	q.f = nil
+	return err
+}
+
+// The keys and limits, that apply to a session.
+func (q *Quota) keys(s *fastnntp.Session) (keys []string,lims []QuotaLimits) {
+	if s==nil { return }
+	if len(s.User)>0 {
+		lim := q.User
+		if q.UserLimits!=nil { lim = q.UserLimits(s.User) }
+		keys,lims = append(keys,"user:"+string(s.User)),append(lims,lim)
+	}
+	if s.RemoteAddr!=nil {
+		keys,lims = append(keys,"ip:"+hostOf(s.RemoteAddr)),append(lims,q.IP)
+	}
+	return
+}
+
+/*
+Checks, whether the events permit another post of the given size. Returns the
+time, when it is permitted (0, if now; -1, if never) and the limit in question.
+*/
+func checkQuota(evs []quotaEvent,lim QuotaLimits,now int64,x quotaEvent) (retry int64,what string) {
+	try := func(limit,window,x int64,amount func(ev *quotaEvent) int64,w string) {
+		if limit<=0 || retry<0 { return }
+		i := sort.Search(len(evs),func(i int) bool { return evs[i].t>now-window })
+		var sum int64
+		for _,ev := range evs[i:] { sum += amount(&ev) }
+		if sum+x<=limit { return }
+		for ; i<len(evs); i++ {
+			sum -= amount(&evs[i])
+			if sum+x<=limit {
+				if t := evs[i].t+window; t>retry { retry,what = t,w }
+				return
+			}
+		}
+		retry,what = -1,w
+	}
+	try(int64(lim.PostsPerHour),quotaHour,1,func(ev *quotaEvent) int64 { return 1 },fmt.Sprint(lim.PostsPerHour," articles per hour"))
+	try(lim.BytesPerDay,quotaDay,x.bytes,func(ev *quotaEvent) int64 { return ev.bytes },fmt.Sprint(lim.BytesPerDay," bytes per day"))
+	try(int64(lim.GroupsPerDay),quotaDay,x.groups,func(ev *quotaEvent) int64 { return ev.groups },fmt.Sprint(lim.GroupsPerDay," newsgroups per day"))
+	return
+}
+
+// Checks the limits of the keys. The lock must be held.
+func (q *Quota) check(keys []string,lims []QuotaLimits,now int64,x quotaEvent) string {
+	var retry int64
+	var what string
+	for i,k := range keys {
+		r,w := checkQuota(q.events[k],lims[i],now,x)
+		if r<0 { return "Article exceeds the limit of "+w }
+		if r>retry { retry,what = r,w }
+	}
+	if retry==0 { return "" }
+	return "Limit of "+what+" reached; try again after "+time.Unix(retry,0).UTC().Format(time.RFC1123Z)
+}
+
+/*
+Checks, whether the session may post at all. Returns the reason, if not.
+*/
+func (q *Quota) Allow(s *fastnntp.Session) (reason string) {
+	keys,lims := q.keys(s)
+	if len(keys)==0 { return "" }
+	q.mu.Lock(); defer q.mu.Unlock()
+	return q.check(keys,lims,q.now(),quotaEvent{bytes:1,groups:1})
+}
+
+func quotaOf(a *Article) quotaEvent {
+	return quotaEvent{
+		bytes: int64(len(a.Header.Bytes())+len(crlfB)+len(a.Body)),
+		groups: int64(len(SplitNewsgroups(a.Header.Get("Newsgroups")))),
+	}
+}
+
+/*
+Checks, whether the article may be posted. Returns the reason, if not. Nothing
+is recorded; use Reserve to post the article.
+*/
+func (q *Quota) Check(a *Article) (reason string) {
+	keys,lims := q.keys(a.Session)
+	if len(keys)==0 { return "" }
+	q.mu.Lock(); defer q.mu.Unlock()
+	return q.check(keys,lims,q.now(),quotaOf(a))
+}
+
+/*
+A post, that has been counted against the limits, but not yet recorded in the
+journal. It is ended by either Commit or Cancel. A nil QuotaReservation is
+valid and does nothing.
+*/
+type QuotaReservation struct{
+	q    *Quota
+	keys []string
+	ev   quotaEvent
+}
+
+/*
+Checks, whether the article may be posted, and counts it against the limits
+at once, so that concurrent posts cannot exceed them together. Returns the
+reason, if it is refused. The size is taken before the article is injected, and
+the same size is recorded by Commit.
+*/
+func (q *Quota) Reserve(a *Article) (res *QuotaReservation,reason string) {
+	keys,lims := q.keys(a.Session)
+	if len(keys)==0 { return nil,"" }
+	ev := quotaOf(a)
+	q.mu.Lock(); defer q.mu.Unlock()
+	ev.t = q.now()
+	if reason = q.check(keys,lims,ev.t,ev); reason!="" { return nil,reason }
+	if q.events==nil { q.events = make(map[string][]quotaEvent) }
+	
+	// Expired events are dropped at most once per hour, so that memory and
+	// journal remain bounded by the posts of the last day.
+	if ev.t-q.pruned>=quotaHour { q.prune(ev.t) }
+	for _,k := range keys {
+		q.events[k] = append(q.events[k],ev)
+		q.live++
+	}
+	return &QuotaReservation{q:q,keys:keys,ev:ev},""
+}
+
+// Records the post in the journal.
+func (r *QuotaReservation) Commit() error {
+	if r==nil { return nil }
+	q,ev := r.q,r.ev
+	q.mu.Lock(); defer q.mu.Unlock()
+	if q.f==nil { return nil }
+	var err error
+	for _,k := range r.keys {
+		if _,e := fmt.Fprintf(q.f,"%d %d %d %s\n",ev.t,ev.bytes,ev.groups,k); err==nil { err = e }
+		q.written++
+	}
+	if q.written>1024 && q.written>2*q.live {
+		if e := q.compact(); err==nil { err = e }
+	}
+	return err
+}
+
+// Gives the reservation back, because the article was not posted.
+func (r *QuotaReservation) Cancel() {
+	if r==nil { return }
+	q := r.q
+	q.mu.Lock(); defer q.mu.Unlock()
+	for _,k := range r.keys {
+		evs := q.events[k]
+		for i := len(evs)-1; i>=0; i-- {
+			if evs[i]!=r.ev { continue }
+			q.events[k] = append(evs[:i],evs[i+1:]...)
+			q.live--
+			break
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+func quotaArticle(user string, body string) *Article {
+	h := ParseHeader([]byte("Newsgroups: misc.test,misc.other\r\nSubject: test\r\n"))
+	return &Article{Session:&fastnntp.Session{User:[]byte(user)},Header:h,Body:[]byte(body)}
+}
+
+// Concurrent posts cannot exceed the limit together.
+func TestQuotaReserve(t *testing.T) {
+	clock := time.Unix(1600000000,0)
+	q := &Quota{User:QuotaLimits{PostsPerHour:5},Now:func() time.Time { return clock }}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var got []*QuotaReservation
+	for i := 0; i<20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res,reason := q.Reserve(quotaArticle("u","body\r\n"))
+			if reason!="" { return }
+			lock.Lock(); got = append(got,res); lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(got)!=5 { t.Fatalf("%d of 20 posts accepted, want 5",len(got)) }
+	if q.Allow(&fastnntp.Session{User:[]byte("u")})=="" { t.Error("session allowed after the limit") }
+	
+	// A cancelled reservation is given back.
+	got[0].Cancel()
+	res,reason := q.Reserve(quotaArticle("u","body\r\n"))
+	if reason!="" { t.Fatalf("refused after Cancel: %s",reason) }
+	res.Commit()
+	if _,reason = q.Reserve(quotaArticle("u","body\r\n")); reason=="" { t.Error("accepted beyond the limit") }
+	if _,reason = q.Reserve(quotaArticle("other","body\r\n")); reason!="" { t.Errorf("other user refused: %s",reason) }
+	
+	// The hour passes.
+	clock = clock.Add(time.Hour)
+	if _,reason = q.Reserve(quotaArticle("u","body\r\n")); reason!="" { t.Errorf("refused after an hour: %s",reason) }
+}
+
+// The journal records the size, that was checked.
+func TestQuotaJournal(t *testing.T) {
+	dir,err := ioutil.TempDir("","quota")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir,"quota")
+	q,err := OpenQuota(fn)
+	if err!=nil { t.Fatal(err) }
+	q.User.BytesPerDay = 1000
+	a := quotaArticle("u",strings.Repeat("x",400)+"\r\n")
+	size := quotaOf(a).bytes
+	res,reason := q.Reserve(a)
+	if reason!="" { t.Fatal(reason) }
+	a.Header.Add("Path",[]byte("not-for-mail"))
+	a.Header.Add("Injection-Info",[]byte("news.example"))
+	if err = res.Commit(); err!=nil { t.Fatal(err) }
+	res,_ = q.Reserve(quotaArticle("u","x\r\n"))
+	res.Cancel()
+	q.Close()
+	
+	q,err = OpenQuota(fn)
+	if err!=nil { t.Fatal(err) }
+	defer q.Close()
+	evs := q.events["user:u"]
+	if len(evs)!=1 || evs[0].bytes!=size || evs[0].groups!=2 { t.Errorf("journal holds %+v, want one post of %d bytes",evs,size) }
+}
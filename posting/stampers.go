@@ -0,0 +1,272 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/binary"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+/*
+An optional extension of Stamper. A Stamper implementing this interface
+derives the Message-ID from the article. It is used by the Injector.
+*/
+type ContentStamper interface{
+	Stamper
+	GetIdFor(id_buf []byte, h *Header, body []byte) []byte
+}
+
+func appendB64(id []byte, v uint64) []byte {
+	if v==0 { return append(id,alphabet[0]) }
+	var stor [11]byte
+	i := len(stor)
+	for v!=0 {
+		i--
+		stor[i] = alphabet[v&63]
+		v >>= 6
+	}
+	return append(id,stor[i:]...)
+}
+// Encodes b in 64-bit words of fixed width (11 digits each).
+func appendB64Bytes(id []byte, b []byte) []byte {
+	var stor [11]byte
+	for len(b)>=8 {
+		v := binary.BigEndian.Uint64(b)
+		for i := len(stor)-1; i>=0; i-- {
+			stor[i] = alphabet[v&63]
+			v >>= 6
+		}
+		id = append(id,stor[:]...)
+		b = b[8:]
+	}
+	return id
+}
+
+func randomUint64() uint64 {
+	var b [8]byte
+	if _,err := rand.Read(b[:]); err!=nil {
+		// Extremely unlikely. Fall back to the clock.
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+/*
+A Stamper, that combines a monotonic counter with a random node ID, that is
+chosen, when the Stamper is created. Within one Stamper, Message-IDs never collide;
+between processes, a collision requires two equal 64-bit node IDs.
+
+Use NewCounterStamper to create it.
+*/
+type CounterStamper struct{
+	HostName
+	node    uint64
+	counter uint64
+}
+
+func NewCounterStamper(host string) *CounterStamper {
+	return &CounterStamper{HostName:HostName(host),node:randomUint64()}
+}
+
+func (c *CounterStamper) GetId(id_buf []byte) []byte {
+	n := atomic.AddUint64(&c.counter,1)
+	id := append(id_buf,'<')
+	id = appendB64(id,n)
+	id = append(id,'.')
+	id = appendB64(id,c.node)
+	id = append(id,'@')
+	id = append(id,c.HostName...)
+	return append(id,'>')
+}
+
+// Fields, that are ignored, when the content hash is calculated.
+var traceFields = []string{
+	"Path","Xref","Message-ID","Injection-Date","Injection-Info",
+	"NNTP-Posting-Host","NNTP-Posting-Date","X-Trace",
+}
+
+/*
+A Stamper, that derives the Message-ID from a SHA-256 hash over the canonical
+form of the header (without trace fields like Path and Xref) and the body.
+
+Unless Deterministic is set, a counter and a random node ID are hashed as well,
+so that submitting the same article twice yields two distinct Message-IDs.
+With Deterministic, equal articles get the same Message-ID, so resubmissions
+are detected as duplicates.
+
+Use NewHashStamper to create it.
+*/
+type HashStamper struct{
+	CounterStamper
+	Deterministic bool
+}
+
+func NewHashStamper(host string,deterministic bool) *HashStamper {
+	return &HashStamper{*NewCounterStamper(host),deterministic}
+}
+
+// Without the article, the Message-ID is a hash of the counter and the node ID.
+func (c *HashStamper) GetId(id_buf []byte) []byte {
+	return c.GetIdFor(id_buf,nil,nil)
+}
+
+func (c *HashStamper) GetIdFor(id_buf []byte, h *Header, body []byte) []byte {
+	d := sha256.New()
+	var nb [16]byte
+	if !c.Deterministic || h==nil {
+		binary.BigEndian.PutUint64(nb[:],atomic.AddUint64(&c.counter,1))
+		binary.BigEndian.PutUint64(nb[8:],c.node)
+		d.Write(nb[:])
+	}
+	if h!=nil {
+		buf := make([]byte,0,256)
+		fields: for i := range h.Fields {
+			f := &h.Fields[i]
+			for _,t := range traceFields {
+				if f.Is(t) { continue fields }
+			}
+			buf = append(buf[:0],f.Name...)
+			aToLower(buf)
+			buf = append(append(buf,':'),f.Unfolded()...)
+			d.Write(append(buf,'\n'))
+		}
+		d.Write(lineFeed)
+		d.Write(body)
+	}
+	id := append(id_buf,'<')
+	id = appendB64Bytes(id,d.Sum(nb[:0])[:24])
+	id = append(id,'@')
+	id = append(id,c.HostName...)
+	return append(id,'>')
+}
+
+/*
+A Stamper for clusters of servers, sharing the same host name.
+Each server has to be configured with a distinct node ID (0-1023).
+
+The Message-ID is made of a millisecond timestamp, the node ID and a sequence
+number (in the style of a "snowflake" ID). If more than 4096 IDs are requested
+within a millisecond, or if the clock goes backwards, the timestamp is advanced
+virtually, so IDs never repeat, as long as the node IDs are unique.
+
+Across restarts, this only holds, if the timestamp is persisted: Use
+OpenClusterStamper to create a ClusterStamper with a state file, or
+NewClusterStamper to create one without.
+*/
+type ClusterStamper struct{
+	HostName
+	node  uint64
+	lock  sync.Mutex
+	last  int64
+	seq   uint64
+	state string
+	lease int64
+	
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+const clusterEpoch = 1262304000000 // 2010-01-01 in milliseconds.
+
+// The timestamp is persisted this far (in milliseconds) ahead of the IDs issued.
+const clusterLease = 10000
+
+func NewClusterStamper(host string,node uint16) *ClusterStamper {
+	return &ClusterStamper{HostName:HostName(host),node:uint64(node&1023)}
+}
+
+/*
+Creates a ClusterStamper, that persists a high water mark of its timestamp in
+the given state file. The mark lies ahead of the IDs issued, so the file is
+written only every few seconds. After a restart, IDs continue above the mark,
+even if the clock went backwards in between.
+
+If the state file cannot be written, IDs are still issued, and writing is
+retried with every ID; until it succeeds, IDs may repeat after a restart.
+*/
+func OpenClusterStamper(host string,node uint16,state string) (*ClusterStamper,error) {
+	c := NewClusterStamper(host,node)
+	c.state = state
+	b,err := ioutil.ReadFile(state)
+	if err==nil {
+		c.last,err = strconv.ParseInt(strings.TrimSpace(string(b)),10,64)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err!=nil { return nil,err }
+	c.lease = c.last
+	return c,nil
+}
+
+// Writes the high water mark. The caller must hold the lock.
+func (c *ClusterStamper) save(mark int64) error {
+	tmp := c.state+".tmp"
+	f,err := os.Create(tmp)
+	if err!=nil { return err }
+	_,err = f.WriteString(strconv.FormatInt(mark,10)+"\n")
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	if err==nil { err = os.Rename(tmp,c.state) }
+	if err!=nil { os.Remove(tmp) }
+	return err
+}
+
+func (c *ClusterStamper) next() uint64 {
+	now := time.Now
+	if c.Now!=nil { now = c.Now }
+	ms := now().UnixNano()/int64(time.Millisecond)-clusterEpoch
+	c.lock.Lock(); defer c.lock.Unlock()
+	if ms>c.last {
+		c.last = ms
+		c.seq = 0
+	} else {
+		c.seq++
+		if c.seq>4095 {
+			c.last++
+			c.seq = 0
+		}
+	}
+	if c.state!="" && c.last>=c.lease {
+		if c.save(c.last+clusterLease)==nil { c.lease = c.last+clusterLease }
+	}
+	return uint64(c.last)<<22 | c.node<<12 | c.seq
+}
+
+// The node ID is part of the number, so it is not repeated in the Message-ID.
+func (c *ClusterStamper) GetId(id_buf []byte) []byte {
+	id := append(id_buf,'<')
+	id = appendB64(id,c.next())
+	id = append(id,'@')
+	id = append(id,c.HostName...)
+	return append(id,'>')
+}
+
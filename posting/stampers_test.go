@@ -0,0 +1,159 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package posting
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+// Calls GetId from many goroutines and fails on the first duplicate.
+func hammer(t *testing.T, s Stamper, workers, each int) map[string]bool {
+	var lock sync.Mutex
+	seen := make(map[string]bool,workers*each)
+	var wg sync.WaitGroup
+	for i := 0; i<workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids := make([]string,each)
+			for j := range ids { ids[j] = string(s.GetId(nil)) }
+			lock.Lock(); defer lock.Unlock()
+			for _,id := range ids {
+				if seen[id] { t.Errorf("duplicate Message-ID %s",id) }
+				seen[id] = true
+			}
+		}()
+	}
+	wg.Wait()
+	return seen
+}
+
+func checkIds(t *testing.T, ids map[string]bool, host string) {
+	for id := range ids {
+		if !strings.HasPrefix(id,"<") || !strings.HasSuffix(id,"@"+host+">") {
+			t.Fatalf("malformed Message-ID %s",id)
+		}
+	}
+}
+
+func TestCounterStamper(t *testing.T) {
+	checkIds(t,hammer(t,NewCounterStamper("news.example"),32,2000),"news.example")
+	
+	// Two stampers have different node IDs.
+	a,b := NewCounterStamper("x"),NewCounterStamper("x")
+	if string(a.GetId(nil))==string(b.GetId(nil)) { t.Error("two stampers issued the same Message-ID") }
+}
+
+func TestHashStamper(t *testing.T) {
+	checkIds(t,hammer(t,NewHashStamper("news.example",false),32,2000),"news.example")
+	
+	h := ParseHeader([]byte("Subject: test\r\nFrom: a@b.example\r\nPath: x!not-for-mail\r\n"))
+	h2 := ParseHeader([]byte("Subject: test\r\nFrom: a@b.example\r\nPath: y!z!not-for-mail\r\n"))
+	body := []byte("body\r\n")
+	
+	s := NewHashStamper("news.example",true)
+	id1 := string(s.GetIdFor(nil,h,body))
+	if id2 := string(s.GetIdFor(nil,h2,body)); id1!=id2 {
+		t.Errorf("deterministic IDs differ in the trace fields only: %s %s",id1,id2)
+	}
+	if id3 := string(s.GetIdFor(nil,h,[]byte("other\r\n"))); id1==id3 {
+		t.Error("deterministic ID ignores the body")
+	}
+	
+	s = NewHashStamper("news.example",false)
+	if string(s.GetIdFor(nil,h,body))==string(s.GetIdFor(nil,h,body)) {
+		t.Error("non-deterministic IDs repeat")
+	}
+}
+
+// A clock, that does not move, forces the ClusterStamper to advance virtually.
+func frozen(at time.Time) func() time.Time {
+	return func() time.Time { return at }
+}
+
+func TestClusterStamper(t *testing.T) {
+	s := NewClusterStamper("news.example",7)
+	s.Now = frozen(time.Date(2020,1,1,0,0,0,0,time.UTC))
+	checkIds(t,hammer(t,s,32,2000),"news.example")
+	
+	// Different nodes, same clock.
+	a,b := NewClusterStamper("x",1),NewClusterStamper("x",2)
+	a.Now,b.Now = s.Now,s.Now
+	for i := 0; i<5000; i++ {
+		if string(a.GetId(nil))==string(b.GetId(nil)) { t.Fatal("two nodes issued the same Message-ID") }
+	}
+}
+
+func TestClusterStamperClockBackwards(t *testing.T) {
+	now := time.Date(2020,1,1,0,0,0,0,time.UTC)
+	s := NewClusterStamper("x",1)
+	s.Now = func() time.Time { return now }
+	var last uint64
+	for i := 0; i<10000; i++ {
+		if i%100==0 { now = now.Add(-time.Second) }
+		n := s.next()
+		if n<=last { t.Fatalf("ID %d does not exceed %d",n,last) }
+		last = n
+	}
+}
+
+func TestClusterStamperRestart(t *testing.T) {
+	dir,err := ioutil.TempDir("","stamper")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir,"state")
+	
+	now := time.Date(2020,1,1,0,0,0,0,time.UTC)
+	s,err := OpenClusterStamper("x",1,state)
+	if err!=nil { t.Fatal(err) }
+	s.Now = frozen(now)
+	
+	// Advance virtually, so the IDs are ahead of the clock.
+	seen := make(map[string]bool)
+	for i := 0; i<4096*20; i++ { seen[string(s.GetId(nil))] = true }
+	
+	// Restart, with the clock standing still and then going backwards.
+	for _,at := range []time.Time{now,now.Add(-time.Minute)} {
+		s,err = OpenClusterStamper("x",1,state)
+		if err!=nil { t.Fatal(err) }
+		s.Now = frozen(at)
+		for i := 0; i<4096*20; i++ {
+			id := string(s.GetId(nil))
+			if seen[id] { t.Fatalf("Message-ID %s reissued after restart",id) }
+			seen[id] = true
+		}
+	}
+	
+	if _,err = OpenClusterStamper("x",1,filepath.Join(dir,"missing")); err!=nil {
+		t.Errorf("a missing state file is an error: %v",err)
+	}
+	ioutil.WriteFile(state,[]byte("garbage\n"),0644)
+	if _,err = OpenClusterStamper("x",1,state); err==nil {
+		t.Error("a corrupt state file is accepted")
+	}
+}
@@ -0,0 +1,301 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package posting
+
+import "github.com/byte-mug/fastnntp"
+import "net/mail"
+import "time"
+import "fmt"
+
+// How pedantic a Validator is.
+type Strictness int
+const(
+	// Only checks, what is required to process the article at all.
+	StrictnessLax Strictness = iota-1
+	
+	// The default. Checks the syntax of all known fields.
+	StrictnessNormal
+	
+	// Enforces the recommendations of RFC 5536 as well.
+	StrictnessStrict
+)
+
+type ReasonCode int
+const(
+	ReasonMissingHeader ReasonCode = iota+1
+	ReasonMalformedHeader
+	ReasonDuplicateHeader
+	ReasonBadMessageId
+	ReasonBadDate
+	ReasonDateInFuture
+	ReasonDateTooOld
+	ReasonBadNewsgroup
+	ReasonLineTooLong
+	ReasonEightBit
+)
+
+var reasonText = map[ReasonCode]string{
+	ReasonMissingHeader  : "Missing header",
+	ReasonMalformedHeader: "Malformed header",
+	ReasonDuplicateHeader: "Duplicate header",
+	ReasonBadMessageId   : "Invalid Message-ID",
+	ReasonBadDate        : "Invalid Date",
+	ReasonDateInFuture   : "Date is in the future",
+	ReasonDateTooOld     : "Article too old",
+	ReasonBadNewsgroup   : "Invalid newsgroup name",
+	ReasonLineTooLong    : "Header line too long",
+	ReasonEightBit       : "Invalid 8-bit content",
+}
+
+// A reason for rejecting an article.
+type Reason struct{
+	Code  ReasonCode
+	// The field in question, if any.
+	Field string
+}
+func (r *Reason) Error() string {
+	if r.Field=="" { return reasonText[r.Code] }
+	return fmt.Sprint(reasonText[r.Code],": ",r.Field)
+}
+
+/*
+Converts the reason into an NNTP error with the given response code.
+Use 441 for POST, 437 for IHAVE and 439 for TAKETHIS.
+*/
+func (r *Reason) NNTPError(code int) *fastnntp.NNTPError {
+	return &fastnntp.NNTPError{Code:code,Msg:r.Error()}
+}
+
+// Fields, that must be present in every article (RFC 5536, 3.1).
+var mandatoryFields = []string{"From","Subject","Newsgroups"}
+
+// Additional mandatory fields, that are normally added by the injecting agent.
+var mandatoryInjected = []string{"Date","Message-ID","Path"}
+
+// Fields, that must not occur more than once.
+var singleFields = []string{
+	"Approved","Archive","Control","Date","Distribution","Expires",
+	"Followup-To","From","Injection-Date","Injection-Info","Lines",
+	"Message-ID","Newsgroups","Organization","Path","References",
+	"Reply-To","Sender","Subject","Summary","Supersedes","Xref",
+}
+
+/*
+Validates articles according to RFC 5536.
+
+The zero value is a usable validator with normal strictness.
+*/
+type Validator struct{
+	Strictness Strictness
+	
+	// The maximum length of a header line, without CRLF. Defaults to 998.
+	MaxLineLength int
+	
+	// How far the Date may lie in the future. Defaults to 24 hours.
+	MaxFuture time.Duration
+	
+	// If non-zero, the maximum age of the Date.
+	MaxAge time.Duration
+	
+	// Permits 8-bit characters in the header (UTF-8 headers).
+	Allow8BitHeader bool
+	
+	// Permits 8-bit characters in the body. Only checked with StrictnessStrict.
+	Allow8BitBody bool
+	
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+/*
+Validates an article. The flag injected must be true, if the article has
+already passed an injecting agent (IHAVE, TAKETHIS or an already processed POST):
+then Date, Message-ID and Path are mandatory too.
+
+Returns nil if the article is valid.
+*/
+func (v *Validator) Validate(h *Header, body []byte, injected bool) (rs []*Reason) {
+	add := func(c ReasonCode,f string) { rs = append(rs,&Reason{c,f}) }
+	for _,f := range mandatoryFields {
+		if !h.Has(f) { add(ReasonMissingHeader,f) }
+	}
+	if injected {
+		for _,f := range mandatoryInjected {
+			if !h.Has(f) { add(ReasonMissingHeader,f) }
+		}
+	}
+	for i := range h.Fields {
+		if h.Fields[i].Malformed { add(ReasonMalformedHeader,""); break }
+	}
+	if id := h.Get("Message-ID"); id!=nil && !v.validMessageId(id) {
+		add(ReasonBadMessageId,"")
+	}
+	if v.Strictness<StrictnessNormal { return }
+	
+	for _,f := range singleFields {
+		if h.Count(f)>1 { add(ReasonDuplicateHeader,f) }
+	}
+	if d := h.Get("Date"); d!=nil {
+		if r := v.checkDate(d); r!=0 { add(r,"") }
+	}
+	for _,f := range [...]string{"Newsgroups","Followup-To"} {
+		for _,val := range h.Values(f) {
+			for _,ng := range SplitNewsgroups(val) {
+				if f=="Followup-To" && string(ng)=="poster" { continue }
+				if !v.ValidNewsgroup(ng) { add(ReasonBadNewsgroup,string(ng)); break }
+			}
+		}
+	}
+	if f := v.longLine(h); f!="" { add(ReasonLineTooLong,f) }
+	if !v.Allow8BitHeader {
+		for i := range h.Fields {
+			f := &h.Fields[i]
+			if has8Bit(f.Name) || has8Bit(f.Value) { add(ReasonEightBit,string(f.Name)); break }
+		}
+	}
+	if v.Strictness>=StrictnessStrict && !v.Allow8BitBody && has8Bit(body) && !h.Has("Content-Transfer-Encoding") {
+		add(ReasonEightBit,"")
+	}
+	return
+}
+
+func (v *Validator) now() time.Time {
+	if v.Now!=nil { return v.Now() }
+	return time.Now()
+}
+
+func (v *Validator) checkDate(d []byte) ReasonCode {
+	t,err := mail.ParseDate(string(d))
+	if err!=nil { return ReasonBadDate }
+	now := v.now()
+	mf := v.MaxFuture
+	if mf==0 { mf = 24*time.Hour }
+	if t.After(now.Add(mf)) { return ReasonDateInFuture }
+	if v.MaxAge!=0 && t.Before(now.Add(-v.MaxAge)) { return ReasonDateTooOld }
+	return 0
+}
+
+func (v *Validator) longLine(h *Header) string {
+	max := v.MaxLineLength
+	if max<=0 { max = 998 }
+	for i := range h.Fields {
+		f := &h.Fields[i]
+		// The first line consists of the name, a colon, a space and the value.
+		n := len(f.Name)+2
+		for _,b := range f.Value {
+			if b=='\n' { n = 0; continue }
+			if b=='\r' { continue }
+			n++
+			if n>max { return string(f.Name) }
+		}
+		if n>max { return string(f.Name) }
+	}
+	return ""
+}
+
+func has8Bit(b []byte) bool {
+	for _,c := range b {
+		if c>=0x80 || c==0 { return true }
+	}
+	return false
+}
+
+func isAtext(b byte) bool {
+	switch {
+	case b>='a' && b<='z',b>='A' && b<='Z',b>='0' && b<='9': return true
+	}
+	switch b {
+	case '!','#','$','%','&','\'','*','+','-','/','=','?','^','_','`','{','|','}','~': return true
+	}
+	return false
+}
+
+func isDotAtom(b []byte) bool {
+	if len(b)==0 || b[0]=='.' || b[len(b)-1]=='.' { return false }
+	for i,c := range b {
+		if c=='.' {
+			if b[i-1]=='.' { return false }
+			continue
+		}
+		if !isAtext(c) { return false }
+	}
+	return true
+}
+
+/*
+Checks the syntax of a Message-ID (RFC 5536, 3.1.3).
+In lax mode, only the "<...@...>" structure and the characters are checked.
+*/
+func (v *Validator) validMessageId(id []byte) bool {
+	if len(id)<5 || len(id)>250 { return false }
+	if id[0]!='<' || id[len(id)-1]!='>' { return false }
+	id = id[1:len(id)-1]
+	at := -1
+	for i,c := range id {
+		if c<=' ' || c>='\x7f' || c=='<' || c=='>' { return false }
+		if c=='@' { at = i }
+	}
+	if at<=0 || at==len(id)-1 { return false }
+	if v.Strictness<StrictnessStrict { return true }
+	left,right := id[:at],id[at+1:]
+	if !isDotAtom(left) { return false }
+	if right[0]=='[' && right[len(right)-1]==']' { return true }
+	return isDotAtom(right)
+}
+
+/*
+Checks the syntax of a newsgroup name (RFC 5536, 3.1.4).
+With StrictnessStrict, the recommendations of RFC 5536 (lower case letters only,
+no all-numeric components) are enforced as well.
+*/
+func (v *Validator) ValidNewsgroup(ng []byte) bool {
+	if len(ng)==0 { return false }
+	comp := 0
+	digits := true
+	for _,c := range ng {
+		if c=='.' {
+			if comp==0 { return false }
+			if digits && v.Strictness>=StrictnessStrict { return false }
+			comp = 0
+			digits = true
+			continue
+		}
+		switch {
+		case c>='a' && c<='z': digits = false
+		case c>='0' && c<='9':
+		case c=='+' || c=='-' || c=='_': digits = false
+		case c>='A' && c<='Z':
+			if v.Strictness>=StrictnessStrict { return false }
+			digits = false
+		default: return false
+		}
+		comp++
+	}
+	if comp==0 { return false }
+	if digits && v.Strictness>=StrictnessStrict { return false }
+	return true
+}
+
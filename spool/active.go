@@ -0,0 +1,153 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package spool
+
+import "bufio"
+import "bytes"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+
+type group struct{
+	name   string
+	status byte
+	high   int64
+	low    int64
+	nums   []int64 // sorted
+}
+
+func (g *group) search(n int64) int {
+	return sort.Search(len(g.nums),func(i int) bool { return g.nums[i]>=n })
+}
+func (g *group) has(n int64) bool {
+	i := g.search(n)
+	return i<len(g.nums) && g.nums[i]==n
+}
+func (g *group) insert(n int64) {
+	i := g.search(n)
+	if i<len(g.nums) && g.nums[i]==n { return }
+	g.nums = append(g.nums,0)
+	copy(g.nums[i+1:],g.nums[i:])
+	g.nums[i] = n
+	g.updateLow()
+}
+func (g *group) remove(n int64) {
+	i := g.search(n)
+	if i<len(g.nums) && g.nums[i]==n {
+		g.nums = append(g.nums[:i],g.nums[i+1:]...)
+	}
+	g.updateLow()
+}
+func (g *group) updateLow() {
+	if len(g.nums)==0 {
+		g.low = g.high+1
+	} else {
+		g.low = g.nums[0]
+	}
+}
+
+/*
+Reads the active file. Each line has the form
+
+	group high low status
+*/
+func readActive(fn string) (map[string]*group,error) {
+	grps := make(map[string]*group)
+	f,err := os.Open(fn)
+	if os.IsNotExist(err) { return grps,nil }
+	if err!=nil { return nil,err }
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fs := bytes.Fields(sc.Bytes())
+		if len(fs)<4 || len(fs[3])==0 { continue }
+		high,e1 := strconv.ParseInt(string(fs[1]),10,64)
+		low,e2 := strconv.ParseInt(string(fs[2]),10,64)
+		if e1!=nil || e2!=nil { continue }
+		grps[string(fs[0])] = &group{name:string(fs[0]),high:high,low:low,status:fs[3][0]}
+	}
+	return grps,sc.Err()
+}
+
+// Writes the active file atomically.
+func writeActive(fn string, grps map[string]*group) error {
+	names := make([]string,0,len(grps))
+	for n := range grps { names = append(names,n) }
+	sort.Strings(names)
+	tmp := fn+".tmp"
+	f,err := os.Create(tmp)
+	if err!=nil { return err }
+	w := bufio.NewWriter(f)
+	for _,n := range names {
+		g := grps[n]
+		fmt.Fprintf(w,"%s %010d %010d %c\n",g.name,g.high,g.low,g.status)
+	}
+	err = w.Flush()
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	if err!=nil { os.Remove(tmp); return err }
+	return os.Rename(tmp,fn)
+}
+
+// Scans the directory of a group for article files.
+func scanGroup(dir string) (nums []int64,err error) {
+	f,err := os.Open(dir)
+	if os.IsNotExist(err) { return nil,nil }
+	if err!=nil { return nil,err }
+	defer f.Close()
+	for {
+		names,err := f.Readdirnames(1024)
+		for _,n := range names {
+			if v,e := strconv.ParseInt(n,10,64); e==nil && v>0 { nums = append(nums,v) }
+		}
+		if err==io.EOF { break }
+		if err!=nil { return nil,err }
+	}
+	sort.Slice(nums,func(i,j int) bool { return nums[i]<nums[j] })
+	return
+}
+
+// Reads the Message-ID from the header of an article file.
+func readMessageId(fn string) ([]byte,error) {
+	f,err := os.Open(fn)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line,err := r.ReadSlice('\n')
+		l := bytes.TrimRight(line,"\r\n")
+		if len(l)==0 { break }
+		if i := bytes.IndexByte(l,':'); i>0 && bytes.EqualFold(l[:i],[]byte("Message-ID")) {
+			return append([]byte(nil),bytes.TrimSpace(l[i+1:])...),nil
+		}
+		if err!=nil { break }
+	}
+	return nil,fmt.Errorf("spool: %s: no Message-ID",filepath.Base(fn))
+}
+
@@ -0,0 +1,160 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package spool
+
+import "bufio"
+import "bytes"
+import "os"
+import "strconv"
+import "strings"
+
+/*
+The Message-ID index. It maps every Message-ID to its storage tokens. A storage
+token is the path of an article file, relative to the article directory (like
+"misc/test/123"). The first token is the primary location of the article, the
+others are the crossposts.
+
+It is kept in memory and persisted as an append-only log. Each line is either
+
+	<message-id> token [token...]
+
+or, for deleted articles,
+
+	<message-id> -
+
+The log also keeps the highest article number ever stored in each group, even
+after the article was deleted. On compaction, these are written as
+
+	high group number
+*/
+type index struct{
+	byId  map[string][]string
+	byTok map[string]string
+	high  map[string]int64
+	log   *os.File
+	w     *bufio.Writer
+}
+
+func openIndex(fn string) (*index,error) {
+	x := &index{byId:make(map[string][]string),byTok:make(map[string]string),high:make(map[string]int64)}
+	if f,err := os.Open(fn); err==nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil,1<<20)
+		for sc.Scan() {
+			fs := strings.Fields(sc.Text())
+			if len(fs)<2 { continue }
+			if fs[0]=="high" {
+				if len(fs)!=3 { continue }
+				n,_ := strconv.ParseInt(fs[2],10,64)
+				x.noteHigh(fs[1],n)
+				continue
+			}
+			x.drop(fs[0])
+			if fs[1]=="-" { continue }
+			x.set(fs[0],fs[1:])
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil,err
+	}
+	f,err := os.OpenFile(fn,os.O_WRONLY|os.O_APPEND|os.O_CREATE,0644)
+	if err!=nil { return nil,err }
+	x.log = f
+	x.w = bufio.NewWriter(f)
+	return x,nil
+}
+
+func (x *index) set(id string, toks []string) {
+	x.byId[id] = toks
+	for _,t := range toks {
+		x.byTok[t] = id
+		x.noteHigh(splitToken(t))
+	}
+}
+func (x *index) noteHigh(group string, num int64) {
+	if num>x.high[group] { x.high[group] = num }
+}
+func (x *index) drop(id string) {
+	for _,t := range x.byId[id] { delete(x.byTok,t) }
+	delete(x.byId,id)
+}
+
+// Records the tokens of an article.
+func (x *index) add(id string, toks []string) error {
+	x.drop(id)
+	x.set(id,toks)
+	var b bytes.Buffer
+	b.WriteString(id)
+	for _,t := range toks { b.WriteByte(' '); b.WriteString(t) }
+	b.WriteByte('\n')
+	if _,err := x.w.Write(b.Bytes()); err!=nil { return err }
+	return x.flush()
+}
+
+// Records the removal of an article.
+func (x *index) remove(id string) error {
+	x.drop(id)
+	if _,err := x.w.WriteString(id+" -\n"); err!=nil { return err }
+	return x.flush()
+}
+
+func (x *index) flush() error {
+	if err := x.w.Flush(); err!=nil { return err }
+	return x.log.Sync()
+}
+
+/*
+Rewrites the log, so that it contains only the live entries and the high water
+marks. If this fails, the old log remains in use.
+*/
+func (x *index) compact(fn string) error {
+	tmp := fn+".tmp"
+	f,err := os.Create(tmp)
+	if err!=nil { return err }
+	w := bufio.NewWriter(f)
+	for g,n := range x.high {
+		w.WriteString("high "+g+" "+strconv.FormatInt(n,10)+"\n")
+	}
+	for id,toks := range x.byId {
+		w.WriteString(id)
+		for _,t := range toks { w.WriteByte(' '); w.WriteString(t) }
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err==nil { err = f.Sync() }
+	if err==nil { err = os.Rename(tmp,fn) }
+	if err!=nil { f.Close(); os.Remove(tmp); return err }
+	x.log.Close()
+	x.log = f
+	x.w = bufio.NewWriter(f)
+	return nil
+}
+
+func (x *index) close() error {
+	x.w.Flush()
+	return x.log.Close()
+}
+
@@ -0,0 +1,641 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+A traditional news spool on the file system.
+
+Every article is stored in a file of its own, named by its article number,
+within a directory per group (the group "misc.test" lives in "misc/test").
+Crossposted articles are hard-linked into the other groups. The high and low
+water marks are kept in an "active" file, and a Message-ID index maps every
+article to its storage tokens.
+
+Numbering is crash-safe: Articles are written to a temporary file first, and
+the index, which is synced on every store, remembers the highest number ever
+stored in each group. When the spool is opened, the high water marks are
+recovered from the index and the article files, so numbers are not reused even
+if the highest article was deleted before a crash. Article files, that are
+missing in the index, are indexed again.
+
+Layout of the spool directory:
+
+	active         the active file
+	index          the Message-ID index
+	articles/      the article files
+	tmp/           temporary files
+*/
+package spool
+
+import "github.com/byte-mug/fastnntp"
+import "github.com/byte-mug/fastnntp/posting"
+import "github.com/byte-mug/fastnntp/overview"
+import "bufio"
+import "bytes"
+import "errors"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+
+var ErrBadGroupName = errors.New("spool: invalid group name")
+
+/*
+A Spool. Use Open to open or create one.
+
+The Spool implements fastnntp.GroupCaps, fastnntp.ArticleCaps,
+fastnntp.PostingCaps and fastnntp.GroupListingCaps, as well as posting.Store.
+*/
+type Spool struct{
+	dir    string
+	lock   sync.RWMutex
+	groups map[string]*group
+	idx    *index
+	
+	// The posting pipeline, used for POST, IHAVE and TAKETHIS.
+	// It may be reconfigured before the Spool is used.
+	Posting *posting.Pipeline
+	
+	// If not nil, the overview entries of stored articles are added to it, and
+	// OVER is served from it. It must be set before the Spool is used.
+	Overview *overview.DB
+}
+
+/*
+Opens the spool in the given directory, creating it if necessary. The host is used
+as path identity and as the right hand side of generated Message-IDs.
+*/
+func Open(dir string, host string) (*Spool,error) {
+	for _,d := range []string{"articles","tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir,d),0755); err!=nil { return nil,err }
+	}
+	// Left-overs of interrupted writes.
+	if tmps,err := filepath.Glob(filepath.Join(dir,"tmp","*")); err==nil {
+		for _,t := range tmps { os.Remove(t) }
+	}
+	grps,err := readActive(filepath.Join(dir,"active"))
+	if err!=nil { return nil,err }
+	idx,err := openIndex(filepath.Join(dir,"index"))
+	if err!=nil { return nil,err }
+	s := &Spool{dir:dir,groups:grps,idx:idx}
+	s.Posting = &posting.Pipeline{Store:s,Stamper:posting.NewCounterStamper(host)}
+	if err = s.recover(); err!=nil { idx.close(); return nil,err }
+	return s,nil
+}
+
+// Brings the active file and the index in line with the article files.
+func (s *Spool) recover() error {
+	for _,g := range s.groups {
+		nums,err := scanGroup(s.groupDir(g.name))
+		if err!=nil { return err }
+		g.nums = nums
+		if n := len(nums); n>0 && nums[n-1]>g.high { g.high = nums[n-1] }
+		if h := s.idx.high[g.name]; h>g.high { g.high = h }
+		for _,n := range nums {
+			tok := token(g.name,n)
+			if _,ok := s.idx.byTok[tok]; ok { continue }
+			id,err := readMessageId(s.tokenPath(tok))
+			if err!=nil { continue }
+			toks := append(append([]string(nil),s.idx.byId[string(id)]...),tok)
+			if err = s.idx.add(string(id),toks); err!=nil { return err }
+		}
+		g.updateLow()
+	}
+	// Drop the tokens of files, that no longer exist.
+	for id,toks := range s.idx.byId {
+		live := toks[:0:0]
+		for _,t := range toks {
+			g,n := splitToken(t)
+			if grp,ok := s.groups[g]; ok && grp.has(n) { live = append(live,t) }
+		}
+		if len(live)==len(toks) { continue }
+		var err error
+		if len(live)==0 {
+			err = s.idx.remove(id)
+		} else {
+			err = s.idx.add(id,live)
+		}
+		if err!=nil { return err }
+	}
+	return writeActive(filepath.Join(s.dir,"active"),s.groups)
+}
+
+// Writes the active file and compacts the index.
+func (s *Spool) Sync() error {
+	s.lock.Lock(); defer s.lock.Unlock()
+	if err := writeActive(filepath.Join(s.dir,"active"),s.groups); err!=nil { return err }
+	return s.idx.compact(filepath.Join(s.dir,"index"))
+}
+
+// Synchronizes and closes the Spool.
+func (s *Spool) Close() error {
+	err := s.Sync()
+	s.lock.Lock(); defer s.lock.Unlock()
+	if e := s.idx.close(); err==nil { err = e }
+	return err
+}
+
+// Returns a Handler, that is backed by this Spool.
+func (s *Spool) Handler() *fastnntp.Handler {
+	return &fastnntp.Handler{
+		GroupCaps: s,
+		ArticleCaps: s,
+		PostingCaps: s.Posting,
+		GroupListingCaps: s,
+	}
+}
+
+/*
+Group names become directories, and article numbers become file names within
+them. A component, that consists only of digits, would collide with an article
+file of the parent group ("alt.2600" versus article 2600 in "alt").
+*/
+func validGroupName(name string) bool {
+	if name=="" { return false }
+	for _,c := range strings.Split(name,".") {
+		if c=="" || strings.Trim(c,"0123456789")=="" { return false }
+	}
+	return !strings.ContainsAny(name,"/\\ \t\r\n\x00")
+}
+
+func (s *Spool) groupDir(name string) string {
+	return filepath.Join(s.dir,"articles",filepath.FromSlash(strings.Replace(name,".","/",-1)))
+}
+
+// The storage token of an article is its path relative to the article directory.
+func token(group string, num int64) string {
+	return strings.Replace(group,".","/",-1)+"/"+strconv.FormatInt(num,10)
+}
+func splitToken(tok string) (group string, num int64) {
+	i := strings.LastIndexByte(tok,'/')
+	if i<0 { return "",0 }
+	num,_ = strconv.ParseInt(tok[i+1:],10,64)
+	return strings.Replace(tok[:i],"/",".",-1),num
+}
+func (s *Spool) tokenPath(tok string) string {
+	return filepath.Join(s.dir,"articles",filepath.FromSlash(tok))
+}
+
+/*
+Adds a group or updates its status. The status is one of 'y' (posting permitted),
+'n' (posting not permitted) or 'm' (moderated). Names with empty or all-numeric
+components are refused with ErrBadGroupName.
+*/
+func (s *Spool) AddGroup(name string, status byte) error {
+	if !validGroupName(name) { return ErrBadGroupName }
+	s.lock.Lock(); defer s.lock.Unlock()
+	if g,ok := s.groups[name]; ok {
+		g.status = status
+	} else {
+		if err := os.MkdirAll(s.groupDir(name),0755); err!=nil { return err }
+		// A group, that was removed before, continues its numbering.
+		g = &group{name:name,status:status,high:s.idx.high[name]}
+		g.updateLow()
+		s.groups[name] = g
+	}
+	return writeActive(filepath.Join(s.dir,"active"),s.groups)
+}
+
+/*
+Removes a group from the active file and deletes its article files. The
+directories of subgroups (like "misc.test.x" within "misc.test") are kept. The
+high water mark is remembered in the index, so the numbering continues if the
+group is added again.
+*/
+func (s *Spool) RemoveGroup(name string) error {
+	s.lock.Lock(); defer s.lock.Unlock()
+	if _,ok := s.groups[name]; !ok { return nil }
+	delete(s.groups,name)
+	if err := writeActive(filepath.Join(s.dir,"active"),s.groups); err!=nil { return err }
+	
+	// The directory may contain files, that are not in the index.
+	dir := s.groupDir(name)
+	nums,err := scanGroup(dir)
+	if err!=nil { return err }
+	for _,n := range nums {
+		tok := token(name,n)
+		if err := os.Remove(s.tokenPath(tok)); err!=nil && !os.IsNotExist(err) { return err }
+		if s.Overview!=nil { s.Overview.Delete(name,n) }
+		id,ok := s.idx.byTok[tok]
+		if !ok { continue }
+		if err := s.dropToken(id,tok); err!=nil { return err }
+	}
+	os.Remove(dir) // Fails, if there are subgroups.
+	return nil
+}
+
+/*
+Creates a group or updates its status. The description is not stored.
+Implements control.GroupManager.
+*/
+func (s *Spool) NewGroup(name string, status byte, desc string) error {
+	return s.AddGroup(name,status)
+}
+
+// Calls fn for every group. Implements control.GroupManager.
+func (s *Spool) EachGroup(fn func(name string, status byte)) {
+	s.lock.RLock()
+	type ent struct{
+		name   string
+		status byte
+	}
+	ents := make([]ent,0,len(s.groups))
+	for _,g := range s.groups { ents = append(ents,ent{g.name,g.status}) }
+	s.lock.RUnlock()
+	for _,e := range ents { fn(e.name,e.status) }
+}
+
+// Returns the header of an article, or nil. Implements control.ArticleManager.
+func (s *Spool) ArticleHeader(id []byte) *posting.Header {
+	tok,_ := s.lookup(&fastnntp.Article{MessageId:id,HasId:true})
+	if tok=="" { return nil }
+	f,err := os.Open(s.tokenPath(tok))
+	if err!=nil { return nil }
+	defer f.Close()
+	var head []byte
+	r := bufio.NewReader(f)
+	for {
+		line,err := r.ReadSlice('\n')
+		if len(bytes.TrimRight(line,"\r\n"))==0 || err!=nil { break }
+		head = append(head,line...)
+	}
+	return posting.ParseHeader(head)
+}
+
+func (s *Spool) dropToken(id, tok string) error {
+	var live []string
+	for _,t := range s.idx.byId[id] {
+		if t!=tok { live = append(live,t) }
+	}
+	if len(live)==0 { return s.idx.remove(id) }
+	return s.idx.add(id,live)
+}
+
+// Deletes an article from all its groups.
+func (s *Spool) Delete(id []byte) error {
+	s.lock.Lock(); defer s.lock.Unlock()
+	toks,ok := s.idx.byId[string(id)]
+	if !ok { return nil }
+	for _,t := range toks {
+		g,n := splitToken(t)
+		if grp,ok := s.groups[g]; ok { grp.remove(n) }
+		os.Remove(s.tokenPath(t))
+		if s.Overview!=nil { s.Overview.Delete(g,n) }
+	}
+	return s.idx.remove(string(id))
+}
+
+/*
+Removes an article from one group. The article file of the group is deleted,
+and the low water mark is updated. Implements expire.Storage.
+*/
+func (s *Spool) ExpireArticle(group string, num int64) error {
+	s.lock.Lock(); defer s.lock.Unlock()
+	grp,ok := s.groups[group]
+	if !ok { return nil }
+	grp.remove(num)
+	tok := token(group,num)
+	os.Remove(s.tokenPath(tok))
+	if s.Overview!=nil { s.Overview.Delete(group,num) }
+	id,ok := s.idx.byTok[tok]
+	if !ok { return nil }
+	return s.dropToken(id,tok)
+}
+
+// Returns the status of a group. Implements posting.ActiveSource.
+func (s *Spool) GroupStatus(group []byte) (status byte, ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	g,ok := s.groups[string(group)]
+	if !ok { return 0,false }
+	return g.status,true
+}
+
+// Returns the high water mark of a group. Implements posting.NumberSource.
+func (s *Spool) GroupHigh(group []byte) (high int64, ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	g,ok := s.groups[string(group)]
+	if !ok { return 0,false }
+	return g.high,true
+}
+
+// ---------------------------------------------------------------------------
+// posting.Store
+
+func (s *Spool) CheckPostId(id []byte) (wanted bool, possible bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	_,ok := s.idx.byId[string(id)]
+	return !ok,true
+}
+func (s *Spool) CheckPost() (possible bool) { return true }
+
+/*
+Stores an article in all groups of its Newsgroups field, that exist in the Spool.
+If the article has been numbered by the Pipeline, these numbers are used; if
+one of them is already taken, the article is rejected. Articles, that belong to
+no known group, are rejected.
+*/
+func (s *Spool) StoreArticle(a *posting.Article) (rejected bool,failed bool) {
+	id := string(a.MessageId())
+	if id=="" || strings.ContainsAny(id," \t\r\n") { return true,false }
+	ngs := posting.SplitNewsgroups(a.Header.Get("Newsgroups"))
+	if a.Numbers!=nil {
+		// The groups and numbers assigned by the Pipeline.
+		ngs = ngs[:0]
+		for _,g := range a.Numbers.Groups { ngs = append(ngs,[]byte(g)) }
+	}
+	
+	// Write the article to a temporary file first.
+	f,err := ioutil.TempFile(filepath.Join(s.dir,"tmp"),"art")
+	if err!=nil { return false,true }
+	tmp := f.Name()
+	w := bufio.NewWriter(f)
+	size,err := a.WriteTo(w)
+	if err==nil { err = w.Flush() }
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	defer os.Remove(tmp)
+	if err!=nil { return false,true }
+	
+	s.lock.Lock(); defer s.lock.Unlock()
+	if _,ok := s.idx.byId[id]; ok { return true,false }
+	if a.Numbers!=nil {
+		// An assigned number, that is already taken, would lose the article in that group.
+		for i,ng := range ngs {
+			if g,ok := s.groups[string(ng)]; ok && g.has(a.Numbers.Numbers[i]) { return true,false }
+		}
+	}
+	var toks []string
+	var grps []*group
+	for i,ng := range ngs {
+		g,ok := s.groups[string(ng)]
+		if !ok { continue }
+		dup := false
+		for _,og := range grps { dup = dup || og==g }
+		if dup { continue }
+		num := g.high+1
+		if a.Numbers!=nil {
+			num = a.Numbers.Numbers[i]
+		}
+		tok := token(g.name,num)
+		if len(toks)==0 {
+			err = os.Rename(tmp,s.tokenPath(tok))
+		} else {
+			err = linkOrCopy(s.tokenPath(toks[0]),s.tokenPath(tok))
+		}
+		if err!=nil { break }
+		if num>g.high { g.high = num }
+		g.insert(num)
+		toks = append(toks,tok)
+		grps = append(grps,g)
+	}
+	if len(toks)==0 {
+		if err!=nil { return false,true }
+		return true,false
+	}
+	if err = s.idx.add(id,toks); err!=nil { return false,true }
+	if s.Overview!=nil {
+		e := overview.EntryFromHeader(a.Header,size,posting.CountLines(a.Body))
+		for _,t := range toks {
+			g,n := splitToken(t)
+			
+			// The article is stored; a missing overview entry is not fatal.
+			e.Number = n
+			s.Overview.Add(g,e)
+		}
+	}
+	return false,false
+}
+
+func linkOrCopy(src, dst string) error {
+	if os.Link(src,dst)==nil { return nil }
+	in,err := os.Open(src)
+	if err!=nil { return err }
+	defer in.Close()
+	out,err := os.Create(dst)
+	if err!=nil { return err }
+	_,err = io.Copy(out,in)
+	if err==nil { err = out.Sync() }
+	if e := out.Close(); err==nil { err = e }
+	return err
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.PostingCaps
+
+func (s *Spool) PerformPost(id []byte, r *fastnntp.DotReader) (rejected bool,failed bool) {
+	return s.Posting.PerformPost(id,r)
+}
+func (s *Spool) PerformPostSession(id []byte, r *fastnntp.DotReader, sess *fastnntp.Session) (rejected bool,failed bool,reason string) {
+	return s.Posting.PerformPostSession(id,r,sess)
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.GroupCaps
+
+func (s *Spool) GetGroup(g *fastnntp.Group) bool {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	grp,ok := s.groups[string(g.Group)]
+	if !ok { return false }
+	g.Number = int64(len(grp.nums))
+	g.Low = grp.low
+	g.High = grp.high
+	return true
+}
+func (s *Spool) ListGroup(g *fastnntp.Group, w *fastnntp.DotWriter, first, last int64) {
+	s.lock.RLock()
+	grp,ok := s.groups[string(g.Group)]
+	var nums []int64
+	if ok {
+		if last<first { last = grp.high }
+		for _,n := range grp.nums[grp.search(first):] {
+			if n>last { break }
+			nums = append(nums,n)
+		}
+	}
+	s.lock.RUnlock()
+	buf := make([]byte,0,32)
+	for _,n := range nums {
+		w.Write(append(fastnntp.AppendUint(buf[:0],n),'\r','\n'))
+	}
+}
+func (s *Spool) CursorMoveGroup(g *fastnntp.Group, i int64, backward bool, id_buf []byte) (ni int64, id []byte, ok bool) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	grp,ok := s.groups[string(g.Group)]
+	if !ok { return }
+	j := grp.search(i)
+	if backward {
+		j--
+	} else if j<len(grp.nums) && grp.nums[j]==i {
+		j++
+	}
+	for ; j>=0 && j<len(grp.nums); {
+		ni = grp.nums[j]
+		if mid,ok := s.idx.byTok[token(grp.name,ni)]; ok {
+			return ni,append(id_buf,mid...),true
+		}
+		if backward { j-- } else { j++ }
+	}
+	return 0,nil,false
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.ArticleCaps
+
+// Returns the storage token and the Message-ID of an article.
+func (s *Spool) lookup(a *fastnntp.Article) (tok, id string) {
+	s.lock.RLock(); defer s.lock.RUnlock()
+	if a.HasNum {
+		grp,ok := s.groups[string(a.Group)]
+		if !ok || !grp.has(a.Number) { return }
+		tok = token(grp.name,a.Number)
+		return tok,s.idx.byTok[tok]
+	}
+	toks := s.idx.byId[string(a.MessageId)]
+	if len(toks)==0 { return }
+	return toks[0],string(a.MessageId)
+}
+
+func (s *Spool) StatArticle(a *fastnntp.Article) bool {
+	tok,id := s.lookup(a)
+	if tok=="" || id=="" { return false }
+	if !a.HasId { a.MessageId = append(a.MessageId[:0],id...) }
+	return true
+}
+
+/*
+Returns a function, that streams the article from its file.
+*/
+func (s *Spool) GetArticle(a *fastnntp.Article, head, body bool) func(w *fastnntp.DotWriter) {
+	tok,id := s.lookup(a)
+	if tok=="" || id=="" { return nil }
+	f,err := os.Open(s.tokenPath(tok))
+	if err!=nil { return nil }
+	if !a.HasId { a.MessageId = append(a.MessageId[:0],id...) }
+	return func(w *fastnntp.DotWriter) {
+		defer f.Close()
+		r := bufio.NewReaderSize(f,1<<13)
+		if !head || !body {
+			for {
+				line,err := r.ReadSlice('\n')
+				if len(bytes.TrimRight(line,"\r\n"))==0 { break }
+				if head { w.Write(line) }
+				if err!=nil { break }
+			}
+			if !body { return }
+		}
+		io.Copy(w,r)
+	}
+}
+
+/*
+Writes the overview of the requested articles. The overview fields are read
+from the article files, unless an overview database is used.
+*/
+func (s *Spool) WriteOverview(ar *fastnntp.ArticleRange) func(w fastnntp.IOverview) {
+	if s.Overview!=nil { return s.Overview.WriteOverview(ar) }
+	type entry struct{
+		num int64
+		tok string
+	}
+	var ents []entry
+	if ar.HasNum {
+		s.lock.RLock()
+		grp,ok := s.groups[string(ar.Group)]
+		if ok {
+			for _,n := range grp.nums[grp.search(ar.Number):] {
+				if n>ar.LastNumber { break }
+				ents = append(ents,entry{n,token(grp.name,n)})
+			}
+		}
+		s.lock.RUnlock()
+	} else if tok,_ := s.lookup(&ar.Article); tok!="" {
+		ents = append(ents,entry{0,tok})
+	}
+	if len(ents)==0 { return nil }
+	return func(w fastnntp.IOverview) {
+		for _,e := range ents {
+			ov,err := ReadOverview(s.tokenPath(e.tok))
+			if err!=nil { continue }
+			if w.WriteEntry(e.num,ov.Subject,ov.From,ov.Date,ov.MessageId,ov.References,ov.Bytes,ov.Lines)!=nil { return }
+		}
+	}
+}
+
+// The overview fields of an article.
+type Overview struct{
+	Subject, From, Date, MessageId, References []byte
+	Bytes, Lines int64
+}
+
+// Reads the overview fields from an article file.
+func ReadOverview(fn string) (*Overview,error) {
+	data,err := ioutil.ReadFile(fn)
+	if err!=nil { return nil,err }
+	ov := new(Overview)
+	ov.Bytes = int64(len(data))
+	i := bytes.Index(data,[]byte("\r\n\r\n"))
+	var head,body []byte
+	if i<0 {
+		head = data
+	} else {
+		head,body = data[:i],data[i+4:]
+	}
+	h := posting.ParseHeader(head)
+	ov.Subject    = ovClean(h.Get("Subject"))
+	ov.From       = ovClean(h.Get("From"))
+	ov.Date       = ovClean(h.Get("Date"))
+	ov.MessageId  = ovClean(h.Get("Message-ID"))
+	ov.References = ovClean(h.Get("References"))
+	ov.Lines      = posting.CountLines(body)
+	return ov,nil
+}
+
+func ovClean(b []byte) []byte {
+	for i,c := range b {
+		switch c {
+		case '\t','\r','\n': b[i] = ' '
+		}
+	}
+	return b
+}
+
+// ---------------------------------------------------------------------------
+// fastnntp.GroupListingCaps
+
+func (s *Spool) ListGroups(wm *fastnntp.WildMat, ila fastnntp.IListActive) bool {
+	s.lock.RLock()
+	grps := make([]group,0,len(s.groups))
+	for _,g := range s.groups { grps = append(grps,group{name:g.name,status:g.status,high:g.high,low:g.low}) }
+	s.lock.RUnlock()
+	sort.Slice(grps,func(i,j int) bool { return grps[i].name<grps[j].name })
+	for _,g := range grps {
+		if ila.WriteFullInfo([]byte(g.name),g.high,g.low,g.status,nil)!=nil { break }
+	}
+	return true
+}
+
@@ -0,0 +1,246 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package spool
+
+import "github.com/byte-mug/fastnntp"
+import "github.com/byte-mug/fastnntp/posting"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sync"
+import "testing"
+
+func tempSpool(t *testing.T) (*Spool,string) {
+	dir,err := ioutil.TempDir("","spool")
+	if err!=nil { t.Fatal(err) }
+	s,err := Open(dir,"news.example")
+	if err!=nil { os.RemoveAll(dir); t.Fatal(err) }
+	return s,dir
+}
+
+// Reopens the spool without closing it, as after a crash.
+func crash(t *testing.T, s *Spool, dir string) *Spool {
+	s.idx.log.Close()
+	s,err := Open(dir,"news.example")
+	if err!=nil { t.Fatal(err) }
+	return s
+}
+
+func testArticle(id, groups string) *posting.Article {
+	h := posting.ParseHeader([]byte("Newsgroups: "+groups+"\r\nMessage-ID: "+id+"\r\nSubject: test\r\n"))
+	return &posting.Article{Header:h,Body:[]byte("body\r\n")}
+}
+
+func store(t *testing.T, s *Spool, id, groups string) {
+	if rej,fail := s.StoreArticle(testArticle(id,groups)); rej || fail {
+		t.Fatalf("storing %s: rejected=%v failed=%v",id,rej,fail)
+	}
+}
+
+func number(s *Spool, group, id string) int64 {
+	for _,t := range s.idx.byId[id] {
+		if g,n := splitToken(t); g==group { return n }
+	}
+	return 0
+}
+
+func has(s *Spool, id string) bool {
+	return s.StatArticle(&fastnntp.Article{MessageId:[]byte(id),HasId:true})
+}
+
+func TestNumbersNotReused(t *testing.T) {
+	s,dir := tempSpool(t)
+	defer os.RemoveAll(dir)
+	if err := s.AddGroup("misc.test",'y'); err!=nil { t.Fatal(err) }
+	for i := 1; i<=4; i++ { store(t,s,fmt.Sprintf("<%d@x>",i),"misc.test") }
+	
+	// Remove the highest articles, and crash before the active file is written.
+	if err := s.Delete([]byte("<4@x>")); err!=nil { t.Fatal(err) }
+	if err := s.ExpireArticle("misc.test",3); err!=nil { t.Fatal(err) }
+	s = crash(t,s,dir)
+	if h,_ := s.GroupHigh([]byte("misc.test")); h!=4 { t.Errorf("high water mark %d after crash, want 4",h) }
+	store(t,s,"<5@x>","misc.test")
+	if n := number(s,"misc.test","<5@x>"); n!=5 { t.Errorf("new article got number %d, want 5",n) }
+	
+	// The high water mark survives compaction as well.
+	if err := s.Delete([]byte("<5@x>")); err!=nil { t.Fatal(err) }
+	if err := s.Close(); err!=nil { t.Fatal(err) }
+	s,err := Open(dir,"news.example")
+	if err!=nil { t.Fatal(err) }
+	defer s.Close()
+	store(t,s,"<6@x>","misc.test")
+	if n := number(s,"misc.test","<6@x>"); n!=6 { t.Errorf("new article got number %d, want 6",n) }
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	s,dir := tempSpool(t)
+	defer os.RemoveAll(dir)
+	s.AddGroup("misc.test",'y')
+	s.AddGroup("misc.other",'y')
+	for i := 1; i<=20; i++ { store(t,s,fmt.Sprintf("<%d@x>",i),"misc.test,misc.other") }
+	for i := 1; i<=20; i+=3 { s.Delete([]byte(fmt.Sprintf("<%d@x>",i))) }
+	check := func(s *Spool) {
+		for i := 1; i<=20; i++ {
+			id := fmt.Sprintf("<%d@x>",i)
+			want := i%3!=1
+			if has(s,id)!=want { t.Errorf("%s present=%v, want %v",id,!want,want) }
+			if want && number(s,"misc.other",id)!=int64(i) { t.Errorf("%s lost its crosspost",id) }
+		}
+	}
+	check(s)
+	if err := s.Close(); err!=nil { t.Fatal(err) }
+	s,err := Open(dir,"news.example")
+	if err!=nil { t.Fatal(err) }
+	check(s)
+	s = crash(t,s,dir)
+	check(s)
+	s.Close()
+}
+
+func TestIndexCorruption(t *testing.T) {
+	s,dir := tempSpool(t)
+	defer os.RemoveAll(dir)
+	s.AddGroup("misc.test",'y')
+	for i := 1; i<=5; i++ { store(t,s,fmt.Sprintf("<%d@x>",i),"misc.test") }
+	s.idx.log.Close()
+	
+	// Malformed and truncated lines are skipped.
+	fn := filepath.Join(dir,"index")
+	f,err := os.OpenFile(fn,os.O_WRONLY|os.O_APPEND,0644)
+	if err!=nil { t.Fatal(err) }
+	f.WriteString("garbage\nhigh misc.test\nhigh misc.test x\n<9@x> misc/test/9\n<3@x")
+	f.Close()
+	s,err = Open(dir,"news.example")
+	if err!=nil { t.Fatal(err) }
+	for i := 1; i<=5; i++ {
+		if !has(s,fmt.Sprintf("<%d@x>",i)) { t.Errorf("<%d@x> lost",i) }
+	}
+	if has(s,"<9@x>") { t.Error("token without an article file was kept") }
+	s.idx.log.Close()
+	
+	// Without an index, the articles are indexed again from their files.
+	os.Remove(fn)
+	s,err = Open(dir,"news.example")
+	if err!=nil { t.Fatal(err) }
+	defer s.Close()
+	for i := 1; i<=5; i++ {
+		if !has(s,fmt.Sprintf("<%d@x>",i)) { t.Errorf("<%d@x> not indexed again",i) }
+	}
+	// The high water mark may have been raised by the bogus token, but is never lowered.
+	store(t,s,"<6@x>","misc.test")
+	if n := number(s,"misc.test","<6@x>"); n<=5 { t.Errorf("new article got number %d, which was taken",n) }
+}
+
+func TestRemoveGroup(t *testing.T) {
+	s,dir := tempSpool(t)
+	defer os.RemoveAll(dir)
+	s.AddGroup("misc.test",'y')
+	s.AddGroup("misc.test.sub",'y')
+	s.AddGroup("misc.other",'y')
+	store(t,s,"<1@x>","misc.test")
+	store(t,s,"<2@x>","misc.test,misc.other")
+	store(t,s,"<3@x>","misc.test.sub")
+	if err := s.RemoveGroup("misc.test"); err!=nil { t.Fatal(err) }
+	if has(s,"<1@x>") { t.Error("article of the removed group is still present") }
+	if !has(s,"<2@x>") || number(s,"misc.test","<2@x>")!=0 { t.Error("crosspost not reduced to the other group") }
+	if !has(s,"<3@x>") { t.Error("article of the subgroup lost") }
+	
+	// The group comes back empty, and its numbering continues.
+	if err := s.AddGroup("misc.test",'y'); err!=nil { t.Fatal(err) }
+	check := func(s *Spool) {
+		g := s.groups["misc.test"]
+		if g.high!=3 || g.low!=3 || len(g.nums)!=1 { t.Errorf("misc.test: high=%d low=%d count=%d, want 3 3 1",g.high,g.low,len(g.nums)) }
+		if has(s,"<1@x>") { t.Error("removed article came back") }
+		if n := number(s,"misc.test","<4@x>"); n!=3 { t.Errorf("new article stored as %d, want 3",n) }
+		if number(s,"misc.test","<2@x>")!=0 { t.Error("removed crosspost came back") }
+		if !has(s,"<3@x>") { t.Error("article of the subgroup lost") }
+	}
+	store(t,s,"<4@x>","misc.test")
+	check(s)
+	if err := s.Close(); err!=nil { t.Fatal(err) }
+	s,err := Open(dir,"news.example")
+	if err!=nil { t.Fatal(err) }
+	check(s)
+	s = crash(t,s,dir)
+	check(s)
+	s.Close()
+}
+
+func TestGroupNames(t *testing.T) {
+	s,dir := tempSpool(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	for _,n := range []string{"alt.2600","2600","alt..x","alt/x",".alt","alt."} {
+		if s.AddGroup(n,'y')!=ErrBadGroupName { t.Errorf("group name %q accepted",n) }
+	}
+	for _,n := range []string{"alt","alt.2600a","comp.lang.c++"} {
+		if err := s.AddGroup(n,'y'); err!=nil { t.Errorf("group name %q refused: %v",n,err) }
+	}
+}
+
+func TestAssignedNumbers(t *testing.T) {
+	s,dir := tempSpool(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	s.AddGroup("misc.test",'y')
+	a := testArticle("<1@x>","misc.test")
+	a.Numbers = &posting.Numbering{Groups:[]string{"misc.test"},Numbers:[]int64{10}}
+	if rej,fail := s.StoreArticle(a); rej || fail { t.Fatal("article with assigned number not stored") }
+	if n := number(s,"misc.test","<1@x>"); n!=10 { t.Errorf("article stored as %d, want 10",n) }
+	
+	// A number, that is already taken, is refused.
+	a = testArticle("<2@x>","misc.test")
+	a.Numbers = &posting.Numbering{Groups:[]string{"misc.test"},Numbers:[]int64{10}}
+	if rej,_ := s.StoreArticle(a); !rej { t.Error("article with a taken number accepted") }
+	if has(s,"<2@x>") { t.Error("refused article is indexed") }
+}
+
+func TestConcurrentStore(t *testing.T) {
+	s,dir := tempSpool(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	s.AddGroup("misc.test",'y')
+	s.AddGroup("misc.other",'y')
+	const workers,each = 8,25
+	var wg sync.WaitGroup
+	for w := 0; w<workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i<each; i++ {
+				a := testArticle(fmt.Sprintf("<%d.%d@x>",w,i),"misc.test,misc.other")
+				if rej,fail := s.StoreArticle(a); rej || fail { t.Errorf("store failed") }
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _,g := range []string{"misc.test","misc.other"} {
+		grp := &fastnntp.Group{Group:[]byte(g)}
+		if !s.GetGroup(grp) { t.Fatal("group missing") }
+		if grp.Number!=workers*each || grp.Low!=1 || grp.High!=workers*each {
+			t.Errorf("%s: %d articles %d-%d",g,grp.Number,grp.Low,grp.High)
+		}
+	}
+}
@@ -26,6 +26,8 @@ SOFTWARE.
 package fastnntp
 
 import "sync"
+import "net"
+import "io"
 
 type Group struct{
 	Group []byte
@@ -84,6 +86,61 @@ type PostingCaps interface{
 	PerformPost(id []byte, r *DotReader) (rejected bool,failed bool)
 }
 
+/*
+Information about the client of an NNTP session.
+*/
+type Session struct{
+	// The remote address of the connection, if known.
+	RemoteAddr net.Addr
+	
+	// The name of the authenticated user. Nil, if no authentication occurred.
+	User []byte
+}
+
+/*
+An optional extension of PostingCaps. If the PostingCaps implement this
+interface, PerformPostSession is used in place of PerformPost.
+
+If a non-empty reason is returned on failure, it replaces the text of the
+failure response (POST and IHAVE only).
+*/
+type SessionPostingCaps interface{
+	PerformPostSession(id []byte, r *DotReader, s *Session) (rejected bool,failed bool,reason string)
+}
+
+/*
+An optional extension of PostingCaps. If the PostingCaps implement this
+interface, CheckPostIdSession is used in place of CheckPostId (IHAVE, CHECK).
+*/
+type SessionCheckCaps interface{
+	CheckPostIdSession(id []byte, s *Session) (wanted bool, possible bool)
+}
+
+/*
+An optional extension of PostingCaps. If the PostingCaps implement this
+interface, CheckPostSession is used in place of CheckPost (POST).
+
+If posting is not possible and a non-empty reason is returned, it replaces the
+text of the 440 response.
+*/
+type SessionCheckPostCaps interface{
+	CheckPostSession(s *Session) (possible bool, reason string)
+}
+
+/*
+An optional extension of ArticleCaps, for download accounting. If the
+ArticleCaps implement this interface, ARTICLE, HEAD, BODY and the overview
+commands (OVER, XOVER, HDR, XHDR) call AllowDownload, once their arguments
+have been checked (so that 412 and 420 take precedence); if it returns false,
+the command is answered with 502 (with the reason, if not empty). After the
+response has been sent, the number of bytes written is reported to
+AccountDownload.
+*/
+type DownloadAccountingCaps interface{
+	AllowDownload(s *Session) (ok bool, reason string)
+	AccountDownload(s *Session, n int64)
+}
+
 type GroupListingCaps interface{
 	// Performs a List-Active action.
 	// the argument 'wm' may be nil.
@@ -113,6 +170,20 @@ type LoginCaps interface{
 	AuthinfoUserPass(user, password []byte, oldh *Handler) (bool,*Handler)
 }
 
+/*
+An optional extension of LoginCaps, for bandwidth throttling. If the LoginCaps
+implement this interface, the responses of a session are written to the writer
+returned by ThrottleWriter, in place of the connection w. It is called when the
+connection is established, and again after a successful authentication (on the
+LoginCaps of the new Handler, if one is returned), so that the limits can
+depend on the user.
+
+Returning w itself disables throttling for the session.
+*/
+type ThrottleCaps interface{
+	ThrottleWriter(w io.Writer, s *Session) io.Writer
+}
+
 
 type Handler struct {
 	GroupCaps
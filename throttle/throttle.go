@@ -0,0 +1,214 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+Bandwidth throttling for sessions.
+
+A Throttle limits the rate, at which responses are written to a connection,
+with token buckets: one per connection, whose rate depends on the class of the
+user, and optionally a global one shared by all connections. The Throttle is
+plugged into a fastnntp.Handler by wrapping its LoginCaps with a LoginCaps of
+this package. Connections without any limit are not wrapped at all.
+
+Time is taken from a Clock, which can be replaced by a fake one in tests.
+*/
+package throttle
+
+import "github.com/byte-mug/fastnntp"
+import "io"
+import "sync"
+import "time"
+
+// The source of time.
+type Clock interface{
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// The real time.
+var System Clock = systemClock{}
+
+// A rate limit.
+type Limit struct{
+	// Bytes per second. Zero means: unlimited.
+	Rate float64
+	
+	// The number of bytes, that may be sent at once. Defaults to Rate (one second).
+	Burst int64
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst>0 { return float64(l.Burst) }
+	return l.Rate
+}
+
+/*
+A token bucket. It is safe for concurrent use.
+*/
+type Bucket struct{
+	Limit Limit
+	
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(l Limit) *Bucket { return &Bucket{Limit:l} }
+
+/*
+Takes n tokens at the given time, and returns, how long the caller has to
+wait before sending. The tokens may go into debt, so that concurrent callers
+queue up behind each other.
+*/
+func (b *Bucket) Reserve(n int64,now time.Time) time.Duration {
+	b.mu.Lock(); defer b.mu.Unlock()
+	burst := b.Limit.burst()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds()*b.Limit.Rate
+		if b.tokens>burst { b.tokens = burst }
+	}
+	if now.After(b.last) { b.last = now }
+	b.tokens -= float64(n)
+	if b.tokens>=0 { return 0 }
+	return time.Duration(-b.tokens/b.Limit.Rate*float64(time.Second))
+}
+
+/*
+A writer, that is limited by one or more buckets. Writes are split into chunks
+no larger than the smallest burst.
+*/
+type Writer struct{
+	w       io.Writer
+	buckets []*Bucket
+	clock   Clock
+	chunk   int
+}
+
+func NewWriter(w io.Writer,clock Clock,buckets ...*Bucket) *Writer {
+	if clock==nil { clock = System }
+	chunk := 1<<15
+	for _,b := range buckets {
+		if c := int(b.Limit.burst()); c<chunk { chunk = c }
+	}
+	if chunk<1 { chunk = 1 }
+	return &Writer{w,buckets,clock,chunk}
+}
+
+func (w *Writer) Write(p []byte) (n int,err error) {
+	for len(p)>0 {
+		c := p
+		if len(c)>w.chunk { c = c[:w.chunk] }
+		now := w.clock.Now()
+		var wait time.Duration
+		for _,b := range w.buckets {
+			if d := b.Reserve(int64(len(c)),now); d>wait { wait = d }
+		}
+		if wait>0 { w.clock.Sleep(wait) }
+		m,e := w.w.Write(c)
+		n += m
+		if e!=nil { return n,e }
+		p = p[m:]
+	}
+	return
+}
+
+/*
+The configuration of the throttling.
+*/
+type Throttle struct{
+	// The limits per connection, by class.
+	Classes map[string]Limit
+	
+	// Returns the class of a session. Defaults to "anonymous" for sessions
+	// without authentication, and "user" otherwise.
+	Classify func(s *fastnntp.Session) string
+	
+	// The limit shared by all connections. Zero means: no global limit.
+	Global Limit
+	
+	// Defaults to System.
+	Clock Clock
+	
+	once   sync.Once
+	global *Bucket
+}
+
+func (t *Throttle) class(s *fastnntp.Session) string {
+	if t.Classify!=nil { return t.Classify(s) }
+	if s!=nil && len(s.User)>0 { return "user" }
+	return "anonymous"
+}
+
+/*
+Returns the writer for a session. If neither its class nor the Throttle has a
+limit, it returns w itself.
+*/
+func (t *Throttle) Writer(w io.Writer,s *fastnntp.Session) io.Writer {
+	t.once.Do(func() {
+		if t.Global.Rate>0 { t.global = NewBucket(t.Global) }
+	})
+	var bs []*Bucket
+	if l := t.Classes[t.class(s)]; l.Rate>0 { bs = append(bs,NewBucket(l)) }
+	if t.global!=nil { bs = append(bs,t.global) }
+	if len(bs)==0 { return w }
+	return NewWriter(w,t.Clock,bs...)
+}
+
+/*
+Wraps a fastnntp.LoginCaps and adds throttling. It implements
+fastnntp.ThrottleCaps. If the wrapped LoginCaps return a new Handler on
+authentication, its LoginCaps are wrapped as well.
+*/
+type LoginCaps struct{
+	fastnntp.LoginCaps
+	Throttle *Throttle
+}
+
+func (c *LoginCaps) ThrottleWriter(w io.Writer, s *fastnntp.Session) io.Writer {
+	return c.Throttle.Writer(w,s)
+}
+
+func (c *LoginCaps) wrap(nh *fastnntp.Handler) *fastnntp.Handler {
+	if nh==nil { return nil }
+	if _,ok := nh.LoginCaps.(fastnntp.ThrottleCaps); ok { return nh }
+	n := *nh
+	n.LoginCaps = &LoginCaps{nh.LoginCaps,c.Throttle}
+	return &n
+}
+
+func (c *LoginCaps) AuthinfoUserOny(user []byte, oldh *fastnntp.Handler) (bool,*fastnntp.Handler) {
+	ok,nh := c.LoginCaps.AuthinfoUserOny(user,oldh)
+	return ok,c.wrap(nh)
+}
+func (c *LoginCaps) AuthinfoUserPass(user, password []byte, oldh *fastnntp.Handler) (bool,*fastnntp.Handler) {
+	ok,nh := c.LoginCaps.AuthinfoUserPass(user,password,oldh)
+	return ok,c.wrap(nh)
+}
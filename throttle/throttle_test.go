@@ -0,0 +1,170 @@
+/*
+MIT License
+
+Copyright (c) 2020 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package throttle
+
+import "github.com/byte-mug/fastnntp"
+import "bytes"
+import "math"
+import "sync"
+import "testing"
+import "time"
+
+// A Clock, that only moves, when it is slept on.
+type fakeClock struct{
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock { return &fakeClock{now:time.Date(2020,1,1,0,0,0,0,time.UTC)} }
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock(); defer c.mu.Unlock()
+	return c.now
+}
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock(); defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+func (c *fakeClock) since(t time.Time) time.Duration { return c.Now().Sub(t) }
+
+// Records the sizes of the writes.
+type chunkWriter struct{
+	bytes.Buffer
+	max int
+}
+func (w *chunkWriter) Write(p []byte) (int,error) {
+	if len(p)>w.max { w.max = len(p) }
+	return w.Buffer.Write(p)
+}
+
+func near(got, want float64) bool { return math.Abs(got-want)<=want/100 }
+
+func TestBucket(t *testing.T) {
+	now := time.Date(2020,1,1,0,0,0,0,time.UTC)
+	b := NewBucket(Limit{Rate:1000,Burst:500})
+	if d := b.Reserve(500,now); d!=0 { t.Errorf("burst: wait %v",d) }
+	if d := b.Reserve(100,now); d!=100*time.Millisecond { t.Errorf("debt: wait %v",d) }
+	if d := b.Reserve(100,now); d!=200*time.Millisecond { t.Errorf("queued: wait %v",d) }
+	
+	// Refilled, but never beyond the burst.
+	now = now.Add(time.Hour)
+	if d := b.Reserve(500,now); d!=0 { t.Errorf("refilled: wait %v",d) }
+	if d := b.Reserve(1,now); d==0 { t.Error("bucket filled beyond the burst") }
+	
+	// A clock going backwards does not add tokens.
+	if d := b.Reserve(1,now.Add(-time.Minute)); d<2*time.Millisecond { t.Errorf("backwards: wait %v",d) }
+	
+	// The burst defaults to the rate.
+	b = NewBucket(Limit{Rate:1000})
+	if b.Reserve(1000,now)!=0 || b.Reserve(1,now)==0 { t.Error("default burst") }
+}
+
+func TestWriterRate(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	var out chunkWriter
+	w := NewWriter(&out,clock,NewBucket(Limit{Rate:10000,Burst:1000}))
+	data := bytes.Repeat([]byte("0123456789abcdef"),1<<16)
+	for p := data; len(p)>0; {
+		n := 3000
+		if n>len(p) { n = len(p) }
+		if m,err := w.Write(p[:n]); m!=n || err!=nil { t.Fatalf("wrote %d of %d: %v",m,n,err) }
+		p = p[n:]
+	}
+	if !bytes.Equal(out.Bytes(),data) { t.Fatal("data changed") }
+	if out.max>1000 { t.Errorf("chunk of %d bytes exceeds the burst",out.max) }
+	
+	// The burst is free, the rest is sent at the rate.
+	want := float64(len(data)-1000)/10000
+	if got := clock.since(start).Seconds(); !near(got,want) { t.Errorf("took %.2fs, want %.2fs",got,want) }
+}
+
+func TestGlobalLimit(t *testing.T) {
+	clock := newFakeClock()
+	th := &Throttle{
+		Classes: map[string]Limit{"anonymous":{Rate:8000},"user":{Rate:20000}},
+		Global: Limit{Rate:10000},
+		Clock: clock,
+	}
+	var a,b bytes.Buffer
+	wa := th.Writer(&a,nil)
+	wb := th.Writer(&b,&fastnntp.Session{User:[]byte("joe")})
+	
+	// Each session alone is below its own limit, together they exceed the global one.
+	start := clock.Now()
+	chunk := make([]byte,1000)
+	for i := 0; i<200; i++ {
+		wa.Write(chunk)
+		wb.Write(chunk)
+	}
+	// After the global burst, both share the global rate.
+	want := float64(a.Len()+b.Len()-10000)/10000
+	if got := clock.since(start).Seconds(); !near(got,want) { t.Errorf("took %.2fs, want %.2fs",got,want) }
+	
+	// Alone, a session gets its own limit.
+	a.Reset()
+	clock.Sleep(time.Hour)
+	start = clock.Now()
+	for i := 0; i<400; i++ { wa.Write(chunk) }
+	want = float64(a.Len()-8000)/8000
+	if got := clock.since(start).Seconds(); !near(got,want) { t.Errorf("took %.2fs, want %.2fs",got,want) }
+}
+
+func TestUnlimited(t *testing.T) {
+	var buf bytes.Buffer
+	th := &Throttle{Classes:map[string]Limit{"user":{Rate:1000}}}
+	if w := th.Writer(&buf,nil); w!=&buf { t.Error("session without a limit is throttled") }
+	if w := th.Writer(&buf,&fastnntp.Session{User:[]byte("joe")}); w==&buf { t.Error("user class is not throttled") }
+	
+	th.Classify = func(s *fastnntp.Session) string { return "free" }
+	if w := th.Writer(&buf,&fastnntp.Session{User:[]byte("joe")}); w!=&buf { t.Error("Classify is ignored") }
+	
+	th = &Throttle{Global:Limit{Rate:1000}}
+	if w := th.Writer(&buf,nil); w==&buf { t.Error("global limit is ignored") }
+}
+
+type testLogin struct{ h *fastnntp.Handler }
+
+func (l *testLogin) AuthinfoDone(h *fastnntp.Handler) bool { return false }
+func (l *testLogin) AuthinfoCheckPrivilege(p fastnntp.LoginPriv, h *fastnntp.Handler) bool { return true }
+func (l *testLogin) AuthinfoUserOny(user []byte, oldh *fastnntp.Handler) (bool,*fastnntp.Handler) { return false,nil }
+func (l *testLogin) AuthinfoUserPass(user, password []byte, oldh *fastnntp.Handler) (bool,*fastnntp.Handler) { return true,l.h }
+
+func TestLoginCaps(t *testing.T) {
+	th := &Throttle{Classes:map[string]Limit{"user":{Rate:1000}}}
+	inner := &testLogin{h:&fastnntp.Handler{LoginCaps:&testLogin{}}}
+	var lc fastnntp.LoginCaps = &LoginCaps{inner,th}
+	if _,ok := lc.(fastnntp.ThrottleCaps); !ok { t.Fatal("LoginCaps do not implement ThrottleCaps") }
+	
+	// The Handler after authentication is throttled as well.
+	ok,nh := lc.AuthinfoUserPass([]byte("joe"),[]byte("pw"),nil)
+	if !ok || nh==nil { t.Fatal("authentication failed") }
+	tc,isTc := nh.LoginCaps.(fastnntp.ThrottleCaps)
+	if !isTc { t.Fatal("new Handler is not throttled") }
+	var buf bytes.Buffer
+	if tc.ThrottleWriter(&buf,&fastnntp.Session{User:[]byte("joe")})==&buf { t.Error("user class is not throttled") }
+	if inner.h.LoginCaps==nh.LoginCaps { t.Error("original Handler was modified") }
+	
+	if ok,nh = lc.AuthinfoUserOny([]byte("joe"),nil); ok || nh!=nil { t.Error("AuthinfoUserOny") }
+}